@@ -0,0 +1,244 @@
+package common_claimcheck
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	GZIP_ENCODING = "gzip+base64"
+
+	DATABASE = "claim_check"
+
+	PURGE_INTERVAL = time.Hour
+)
+
+type Settings struct {
+	Store            string
+	Path             string
+	MaxInlineBytes   int               `mapstructure:"max_inline_bytes"`
+	MinCompressBytes int               `mapstructure:"min_compress_bytes"`
+	Compression      map[string]string `mapstructure:"compression"`
+	RetentionHours   int               `mapstructure:"retention_hours"`
+}
+
+// ClaimCheck compresses message bodies for the topics configured to and moves
+// the ones still above MaxInlineBytes to a BodyStore, leaving a reference behind
+type ClaimCheck struct {
+	Settings Settings
+	Store    BodyStore
+
+	mutex sync.Mutex
+}
+
+// NewClaimCheck reads the "claim_check" section of the provisioner configuration:
+//
+//	{"store": "gridfs", "max_inline_bytes": 524288, "min_compress_bytes": 1024,
+//	 "compression": {"messaging_cmp": "gzip"}, "retention_hours": 168}
+//
+// the filesystem store takes its directory from "path". Bodies are kept for
+// retention_hours, at least as long as the topics carrying their references
+func NewClaimCheck(configuration map[string]interface{}) (*ClaimCheck, error) {
+	settings := Settings{Store: GRIDFS_STORE, MaxInlineBytes: 512 * 1024, MinCompressBytes: 1024, RetentionHours: 168}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{WeaklyTypedInput: true, Result: &settings})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(configuration["claim_check"]); err != nil {
+		return nil, fmt.Errorf("invalid claim_check configuration: %v", err)
+	}
+
+	for topic, compression := range settings.Compression {
+		if compression != "gzip" && compression != "none" {
+			return nil, fmt.Errorf("unknown compression %s for %s", compression, topic)
+		}
+	}
+
+	if settings.RetentionHours < 1 {
+		return nil, fmt.Errorf("claim check retention_hours must be positive")
+	}
+
+	if settings.Store == FILESYSTEM_STORE && settings.Path == "" {
+		settings.Path = filepath.Join(os.TempDir(), "kafka-message-processor", "bodies")
+	}
+
+	claimCheck := &ClaimCheck{Settings: settings}
+	switch settings.Store {
+	case FILESYSTEM_STORE:
+		claimCheck.Store = &FilesystemStore{Directory: settings.Path}
+	case GRIDFS_STORE:
+		// Connected on first use, most deployments never exceed the inline limit
+	default:
+		return nil, fmt.Errorf("unknown claim check store %s", settings.Store)
+	}
+
+	return claimCheck, nil
+}
+
+func (c *ClaimCheck) store() (BodyStore, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.Store == nil {
+		db, _, err := common_mongo.Connect(DATABASE)
+		if err != nil {
+			return nil, err
+		}
+		c.Store = &GridFSStore{Database: db, Prefix: "bodies"}
+	}
+
+	return c.Store, nil
+}
+
+// Prepare returns the message as it should be produced to topic, a message
+// whose body is already stored keeps its reference
+func (c *ClaimCheck) Prepare(topic string, message common_models.Message) (common_models.Message, error) {
+	if message.BodyReference != "" {
+		return message, nil
+	}
+	body := []byte(message.Message)
+
+	if c.Settings.Compression[topic] == "gzip" && len(body) >= c.Settings.MinCompressBytes {
+		compressed, err := compress(body)
+		if err != nil {
+			return message, err
+		}
+
+		message.Message = base64.StdEncoding.EncodeToString(compressed)
+		message.BodyEncoding = GZIP_ENCODING
+		body = []byte(message.Message)
+	}
+
+	if c.Settings.MaxInlineBytes > 0 && len(body) > c.Settings.MaxInlineBytes {
+		store, err := c.store()
+		if err != nil {
+			return message, err
+		}
+
+		reference, err := store.Put(message.Id.Hex()+"-"+topic, body)
+		if err != nil {
+			return message, err
+		}
+
+		message.Message = ""
+		message.BodyReference = reference
+	}
+
+	return message, nil
+}
+
+// Resolve restores the original body of a prepared message
+func (c *ClaimCheck) Resolve(message common_models.Message) (common_models.Message, error) {
+	if message.BodyReference != "" {
+		store, err := c.store()
+		if err != nil {
+			return message, err
+		}
+
+		body, err := store.Get(message.BodyReference)
+		if err != nil {
+			return message, err
+		}
+
+		message.Message = string(body)
+		message.BodyReference = ""
+	}
+
+	switch message.BodyEncoding {
+	case "":
+	case GZIP_ENCODING:
+		compressed, err := base64.StdEncoding.DecodeString(message.Message)
+		if err != nil {
+			return message, err
+		}
+
+		body, err := decompress(compressed)
+		if err != nil {
+			return message, err
+		}
+
+		message.Message = string(body)
+		message.BodyEncoding = ""
+	default:
+		return message, fmt.Errorf("unknown body encoding %s", message.BodyEncoding)
+	}
+
+	return message, nil
+}
+
+// Reuse puts the stored body of the message it was resolved from back on a
+// resolved message, producing it again doesn't store the body a second time
+func (c *ClaimCheck) Reuse(resolved common_models.Message, stored common_models.Message) common_models.Message {
+	if stored.BodyReference != "" {
+		resolved.Message = ""
+		resolved.BodyEncoding = stored.BodyEncoding
+		resolved.BodyReference = stored.BodyReference
+	}
+
+	return resolved
+}
+
+// PurgeExpired removes the bodies older than the retention every
+// PURGE_INTERVAL, the producer runs it since it stores nearly every body.
+// Nothing is purged when offload is disabled, and the GridFS store is only
+// purged once something was stored so idle producers never connect to it
+func (c *ClaimCheck) PurgeExpired() {
+	if c.Settings.MaxInlineBytes <= 0 {
+		return
+	}
+
+	for {
+		if store := c.connectedStore(); store != nil {
+			before := time.Now().Add(-time.Duration(c.Settings.RetentionHours) * time.Hour)
+			if removed, err := store.Purge(before); err != nil {
+				fmt.Printf("Couldn't purge claim check bodies: %v\n", err)
+			} else if removed > 0 {
+				fmt.Printf("Purged %d claim check bodies\n", removed)
+			}
+		}
+
+		time.Sleep(PURGE_INTERVAL)
+	}
+}
+
+func (c *ClaimCheck) connectedStore() BodyStore {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.Store
+}
+
+func compress(body []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
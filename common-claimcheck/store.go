@@ -0,0 +1,148 @@
+package common_claimcheck
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	GRIDFS_STORE     = "gridfs"
+	FILESYSTEM_STORE = "filesystem"
+
+	GRIDFS_PREFIX     = "gridfs://"
+	FILESYSTEM_PREFIX = "file://"
+)
+
+var ErrInvalidReference = errors.New("invalid claim check reference")
+
+// BodyStore keeps message bodies too big to travel through Kafka, Purge
+// removes the ones stored before a time and returns how many it removed
+type BodyStore interface {
+	Put(name string, body []byte) (string, error)
+	Get(reference string) ([]byte, error)
+	Purge(before time.Time) (int, error)
+}
+
+type GridFSStore struct {
+	Database *mgo.Database
+	Prefix   string
+}
+
+func (s *GridFSStore) Put(name string, body []byte) (string, error) {
+	session := s.Database.Session.Copy()
+	defer session.Close()
+
+	gridFS := s.Database.With(session).GridFS(s.Prefix)
+	gridFS.Remove(name)
+
+	file, err := gridFS.Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	return GRIDFS_PREFIX + name, nil
+}
+
+func (s *GridFSStore) Get(reference string) ([]byte, error) {
+	if !strings.HasPrefix(reference, GRIDFS_PREFIX) {
+		return nil, ErrInvalidReference
+	}
+
+	session := s.Database.Session.Copy()
+	defer session.Close()
+
+	file, err := s.Database.With(session).GridFS(s.Prefix).Open(strings.TrimPrefix(reference, GRIDFS_PREFIX))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func (s *GridFSStore) Purge(before time.Time) (int, error) {
+	session := s.Database.Session.Copy()
+	defer session.Close()
+
+	gridFS := s.Database.With(session).GridFS(s.Prefix)
+	iter := gridFS.Find(bson.M{"uploadDate": bson.M{"$lt": before}}).Select(bson.M{"_id": 1}).Iter()
+
+	removed := 0
+	file := struct {
+		Id interface{} `bson:"_id"`
+	}{}
+	for iter.Next(&file) {
+		if err := gridFS.RemoveId(file.Id); err != nil {
+			iter.Close()
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, iter.Close()
+}
+
+// FilesystemStore writes bodies to a directory shared by the producer and the dispatcher
+type FilesystemStore struct {
+	Directory string
+}
+
+func (s *FilesystemStore) Put(name string, body []byte) (string, error) {
+	if err := os.MkdirAll(s.Directory, 0700); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(s.Directory, name), body, 0600); err != nil {
+		return "", err
+	}
+
+	return FILESYSTEM_PREFIX + name, nil
+}
+
+// References only name a file, anything resembling a path is refused
+func (s *FilesystemStore) Get(reference string) ([]byte, error) {
+	name := strings.TrimPrefix(reference, FILESYSTEM_PREFIX)
+	if !strings.HasPrefix(reference, FILESYSTEM_PREFIX) || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, ErrInvalidReference
+	}
+
+	return ioutil.ReadFile(filepath.Join(s.Directory, name))
+}
+
+func (s *FilesystemStore) Purge(before time.Time) (int, error) {
+	entries, err := ioutil.ReadDir(s.Directory)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !entry.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Directory, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,78 @@
+package common_config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Endpoints resolves the addresses configured for a key. A value can be a
+// single address, a comma separated static list or a DNS SRV reference
+// written as "<scheme>+srv://<record name><path>", for example
+// "http+srv://_provisioner._tcp.messaging.internal" which resolves to one
+// "http://<target>:<port>" address per SRV record ordered by priority and weight.
+// Mongo URLs aren't endpoint lists, common_mongo parses them whole
+func Endpoints(key string) ([]string, error) {
+	value := Get(key, "")
+	if value == "" {
+		return []string{}, fmt.Errorf("no address configured for %s", key)
+	}
+
+	endpoints := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		resolved, err := resolveEntry(entry)
+		if err != nil {
+			return []string{}, err
+		}
+		endpoints = append(endpoints, resolved...)
+	}
+
+	if len(endpoints) == 0 {
+		return endpoints, fmt.Errorf("no address configured for %s", key)
+	}
+
+	return endpoints, nil
+}
+
+// Endpoint returns the preferred address configured for a key
+func Endpoint(key string) (string, error) {
+	endpoints, err := Endpoints(key)
+	if err != nil {
+		return "", err
+	}
+
+	return endpoints[0], nil
+}
+
+func resolveEntry(entry string) ([]string, error) {
+	parsed, err := url.Parse(entry)
+	if err != nil || !strings.HasSuffix(parsed.Scheme, "+srv") {
+		return []string{strings.TrimSuffix(entry, "/")}, nil
+	}
+
+	scheme := strings.TrimSuffix(parsed.Scheme, "+srv")
+	_, records, err := net.LookupSRV("", "", parsed.Hostname())
+	if err != nil {
+		return []string{}, err
+	}
+	if len(records) == 0 {
+		return []string{}, errors.New("no SRV records found for " + parsed.Hostname())
+	}
+
+	endpoints := []string{}
+	for _, record := range records {
+		resolved := *parsed
+		resolved.Scheme = scheme
+		resolved.Host = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port))
+		endpoints = append(endpoints, strings.TrimSuffix(resolved.String(), "/"))
+	}
+
+	return endpoints, nil
+}
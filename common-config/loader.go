@@ -0,0 +1,141 @@
+package common_config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Keys understood by the loader, each one can be given as a command line
+// flag (-provisioning-url), an environment variable (PROVISIONING_URL) or an
+// entry of the JSON file pointed by -config-file / CONFIG_FILE, in that order of precedence
+const (
+	CONFIG_FILE      = "config_file"
+	CONFIG_NAMESPACE = "config_namespace"
+	ENVIRONMENT      = "environment"
+	TENANT           = "tenant"
+	LISTEN_ADDRESS   = "listen_address"
+	PROVISIONING_URL = "provisioning_url"
+	CORE_URL         = "core_url"
+	PRODUCER_URL     = "producer_url"
+	GELF_URL         = "gelf_url"
+	MONGODB_URL      = "mongodb_url"
+	CONFIG_CACHE_DIR = "config_cache_dir"
+	STARTUP_ATTEMPTS = "startup_attempts"
+
+	KAFKA_SECURITY_PROTOCOL        = "kafka_security_protocol"
+	KAFKA_SASL_MECHANISM           = "kafka_sasl_mechanism"
+	KAFKA_SASL_USERNAME            = "kafka_sasl_username"
+	KAFKA_SASL_PASSWORD            = "kafka_sasl_password"
+	KAFKA_SASL_PASSWORD_FILE       = "kafka_sasl_password_file"
+	KAFKA_SSL_CA_LOCATION          = "kafka_ssl_ca_location"
+	KAFKA_SSL_CERTIFICATE_LOCATION = "kafka_ssl_certificate_location"
+	KAFKA_SSL_KEY_LOCATION         = "kafka_ssl_key_location"
+	KAFKA_SSL_KEY_PASSWORD         = "kafka_ssl_key_password"
+
+	SCHEMA_REGISTRY_URL = "schema_registry_url"
+)
+
+var defaults = map[string]string{
+	PROVISIONING_URL: "http://localhost:3010",
+	CORE_URL:         "http://localhost:3000",
+	PRODUCER_URL:     "http://localhost:3020",
+	GELF_URL:         "http://localhost:5555/gelf",
+	MONGODB_URL:      "mongodb://localhost:27017",
+	STARTUP_ATTEMPTS: "5",
+}
+
+var knownKeys = []string{
+	CONFIG_FILE, CONFIG_NAMESPACE, ENVIRONMENT, TENANT, LISTEN_ADDRESS, PROVISIONING_URL, CORE_URL, PRODUCER_URL, GELF_URL, MONGODB_URL, CONFIG_CACHE_DIR, STARTUP_ATTEMPTS,
+	KAFKA_SECURITY_PROTOCOL, KAFKA_SASL_MECHANISM, KAFKA_SASL_USERNAME, KAFKA_SASL_PASSWORD, KAFKA_SASL_PASSWORD_FILE,
+	KAFKA_SSL_CA_LOCATION, KAFKA_SSL_CERTIFICATE_LOCATION, KAFKA_SSL_KEY_LOCATION, KAFKA_SSL_KEY_PASSWORD,
+	SCHEMA_REGISTRY_URL,
+}
+
+var loadOnce sync.Once
+var flagValues map[string]*string = map[string]*string{}
+var fileValues map[string]string = map[string]string{}
+
+// Load parses the command line flags and the configuration file, it is safe
+// to call more than once and Get calls it implicitly
+func Load() error {
+	var err error
+
+	loadOnce.Do(func() {
+		for _, key := range knownKeys {
+			if flag.Lookup(flagName(key)) == nil {
+				flagValues[key] = flag.String(flagName(key), "", fmt.Sprintf("overrides the %s environment variable", envName(key)))
+			}
+		}
+		if !flag.Parsed() {
+			flag.Parse()
+		}
+
+		err = loadFile(lookup(CONFIG_FILE))
+	})
+
+	return err
+}
+
+// Get returns the value of a key, falling back to the loader defaults and then to fallback
+func Get(key string, fallback string) string {
+	if err := Load(); err != nil {
+		fmt.Printf("Couldn't load the configuration file: %v\n", err)
+	}
+
+	if value := lookup(key); value != "" {
+		return value
+	}
+
+	if value, ok := defaults[key]; ok {
+		return value
+	}
+
+	return fallback
+}
+
+func lookup(key string) string {
+	if value, ok := flagValues[key]; ok && *value != "" {
+		return *value
+	}
+
+	if value := os.Getenv(envName(key)); value != "" {
+		return value
+	}
+
+	return fileValues[key]
+}
+
+func loadFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		fileValues[strings.ToLower(key)] = fmt.Sprint(value)
+	}
+
+	return nil
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+func envName(key string) string {
+	return strings.ToUpper(key)
+}
@@ -0,0 +1,21 @@
+package common_config
+
+import "strings"
+
+// Namespace builds the provisioner namespace for a service, CONFIG_NAMESPACE
+// takes precedence, otherwise ENVIRONMENT and TENANT are joined with the service name
+func Namespace(service string) string {
+	if namespace := Get(CONFIG_NAMESPACE, ""); namespace != "" {
+		return strings.Trim(namespace, "/")
+	}
+
+	segments := []string{}
+	for _, segment := range []string{Get(ENVIRONMENT, ""), Get(TENANT, ""), service} {
+		segment = strings.Trim(segment, "/ ")
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
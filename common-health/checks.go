@@ -0,0 +1,112 @@
+package common_health
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type check struct {
+	run      func() error
+	critical bool
+}
+
+var checksMutex sync.RWMutex
+var checks map[string]check = map[string]check{}
+
+var startedOn = time.Now()
+
+// RegisterCheck adds a dependency probed on every readiness request, a failing
+// critical check makes the service not ready while any other one only degrades it
+func RegisterCheck(component string, critical bool, run func() error) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+
+	checks[component] = check{run: run, critical: critical}
+}
+
+// Evaluate runs the registered checks on top of the state reported during
+// startup, components still starting up aren't probed
+func Evaluate() (bool, map[string]ComponentStatus) {
+	result := Components()
+
+	checksMutex.RLock()
+	registered := map[string]check{}
+	for name, c := range checks {
+		registered[name] = c
+	}
+	checksMutex.RUnlock()
+
+	for name, c := range registered {
+		if status, ok := result[name]; ok && status.Status == NOT_READY {
+			continue
+		}
+
+		if err := c.run(); err != nil {
+			if c.critical {
+				result[name] = ComponentStatus{Status: NOT_READY, Detail: err.Error()}
+			} else {
+				result[name] = ComponentStatus{Status: DEGRADED, Detail: err.Error()}
+			}
+		} else if _, ok := result[name]; !ok {
+			result[name] = ComponentStatus{Status: READY}
+		}
+	}
+
+	ready := true
+	for _, status := range result {
+		if status.Status == NOT_READY {
+			ready = false
+		}
+	}
+
+	return ready, result
+}
+
+func LivezHandler(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusOK, map[string]interface{}{"status": "alive", "uptime_seconds": int64(time.Since(startedOn).Seconds())})
+}
+
+var sensitiveFragments = []string{"host", "address", "url", "password", "secret", "token", "credential", "sasl", "key"}
+
+// Redact masks the values of sensitive looking keys at any depth of a configuration document
+func Redact(configuration map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range configuration {
+		if sensitive(key) {
+			result[key] = "[redacted]"
+			continue
+		}
+
+		result[key] = redactValue(value)
+	}
+
+	return result
+}
+
+func redactValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return Redact(typed)
+	case []interface{}:
+		redacted := make([]interface{}, len(typed))
+		for i, element := range typed {
+			redacted[i] = redactValue(element)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, fragment := range sensitiveFragments {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
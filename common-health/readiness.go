@@ -0,0 +1,123 @@
+package common_health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	READY     = "ready"
+	NOT_READY = "not_ready"
+	DEGRADED  = "degraded"
+)
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var mutex sync.RWMutex
+var components map[string]ComponentStatus = map[string]ComponentStatus{}
+
+// Register marks a component the service depends on as not ready until it reports otherwise
+func Register(component string) {
+	SetNotReady(component, "starting")
+}
+
+func SetReady(component string) {
+	set(component, ComponentStatus{Status: READY})
+}
+
+func SetNotReady(component string, detail string) {
+	set(component, ComponentStatus{Status: NOT_READY, Detail: detail})
+}
+
+// SetDegraded keeps the service ready while reporting it runs on a fallback
+func SetDegraded(component string, detail string) {
+	set(component, ComponentStatus{Status: DEGRADED, Detail: detail})
+}
+
+func set(component string, status ComponentStatus) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	components[component] = status
+}
+
+func Ready() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, status := range components {
+		if status.Status == NOT_READY {
+			return false
+		}
+	}
+
+	return true
+}
+
+func Components() map[string]ComponentStatus {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	result := map[string]ComponentStatus{}
+	for component, status := range components {
+		result[component] = status
+	}
+
+	return result
+}
+
+func ReadyzHandler(w http.ResponseWriter, req *http.Request) {
+	ready, statuses := Evaluate()
+
+	status, code := READY, http.StatusOK
+	if !ready {
+		status, code = NOT_READY, http.StatusServiceUnavailable
+	}
+
+	WriteJSON(w, code, map[string]interface{}{"status": status, "components": statuses})
+}
+
+// RequireReady answers 503 to every request but the probes until the service is ready
+func RequireReady() martini.Handler {
+	return func(w http.ResponseWriter, req *http.Request, c martini.Context) {
+		if req.URL.Path == "/readyz" || req.URL.Path == "/livez" || Ready() {
+			c.Next()
+			return
+		}
+
+		w.Header().Set("Retry-After", "5")
+		WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "service is not ready", "components": Components()})
+	}
+}
+
+var routes map[string]http.HandlerFunc = make(map[string]http.HandlerFunc)
+
+// Handle adds a route to the server started by Serve, call it before Serve
+func Handle(pattern string, handler http.HandlerFunc) {
+	routes[pattern] = handler
+}
+
+// Serve exposes the probes for services that don't run an HTTP server of their own
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", LivezHandler)
+	mux.HandleFunc("/readyz", ReadyzHandler)
+	for pattern, handler := range routes {
+		mux.HandleFunc(pattern, handler)
+	}
+
+	go http.ListenAndServe(address, mux)
+}
+
+// WriteJSON answers body encoded as JSON with the given status code
+func WriteJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,126 @@
+package common_kafka
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// ConfigurationError is returned when the provisioner configuration lacks a value the clients need
+type ConfigurationError struct {
+	Key string
+}
+
+func (e *ConfigurationError) Error() string {
+	return fmt.Sprintf("kafka configuration is missing %s", e.Key)
+}
+
+// ConfigMap builds the librdkafka configuration shared by every client out
+// of the provisioner configuration and the security settings, overrides are applied last
+func ConfigMap(configuration map[string]interface{}, overrides kafka.ConfigMap) (*kafka.ConfigMap, error) {
+	host, ok := configuration["kafka_host"].(string)
+	if !ok || host == "" {
+		return nil, &ConfigurationError{Key: "kafka_host"}
+	}
+
+	configMap, err := securityConfig(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	configMap["bootstrap.servers"] = host
+	for key, value := range overrides {
+		configMap[key] = value
+	}
+
+	return &configMap, nil
+}
+
+// NewConsumer builds a consumer of groupID, properties the service depends on
+// go in required and take precedence over the consumer_config tuning
+func NewConsumer(configuration map[string]interface{}, groupID string, required ...kafka.ConfigMap) (*kafka.Consumer, error) {
+	tuning, err := tuningConfig(configuration, CONSUMER_CONFIG, consumerProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := kafka.ConfigMap{
+		"group.id":          groupID,
+		"auto.offset.reset": "earliest",
+	}
+	for key, value := range tuning {
+		overrides[key] = value
+	}
+	for _, properties := range required {
+		for key, value := range properties {
+			overrides[key] = value
+		}
+	}
+
+	configMap, err := ConfigMap(configuration, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafka.NewConsumer(configMap)
+}
+
+func NewProducer(configuration map[string]interface{}) (*kafka.Producer, error) {
+	tuning, err := tuningConfig(configuration, PRODUCER_CONFIG, producerProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkIdempotence(tuning); err != nil {
+		return nil, err
+	}
+
+	overrides := kafka.ConfigMap{}
+	for key, value := range tuning {
+		overrides[key] = value
+	}
+	// Idempotence keeps retried batches from duplicating or reordering messages within a partition
+	overrides["enable.idempotence"] = true
+
+	configMap, err := ConfigMap(configuration, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafka.NewProducer(configMap)
+}
+
+// Per key ordering depends on the idempotent producer, producer_config may
+// tune the properties it relies on but not loosen them
+func checkIdempotence(tuning kafka.ConfigMap) error {
+	for property, value := range tuning {
+		text := fmt.Sprint(value)
+
+		switch property {
+		case "enable.idempotence":
+			if text != "true" {
+				return &TuningError{Section: PRODUCER_CONFIG, Property: property, Reason: "can't disable the idempotent producer"}
+			}
+		case "acks", "request.required.acks":
+			if text != "all" && text != "-1" {
+				return &TuningError{Section: PRODUCER_CONFIG, Property: property, Reason: "must be all or -1 for the idempotent producer"}
+			}
+		case "max.in.flight.requests.per.connection":
+			if inFlight, err := strconv.Atoi(text); err != nil || inFlight < 1 || inFlight > 5 {
+				return &TuningError{Section: PRODUCER_CONFIG, Property: property, Reason: "must be between 1 and 5 for the idempotent producer"}
+			}
+		}
+	}
+
+	return nil
+}
+
+func NewAdminClient(configuration map[string]interface{}) (*kafka.AdminClient, error) {
+	configMap, err := ConfigMap(configuration, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafka.NewAdminClient(configMap)
+}
@@ -0,0 +1,49 @@
+package common_kafka
+
+import (
+	"testing"
+)
+
+func TestNewProducerRefusesLooserIdempotence(t *testing.T) {
+	cases := map[string]interface{}{
+		"enable.idempotence":                    false,
+		"acks":                                  "1",
+		"request.required.acks":                 float64(0),
+		"max.in.flight.requests.per.connection": float64(6),
+	}
+
+	for property, value := range cases {
+		configuration := map[string]interface{}{
+			"kafka_host":    "localhost:9092",
+			PRODUCER_CONFIG: map[string]interface{}{property: value},
+		}
+
+		producer, err := NewProducer(configuration)
+		if err == nil {
+			producer.Close()
+			t.Errorf("%s=%v was accepted", property, value)
+			continue
+		}
+		if tuningError, ok := err.(*TuningError); !ok || tuningError.Property != property {
+			t.Errorf("%s=%v failed with %v", property, value, err)
+		}
+	}
+}
+
+func TestNewProducerKeepsIdempotence(t *testing.T) {
+	configuration := map[string]interface{}{
+		"kafka_host": "localhost:9092",
+		PRODUCER_CONFIG: map[string]interface{}{
+			"enable.idempotence":                    true,
+			"acks":                                  "all",
+			"max.in.flight.requests.per.connection": float64(5),
+			"linger.ms":                             float64(10),
+		},
+	}
+
+	producer, err := NewProducer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer.Close()
+}
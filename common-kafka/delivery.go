@@ -0,0 +1,22 @@
+package common_kafka
+
+import (
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// LogDeliveryReports drains the producer events, it has to run for the
+// lifetime of a producer created without a delivery channel
+func LogDeliveryReports(producer *kafka.Producer) {
+	for event := range producer.Events() {
+		switch e := event.(type) {
+		case *kafka.Message:
+			if e.TopicPartition.Error != nil {
+				fmt.Printf("Delivery failed to %v: %v\n", e.TopicPartition, e.TopicPartition.Error)
+			}
+		case kafka.Error:
+			fmt.Printf("Producer error: %v\n", e)
+		}
+	}
+}
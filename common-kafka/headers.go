@@ -0,0 +1,99 @@
+package common_kafka
+
+import (
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+const (
+	HEADER_MESSAGE_ID  = "message-id"
+	HEADER_TYPE        = "type"
+	HEADER_SENDER      = "sender"
+	HEADER_CREATED_ON  = "created-on"
+	HEADER_RECEIVED_ON = "received-on"
+	HEADER_ATTEMPT     = "attempt"
+	HEADER_TRACEPARENT = "traceparent"
+	HEADER_CAMPAIGN_ID = "campaign-id"
+	HEADER_STATUS      = "status"
+)
+
+// MessageHeaders carries the metadata consumers need to route or measure a
+// message without decoding its body
+type MessageHeaders struct {
+	MessageId   string
+	Type        string
+	Sender      string
+	CreatedOn   int64
+	ReceivedOn  int64
+	Attempt     int
+	TraceParent string
+	CampaignId  string
+	Status      string
+}
+
+func HeadersFor(message common_models.Message, attempt int, traceParent string) []kafka.Header {
+	headers := []kafka.Header{
+		{Key: HEADER_TYPE, Value: []byte(message.Type)},
+		{Key: HEADER_SENDER, Value: []byte(message.Sender)},
+		{Key: HEADER_CREATED_ON, Value: []byte(strconv.FormatInt(message.CreatedOn, 10))},
+		{Key: HEADER_ATTEMPT, Value: []byte(strconv.Itoa(attempt))},
+	}
+
+	if message.Id != "" {
+		headers = append(headers, kafka.Header{Key: HEADER_MESSAGE_ID, Value: []byte(message.Id.Hex())})
+	}
+	if message.ReceivedOn != 0 {
+		headers = append(headers, kafka.Header{Key: HEADER_RECEIVED_ON, Value: []byte(strconv.FormatInt(message.ReceivedOn, 10))})
+	}
+	if traceParent != "" {
+		headers = append(headers, kafka.Header{Key: HEADER_TRACEPARENT, Value: []byte(traceParent)})
+	}
+	if message.CampaignId != "" {
+		headers = append(headers, kafka.Header{Key: HEADER_CAMPAIGN_ID, Value: []byte(message.CampaignId)})
+	}
+	if message.Status != "" {
+		headers = append(headers, kafka.Header{Key: HEADER_STATUS, Value: []byte(message.Status)})
+	}
+
+	return headers
+}
+
+// ReadHeaders decodes the standard headers, the flag is false for messages
+// produced before headers existed so callers can fall back to the body
+func ReadHeaders(msg *kafka.Message) (MessageHeaders, bool) {
+	headers := MessageHeaders{}
+	found := false
+
+	for _, header := range msg.Headers {
+		value := string(header.Value)
+
+		switch header.Key {
+		case HEADER_MESSAGE_ID:
+			headers.MessageId = value
+		case HEADER_TYPE:
+			headers.Type = value
+		case HEADER_SENDER:
+			headers.Sender = value
+		case HEADER_CREATED_ON:
+			headers.CreatedOn, _ = strconv.ParseInt(value, 10, 64)
+		case HEADER_RECEIVED_ON:
+			headers.ReceivedOn, _ = strconv.ParseInt(value, 10, 64)
+		case HEADER_ATTEMPT:
+			headers.Attempt, _ = strconv.Atoi(value)
+		case HEADER_TRACEPARENT:
+			headers.TraceParent = value
+		case HEADER_CAMPAIGN_ID:
+			headers.CampaignId = value
+		case HEADER_STATUS:
+			headers.Status = value
+		default:
+			continue
+		}
+
+		found = true
+	}
+
+	return headers, found
+}
@@ -0,0 +1,107 @@
+package common_kafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+)
+
+// Provisioner "kafka_security" entries and the local setting overriding each of them
+var securitySettings = []struct {
+	name     string
+	local    string
+	property string
+}{
+	{"security_protocol", common_config.KAFKA_SECURITY_PROTOCOL, "security.protocol"},
+	{"sasl_mechanism", common_config.KAFKA_SASL_MECHANISM, "sasl.mechanism"},
+	{"sasl_username", common_config.KAFKA_SASL_USERNAME, "sasl.username"},
+	{"sasl_password", common_config.KAFKA_SASL_PASSWORD, "sasl.password"},
+	{"ssl_ca_location", common_config.KAFKA_SSL_CA_LOCATION, "ssl.ca.location"},
+	{"ssl_certificate_location", common_config.KAFKA_SSL_CERTIFICATE_LOCATION, "ssl.certificate.location"},
+	{"ssl_key_location", common_config.KAFKA_SSL_KEY_LOCATION, "ssl.key.location"},
+	{"ssl_key_password", common_config.KAFKA_SSL_KEY_PASSWORD, "ssl.key.password"},
+}
+
+var securityProtocols = []string{"PLAINTEXT", "SSL", "SASL_PLAINTEXT", "SASL_SSL"}
+var saslMechanisms = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+
+// SecurityError is returned when the security settings can't produce a working client
+type SecurityError struct {
+	Reason string
+}
+
+func (e *SecurityError) Error() string {
+	return "invalid kafka security configuration: " + e.Reason
+}
+
+// securityConfig merges the provisioner's kafka_security section with the
+// local settings, credentials are expected locally (flags, environment or a
+// secret file through KAFKA_SASL_PASSWORD_FILE) and take precedence
+func securityConfig(configuration map[string]interface{}) (kafka.ConfigMap, error) {
+	provisioned, _ := configuration["kafka_security"].(map[string]interface{})
+
+	configMap := kafka.ConfigMap{}
+	for _, setting := range securitySettings {
+		value := common_config.Get(setting.local, "")
+		if value == "" && provisioned[setting.name] != nil {
+			value = fmt.Sprint(provisioned[setting.name])
+		}
+
+		if value != "" {
+			configMap[setting.property] = value
+		}
+	}
+
+	if passwordFile := common_config.Get(common_config.KAFKA_SASL_PASSWORD_FILE, ""); passwordFile != "" {
+		content, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, &SecurityError{Reason: err.Error()}
+		}
+		configMap["sasl.password"] = strings.TrimSpace(string(content))
+	}
+
+	if err := validateSecurity(configMap); err != nil {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+func validateSecurity(configMap kafka.ConfigMap) error {
+	protocol, _ := configMap["security.protocol"].(string)
+	protocol = strings.ToUpper(protocol)
+	if protocol == "" {
+		protocol = "PLAINTEXT"
+	}
+	if !contains(securityProtocols, protocol) {
+		return &SecurityError{Reason: "unknown security protocol " + protocol}
+	}
+	configMap["security.protocol"] = protocol
+
+	if strings.HasPrefix(protocol, "SASL_") {
+		mechanism, _ := configMap["sasl.mechanism"].(string)
+		if !contains(saslMechanisms, strings.ToUpper(mechanism)) {
+			return &SecurityError{Reason: "unknown sasl mechanism " + mechanism}
+		}
+		configMap["sasl.mechanism"] = strings.ToUpper(mechanism)
+
+		if configMap["sasl.username"] == nil || configMap["sasl.password"] == nil {
+			return &SecurityError{Reason: protocol + " requires sasl username and password"}
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package common_kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+var traceParentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// NewTraceParent starts a W3C trace context
+func NewTraceParent() string {
+	return "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+}
+
+// ChildTraceParent keeps the trace of parent under a new span, an invalid or
+// missing parent starts a new trace
+func ChildTraceParent(parent string) string {
+	match := traceParentPattern.FindStringSubmatch(parent)
+	if match == nil {
+		return NewTraceParent()
+	}
+
+	return "00-" + match[1] + "-" + randomHex(8) + "-" + match[3]
+}
+
+func randomHex(size int) string {
+	buffer := make([]byte, size)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
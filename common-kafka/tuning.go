@@ -0,0 +1,89 @@
+package common_kafka
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	PRODUCER_CONFIG = "producer_config"
+	CONSUMER_CONFIG = "consumer_config"
+)
+
+var producerProperties = []string{
+	"acks", "request.required.acks", "enable.idempotence", "max.in.flight.requests.per.connection",
+	"linger.ms", "queue.buffering.max.ms", "batch.size", "batch.num.messages",
+	"compression.type", "compression.codec", "compression.level",
+	"message.max.bytes", "message.timeout.ms", "request.timeout.ms", "retries", "retry.backoff.ms",
+	"queue.buffering.max.messages", "queue.buffering.max.kbytes",
+	"client.id", "socket.keepalive.enable", "statistics.interval.ms",
+}
+
+// Auto commit isn't tunable, no consumer commits its offsets any other way
+var consumerProperties = []string{
+	"fetch.min.bytes", "fetch.max.bytes", "fetch.wait.max.ms", "max.partition.fetch.bytes", "fetch.message.max.bytes",
+	"session.timeout.ms", "heartbeat.interval.ms", "max.poll.interval.ms",
+	"auto.offset.reset", "auto.commit.interval.ms",
+	"queued.min.messages", "queued.max.messages.kbytes", "partition.assignment.strategy", "isolation.level",
+	"client.id", "socket.keepalive.enable", "statistics.interval.ms",
+}
+
+// Properties owned by the service setup or the security settings, overriding
+// them from the provisioner would redirect or unsecure the clients
+var protectedPrefixes = []string{"bootstrap.servers", "group.id", "security.", "sasl.", "ssl.", "plugin.", "debug"}
+
+// TuningError is returned when a producer_config or consumer_config entry isn't accepted
+type TuningError struct {
+	Section  string
+	Property string
+	Reason   string
+}
+
+func (e *TuningError) Error() string {
+	return fmt.Sprintf("%s.%s %s", e.Section, e.Property, e.Reason)
+}
+
+// tuningConfig reads a librdkafka pass-through section of the provisioner
+// configuration, per service values come from the service's namespace
+func tuningConfig(configuration map[string]interface{}, section string, allowed []string) (kafka.ConfigMap, error) {
+	entries, _ := configuration[section].(map[string]interface{})
+
+	configMap := kafka.ConfigMap{}
+	for property, value := range entries {
+		for _, prefix := range protectedPrefixes {
+			if strings.HasPrefix(property, prefix) {
+				return nil, &TuningError{Section: section, Property: property, Reason: "is not allowed"}
+			}
+		}
+
+		if !contains(allowed, property) {
+			return nil, &TuningError{Section: section, Property: property, Reason: "is not a supported property"}
+		}
+
+		converted, err := configValue(value)
+		if err != nil {
+			return nil, &TuningError{Section: section, Property: property, Reason: err.Error()}
+		}
+		configMap[property] = converted
+	}
+
+	return configMap, nil
+}
+
+// JSON numbers arrive as float64 while librdkafka expects integers
+func configValue(value interface{}) (kafka.ConfigValue, error) {
+	switch typed := value.(type) {
+	case string, bool:
+		return typed, nil
+	case float64:
+		if typed != math.Trunc(typed) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return int(typed), nil
+	}
+
+	return nil, fmt.Errorf("has an unsupported value %v", value)
+}
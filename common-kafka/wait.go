@@ -0,0 +1,40 @@
+package common_kafka
+
+import (
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+)
+
+const COMPONENT = "kafka"
+
+// MetadataClient is satisfied by consumers, producers and admin clients
+type MetadataClient interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+}
+
+// WaitForBrokers blocks until the brokers answer a metadata request, the
+// service reports not ready for as long as they don't
+func WaitForBrokers(client MetadataClient) {
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		_, err := client.GetMetadata(nil, false, 5000)
+		if err != nil {
+			fmt.Printf("Couldn't reach the kafka brokers (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(COMPONENT, err.Error())
+			return err
+		}
+
+		common_health.SetReady(COMPONENT)
+		return nil
+	})
+}
+
+// Check probes the brokers through the client for the readiness endpoint
+func Check(client MetadataClient) func() error {
+	return func() error {
+		_, err := client.GetMetadata(nil, false, 2000)
+		return err
+	}
+}
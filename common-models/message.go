@@ -1,6 +1,10 @@
 package common_models
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 const (
 	Campaing        = "CMP"
@@ -8,13 +12,85 @@ const (
 	OneTimePassword = "OTP"
 )
 
+// Status of messages that were never produced because the recipient opted out
+const SUPPRESSED = "suppressed"
+
+// Status of the reports the producer emits for campaign messages it accepted
+const QUEUED = "queued"
+
+// Status of messages the dispatcher didn't send, because their campaign was
+// cancelled or because sending failed
+const (
+	CANCELLED = "cancelled"
+	FAILED    = "failed"
+)
+
 type Message struct {
-	Id          bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
-	Recipient   string        `json:"recipient" form:"recipient" binding:"required" bson:"recipient"`
-	Message     string        `json:"message" form:"message" binding:"required" bson:"message"`
-	Sender      string        `json:"sender" form:"sender" binding:"required" bson:"sender"`
-	Type        string        `json:"type" form:"type" binding:"required" bson:"type" validate:"required,oneof=CMP TRX OTP"`
-	CreatedOn   int64         `json:"created_on" bson:"created_on"`
-	ReceivedOn  int64         `json:"received_on" bson:"received_on"`
-	ProcessedOn int64         `json:"processed_on" bson:"processed_on"`
+	Id          bson.ObjectId     `json:"_id,omitempty" bson:"_id,omitempty"`
+	Recipient   string            `json:"recipient" form:"recipient" binding:"required" bson:"recipient" validate:"required,recipient"`
+	Message     string            `json:"message" form:"message" bson:"message" validate:"required_without=TemplateId"`
+	Sender      string            `json:"sender" form:"sender" binding:"required" bson:"sender"`
+	Type        string            `json:"type" form:"type" binding:"required" bson:"type" validate:"required,oneof=CMP TRX OTP"`
+	CreatedOn   int64             `json:"created_on" bson:"created_on"`
+	ReceivedOn  int64             `json:"received_on" bson:"received_on"`
+	ProcessedOn int64             `json:"processed_on" bson:"processed_on"`
+	Metadata    map[string]string `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	TimeZone    string            `json:"time_zone,omitempty" form:"time_zone" bson:"time_zone,omitempty"`
+	Status      string            `json:"status,omitempty" bson:"status,omitempty"`
+	Priority    string            `json:"priority,omitempty" form:"priority" bson:"priority,omitempty" validate:"omitempty,oneof=high normal low"`
+	CampaignId  string            `json:"campaign_id,omitempty" form:"campaign_id" bson:"campaign_id,omitempty"`
+
+	// Rendered into Message by the producer when TemplateId is given
+	TemplateId      string            `json:"template_id,omitempty" form:"template_id" bson:"template_id,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty" form:"template_version" bson:"template_version,omitempty"`
+	Locale          string            `json:"locale,omitempty" form:"locale" bson:"locale,omitempty"`
+	Variables       map[string]string `json:"variables,omitempty" bson:"-"`
+
+	// Set by the claim check when the body was compressed or stored outside of Kafka
+	BodyEncoding  string `json:"body_encoding,omitempty" bson:"body_encoding,omitempty"`
+	BodyReference string `json:"body_reference,omitempty" bson:"body_reference,omitempty"`
+}
+
+// Urgent messages are delivered right away, they are never held by quiet hours
+func (m *Message) Urgent() bool {
+	return m.Type == Transactional || m.Type == OneTimePassword
+}
+
+const DEFAULT_PARTITION_KEY = "recipient"
+
+// ValidPartitionKey tells whether field is one PartitionKey understands, an
+// unknown field would silently leave every message without a key
+func ValidPartitionKey(field string) bool {
+	switch {
+	case field == "recipient" || field == "sender" || field == "type" || field == "none":
+		return true
+	case strings.HasPrefix(field, "metadata."):
+		return field != "metadata."
+	}
+
+	return false
+}
+
+// PartitionKey returns the Kafka key of the message. Messages sharing a key
+// land on the same partition and keep their relative order, field is one of
+// "recipient", "sender", "type", "metadata.<name>" or "none" for no key
+func (m *Message) PartitionKey(field string) []byte {
+	var key string
+
+	switch {
+	case field == "" || field == "recipient":
+		key = m.Recipient
+	case field == "sender":
+		key = m.Sender
+	case field == "type":
+		key = m.Type
+	case strings.HasPrefix(field, "metadata."):
+		key = m.Metadata[strings.TrimPrefix(field, "metadata.")]
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	return []byte(key)
 }
@@ -0,0 +1,30 @@
+package common_models
+
+const (
+	HIGH_PRIORITY   = "high"
+	NORMAL_PRIORITY = "normal"
+	LOW_PRIORITY    = "low"
+)
+
+// Priorities from the most to the least urgent
+var PRIORITIES = []string{HIGH_PRIORITY, NORMAL_PRIORITY, LOW_PRIORITY}
+
+// LaneTopic returns the topic carrying the priority lane of topic, normal
+// priority messages stay on the topic itself
+func LaneTopic(topic string, priority string) string {
+	if priority == "" || priority == NORMAL_PRIORITY {
+		return topic
+	}
+
+	return topic + "-" + priority
+}
+
+// LaneTopics returns every lane of topic, the most urgent first
+func LaneTopics(topic string) []string {
+	lanes := []string{}
+	for _, priority := range PRIORITIES {
+		lanes = append(lanes, LaneTopic(topic, priority))
+	}
+
+	return lanes
+}
@@ -0,0 +1,98 @@
+package common_models
+
+import (
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator"
+)
+
+const RECIPIENT_VALIDATION = "recipient"
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "", "/", "")
+
+// IsEmail tells if recipient is addressed by email rather than by phone
+func IsEmail(recipient string) bool {
+	return strings.Contains(recipient, "@")
+}
+
+// NormalizeRecipient brings recipient to the form it is stored and compared
+// with. Phone numbers lose their separators and get the "+" international
+// prefix, defaultCountryCode being prepended to national numbers when set.
+// Emails are lowercased whole, so suppressions, rate limits, partition keys
+// and campaign deliveries all see one recipient. Invalid values are returned
+// trimmed
+func NormalizeRecipient(recipient string, defaultCountryCode string) string {
+	recipient = strings.TrimSpace(recipient)
+
+	if IsEmail(recipient) {
+		return strings.ToLower(recipient)
+	}
+
+	phone := phoneSeparators.Replace(recipient)
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	} else if !strings.HasPrefix(phone, "+") && defaultCountryCode != "" {
+		phone = "+" + strings.TrimPrefix(defaultCountryCode, "+") + strings.TrimPrefix(phone, "0")
+	}
+
+	if e164Pattern.MatchString(phone) {
+		return phone
+	}
+
+	return recipient
+}
+
+// ValidRecipient tells if recipient is an E.164 phone number or a plain email address
+func ValidRecipient(recipient string) bool {
+	if IsEmail(recipient) {
+		address, err := mail.ParseAddress(recipient)
+		return err == nil && address.Address == recipient && address.Name == ""
+	}
+
+	return e164Pattern.MatchString(recipient)
+}
+
+// RegisterValidations adds the "recipient" tag to validate and makes it
+// report fields by their JSON name
+func RegisterValidations(validate *validator.Validate) error {
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	return validate.RegisterValidation(RECIPIENT_VALIDATION, func(field validator.FieldLevel) bool {
+		return ValidRecipient(field.Field().String())
+	})
+}
+
+// FieldErrors describes each failed validation by the JSON name of its field
+func FieldErrors(err error) map[string]string {
+	fields := map[string]string{}
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return fields
+	}
+
+	for _, fieldError := range validationErrors {
+		name := fieldError.Field()
+		switch fieldError.Tag() {
+		case "required", "required_without":
+			fields[name] = "is required"
+		case "oneof":
+			fields[name] = "must be one of " + fieldError.Param()
+		case RECIPIENT_VALIDATION:
+			fields[name] = "must be an E.164 phone number (+18095551234) or an email address"
+		default:
+			fields[name] = "failed the " + fieldError.Tag() + " validation"
+		}
+	}
+
+	return fields
+}
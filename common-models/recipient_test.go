@@ -0,0 +1,64 @@
+package common_models
+
+import "testing"
+
+func TestNormalizeRecipient(t *testing.T) {
+	cases := []struct {
+		recipient          string
+		defaultCountryCode string
+		normalized         string
+	}{
+		{recipient: "+18095551234", normalized: "+18095551234"},
+		{recipient: " +1 (809) 555-1234 ", normalized: "+18095551234"},
+		{recipient: "0018095551234", normalized: "+18095551234"},
+		{recipient: "00 44 20 7946 0958", defaultCountryCode: "1", normalized: "+442079460958"},
+		{recipient: "8095551234", defaultCountryCode: "1", normalized: "+18095551234"},
+		{recipient: "8095551234", defaultCountryCode: "+1", normalized: "+18095551234"},
+		{recipient: "020 7946 0958", defaultCountryCode: "44", normalized: "+442079460958"},
+		{recipient: "8095551234", normalized: "8095551234"},
+		{recipient: "+0123", normalized: "+0123"},
+		{recipient: "John@Example.COM", normalized: "john@example.com"},
+		{recipient: " john@example.com ", defaultCountryCode: "1", normalized: "john@example.com"},
+	}
+
+	for _, c := range cases {
+		if normalized := NormalizeRecipient(c.recipient, c.defaultCountryCode); normalized != c.normalized {
+			t.Errorf("%q with %q: got %q, want %q", c.recipient, c.defaultCountryCode, normalized, c.normalized)
+		}
+	}
+}
+
+func TestRecipientKeysAgree(t *testing.T) {
+	recipients := []string{"John@x.com", "john@X.com", "JOHN@x.com"}
+
+	for _, recipient := range recipients {
+		normalized := NormalizeRecipient(recipient, "")
+		if key := SuppressionKey(recipient, ""); key != normalized {
+			t.Errorf("%s: suppression key %q differs from %q", recipient, key, normalized)
+		}
+
+		message := Message{Recipient: normalized}
+		if key := string(message.PartitionKey(DEFAULT_PARTITION_KEY)); key != "john@x.com" {
+			t.Errorf("%s: partition key %q, want john@x.com", recipient, key)
+		}
+	}
+}
+
+func TestValidRecipient(t *testing.T) {
+	cases := map[string]bool{
+		"+18095551234":      true,
+		"+442079460958":     true,
+		"18095551234":       false,
+		"+1809":             false,
+		"john@example.com":  true,
+		"John <john@x.com>": false,
+		"not an email@":     false,
+		"":                  false,
+	}
+
+	for recipient, valid := range cases {
+		if ValidRecipient(recipient) != valid {
+			t.Errorf("%q: valid should be %v", recipient, valid)
+		}
+	}
+}
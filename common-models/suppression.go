@@ -0,0 +1,33 @@
+package common_models
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	SUPPRESSION_API    = "api"
+	SUPPRESSION_IMPORT = "import"
+)
+
+// Suppression opts a recipient out of the messages of Sender, or of every
+// sender when Sender is empty
+type Suppression struct {
+	Id        bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+	Recipient string        `json:"recipient" form:"recipient" binding:"required" bson:"recipient"`
+	Sender    string        `json:"sender,omitempty" form:"sender" bson:"sender"`
+	Reason    string        `json:"reason,omitempty" form:"reason" bson:"reason,omitempty"`
+	Source    string        `json:"source,omitempty" bson:"source,omitempty"`
+	CreatedOn int64         `json:"created_on" bson:"created_on"`
+}
+
+// SuppressionKey is the form recipients are stored and looked up with, the
+// normalized recipient. defaultCountryCode has to be the one messages are
+// normalized with
+func SuppressionKey(recipient string, defaultCountryCode string) string {
+	return NormalizeRecipient(recipient, defaultCountryCode)
+}
+
+// Applies tells if the suppression covers messages of sender
+func (s *Suppression) Applies(sender string) bool {
+	return s.Sender == "" || s.Sender == sender
+}
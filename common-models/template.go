@@ -0,0 +1,106 @@
+package common_models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const DEFAULT_LOCALE = "default"
+
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.]*)\s*\}\}`)
+
+// Every update of a template is stored as a new version, Bodies holds one
+// text per locale using {{variable}} placeholders
+type Template struct {
+	Id            bson.ObjectId     `json:"_id,omitempty" bson:"_id,omitempty"`
+	TemplateId    string            `json:"template_id" form:"template_id" bson:"template_id"`
+	Version       int               `json:"version" bson:"version"`
+	DefaultLocale string            `json:"default_locale" form:"default_locale" bson:"default_locale"`
+	Bodies        map[string]string `json:"bodies" bson:"bodies"`
+	Variables     []string          `json:"variables" bson:"variables"`
+	Deleted       bool              `json:"deleted" bson:"deleted"`
+	CreatedOn     int64             `json:"created_on" bson:"created_on"`
+}
+
+// MissingVariablesError lists the placeholders a render request left without value
+type MissingVariablesError struct {
+	Names []string
+}
+
+func (e *MissingVariablesError) Error() string {
+	return "missing template variables: " + strings.Join(e.Names, ", ")
+}
+
+// TemplateVariables returns the sorted placeholder names used by body
+func TemplateVariables(body string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Body picks the text for locale, falling back to its language ("es" for
+// "es-DO") and then to the default locale
+func (t *Template) Body(locale string) (string, error) {
+	candidates := []string{locale}
+	if index := strings.IndexAny(locale, "-_"); index > 0 {
+		candidates = append(candidates, locale[:index])
+	}
+	candidates = append(candidates, t.DefaultLocale, DEFAULT_LOCALE)
+
+	for _, candidate := range candidates {
+		if body, ok := t.Bodies[candidate]; ok && candidate != "" {
+			return body, nil
+		}
+	}
+
+	return "", fmt.Errorf("template %s has no body for locale %s", t.TemplateId, locale)
+}
+
+func (t *Template) Render(locale string, variables map[string]string) (string, error) {
+	body, err := t.Body(locale)
+	if err != nil {
+		return "", err
+	}
+
+	missing := []string{}
+	for _, name := range TemplateVariables(body) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", &MissingVariablesError{Names: missing}
+	}
+
+	return templateVariablePattern.ReplaceAllStringFunc(body, func(placeholder string) string {
+		return variables[templateVariablePattern.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+func (t *Template) Validate() error {
+	if t.TemplateId == "" {
+		return fmt.Errorf("template_id is required")
+	}
+	if len(t.Bodies) == 0 {
+		return fmt.Errorf("at least one body is required")
+	}
+	if t.DefaultLocale != "" {
+		if _, ok := t.Bodies[t.DefaultLocale]; !ok {
+			return fmt.Errorf("default_locale %s has no body", t.DefaultLocale)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package common_mongo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	"gopkg.in/mgo.v2"
+)
+
+const CONNECT_ATTEMPTS = 5
+const COMPONENT = "mongo"
+const SRV_SCHEME = "mongodb+srv://"
+
+// ConnectionError is returned when no session could be established after every attempt
+type ConnectionError struct {
+	Addrs    []string
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("couldn't connect to mongo at %v after %d attempts: %v", e.Addrs, e.Attempts, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// DialInfo builds the dial information from MONGODB_URL, parsed whole so a
+// replica set URI keeps every host, its credentials and options. A
+// mongodb+srv URI gets its hosts from the _mongodb._tcp SRV records of its
+// host and database is used when the URL names none
+func DialInfo(database string) (*mgo.DialInfo, error) {
+	uri := strings.TrimSpace(common_config.Get(common_config.MONGODB_URL, ""))
+	if uri == "" {
+		return nil, fmt.Errorf("no address configured for %s", common_config.MONGODB_URL)
+	}
+
+	srv := strings.HasPrefix(uri, SRV_SCHEME)
+	if srv {
+		uri = "mongodb://" + strings.TrimPrefix(uri, SRV_SCHEME)
+	}
+
+	mInfo, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if srv {
+		if len(mInfo.Addrs) != 1 {
+			return nil, fmt.Errorf("a %s URI names exactly one host", SRV_SCHEME)
+		}
+		if mInfo.Addrs, err = lookupHosts(mInfo.Addrs[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if mInfo.Database == "" {
+		mInfo.Database = database
+	}
+	mInfo.Timeout = 10 * time.Second
+
+	return mInfo, nil
+}
+
+func lookupHosts(host string) ([]string, error) {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	_, records, err := net.LookupSRV("mongodb", "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no SRV records found for _mongodb._tcp." + host)
+	}
+
+	addrs := []string{}
+	for _, record := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port)))
+	}
+
+	return addrs, nil
+}
+
+// Dial opens a safe session, retrying with backoff between attempts
+func Dial(mInfo *mgo.DialInfo) (*mgo.Session, error) {
+	var session *mgo.Session
+
+	err := common_retry.Retry(common_retry.DefaultBackoff(), CONNECT_ATTEMPTS, func(attempt int) error {
+		var err error
+		session, err = mgo.DialWithInfo(mInfo)
+		return err
+	})
+	if err != nil {
+		return nil, &ConnectionError{Addrs: mInfo.Addrs, Attempts: CONNECT_ATTEMPTS, Err: err}
+	}
+
+	session.SetSafe(&mgo.Safe{})
+	return session, nil
+}
+
+// Connect dials the database configured through MONGODB_URL
+func Connect(database string) (*mgo.Database, *mgo.Session, error) {
+	mInfo, err := DialInfo(database)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := Dial(mInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session.DB(mInfo.Database), session, nil
+}
+
+// MongoDB maps a per request copy of the session's database into the martini context
+func MongoDB(database string) martini.Handler {
+	db, session, err := Connect(database)
+	if err != nil {
+		fmt.Printf("Can't connect to mongo, go error %v\n", err)
+		os.Exit(1)
+	}
+	common_health.RegisterCheck(COMPONENT, true, Check(session))
+
+	return func(c martini.Context) {
+		s := session.Clone()
+		defer s.Close()
+
+		c.Map(db.With(s))
+		c.Next()
+	}
+}
+
+// Check pings the server through a short lived copy of the session
+func Check(session *mgo.Session) func() error {
+	return func() error {
+		s := session.Copy()
+		defer s.Close()
+
+		s.SetSyncTimeout(2 * time.Second)
+		s.SetSocketTimeout(2 * time.Second)
+		return s.Ping()
+	}
+}
@@ -0,0 +1,51 @@
+package common_provisioner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+)
+
+// The last configuration retrieved successfully is kept on disk so a service
+// can still start while the provisioner is unreachable
+func (c *Client) cachePath(key string) string {
+	directory := common_config.Get(common_config.CONFIG_CACHE_DIR, filepath.Join(os.TempDir(), "kafka-message-processor"))
+	return filepath.Join(directory, c.Service+"-"+key+".json")
+}
+
+func (c *Client) saveCache(key string, configuration map[string]interface{}) error {
+	content, err := json.Marshal(configuration)
+	if err != nil {
+		return err
+	}
+
+	path := c.cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Written aside and renamed so a crash never leaves a truncated cache behind
+	temporary := path + ".tmp"
+	if err := ioutil.WriteFile(temporary, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+func (c *Client) CachedConfiguration(key string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(c.cachePath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var configuration map[string]interface{}
+	if err := json.Unmarshal(content, &configuration); err != nil {
+		return nil, &DecodeError{URL: c.cachePath(key), Err: err}
+	}
+
+	return configuration, nil
+}
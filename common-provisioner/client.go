@@ -0,0 +1,120 @@
+package common_provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+)
+
+const KAFKA_SERVICE_CONFIG = "kafka_service_config"
+
+type Client struct {
+	Service    string
+	HTTPClient *http.Client
+	Attempts   int
+	Backoff    common_retry.Backoff
+}
+
+func NewClient(service string) *Client {
+	return &Client{
+		Service:    service,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Attempts:   3,
+		Backoff:    common_retry.DefaultBackoff(),
+	}
+}
+
+// Configuration retrieves a configuration key resolved for the service
+// namespace, every discovered provisioner endpoint is tried in order
+func (c *Client) Configuration(key string) (map[string]interface{}, error) {
+	endpoints, err := common_config.Endpoints(common_config.PROVISIONING_URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastError error
+	for _, endpoint := range endpoints {
+		configurationURL := endpoint + "/config/" + url.PathEscape(key)
+		if namespace := common_config.Namespace(c.Service); namespace != "" {
+			configurationURL += "?namespace=" + url.QueryEscape(namespace)
+		}
+
+		body, err := c.GetJSON(configurationURL)
+		if err != nil {
+			lastError = err
+			continue
+		}
+
+		if body["status"] != "successful" {
+			return nil, ErrUnsuccessful
+		}
+
+		result, ok := body["result"].(map[string]interface{})
+		if !ok {
+			return nil, &DecodeError{URL: configurationURL, Err: errors.New("result is not an object")}
+		}
+
+		if err := c.saveCache(key, result); err != nil {
+			fmt.Printf("Couldn't cache %s: %v\n", key, err)
+		}
+
+		return result, nil
+	}
+
+	return nil, lastError
+}
+
+// GetJSON performs a GET request decoding the JSON object it responds with,
+// transport and server side failures are retried with backoff
+func (c *Client) GetJSON(url string) (map[string]interface{}, error) {
+	var body map[string]interface{}
+
+	err := common_retry.Retry(c.Backoff, c.Attempts, func(attempt int) error {
+		var err error
+		body, err = c.getJSON(url)
+		if err != nil && !retryable(err) {
+			return common_retry.Permanent(err)
+		}
+
+		return err
+	})
+
+	return body, err
+}
+
+func (c *Client) getJSON(url string) (map[string]interface{}, error) {
+	resp, err := c.HTTPClient.Get(url)
+	if err != nil {
+		return nil, &RequestError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &RequestError{URL: url, Err: err}
+	}
+
+	var body map[string]interface{}
+	decodeError := json.Unmarshal(content, &body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message := ""
+		if decodeError == nil && body["error"] != nil {
+			message = fmt.Sprint(body["error"])
+		}
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Message: message}
+	}
+
+	if decodeError != nil {
+		return nil, &DecodeError{URL: url, Err: decodeError}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,63 @@
+package common_provisioner
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnsuccessful = errors.New("provisioning service reported an unsuccessful request")
+
+// RequestError is returned when the request couldn't be sent or its body couldn't be read
+type RequestError struct {
+	URL string
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request to %s failed: %v", e.URL, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the response has a non 2xx status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request to %s returned status %d", e.URL, e.StatusCode)
+	}
+
+	return fmt.Sprintf("request to %s returned status %d: %s", e.URL, e.StatusCode, e.Message)
+}
+
+// DecodeError is returned when the response body isn't the expected JSON document
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("couldn't decode response from %s: %v", e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Transport failures and server side errors are worth retrying, anything else won't change
+func retryable(err error) bool {
+	var requestError *RequestError
+	var statusError *StatusError
+
+	if errors.As(err, &requestError) {
+		return true
+	}
+
+	return errors.As(err, &statusError) && statusError.StatusCode >= 500
+}
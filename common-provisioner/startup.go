@@ -0,0 +1,71 @@
+package common_provisioner
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+)
+
+const COMPONENT = "provisioner"
+
+// WaitForConfiguration blocks until the configuration is available. Once
+// STARTUP_ATTEMPTS attempts failed the last known good copy is used when one
+// was cached, otherwise it keeps retrying while the service reports not ready.
+// The returned flag tells whether the configuration came from the cache
+func (c *Client) WaitForConfiguration(key string) (map[string]interface{}, bool) {
+	startupAttempts, err := strconv.Atoi(common_config.Get(common_config.STARTUP_ATTEMPTS, ""))
+	if err != nil || startupAttempts < 1 {
+		startupAttempts = 1
+	}
+
+	var configuration map[string]interface{}
+	cached := false
+
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		var err error
+		configuration, err = c.Configuration(key)
+		if err == nil {
+			common_health.SetReady(COMPONENT)
+			return nil
+		}
+
+		fmt.Printf("Couldn't retrieve %s (attempt %d): %v\n", key, attempt, err)
+		common_health.SetNotReady(COMPONENT, err.Error())
+
+		if attempt >= startupAttempts {
+			if cachedConfiguration, cacheErr := c.CachedConfiguration(key); cacheErr == nil {
+				fmt.Printf("Using the last known good %s\n", key)
+				configuration = cachedConfiguration
+				cached = true
+				common_health.SetDegraded(COMPONENT, "using cached configuration: "+err.Error())
+				return nil
+			}
+		}
+
+		return err
+	})
+
+	return configuration, cached
+}
+
+// Check tells whether any provisioner endpoint answers its liveness probe
+func (c *Client) Check() error {
+	endpoints, err := common_config.Endpoints(common_config.PROVISIONING_URL)
+	if err != nil {
+		return err
+	}
+
+	probe := &Client{Service: c.Service, HTTPClient: &http.Client{Timeout: 2 * time.Second}, Attempts: 1}
+	for _, endpoint := range endpoints {
+		if _, err = probe.GetJSON(endpoint + "/livez"); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
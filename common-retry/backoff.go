@@ -0,0 +1,71 @@
+package common_retry
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+}
+
+func DefaultBackoff() Backoff {
+	return Backoff{Initial: 500 * time.Millisecond, Max: 30 * time.Second, Factor: 2}
+}
+
+// Delay returns how long to wait after the given failed attempt (starting at 1),
+// the exponential delay is capped at Max and jittered by up to a fifth
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 1; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	jitter := delay / 5 * rand.Float64()
+	return time.Duration(delay - jitter)
+}
+
+// PermanentError stops Retry right away
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Retry calls fn until it succeeds, returns a permanent error or the
+// attempts run out, zero attempts retries forever
+func Retry(backoff Backoff, attempts int, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			return permanent.Err
+		}
+
+		if attempts > 0 && attempt >= attempts {
+			return err
+		}
+
+		time.Sleep(backoff.Delay(attempt))
+	}
+}
@@ -0,0 +1,328 @@
+package common_serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Avro schema of common_models.Message, new fields need a default to stay backward compatible
+const MESSAGE_AVRO_SCHEMA = `{"type":"record","name":"Message","namespace":"com.hectorandac.messaging","fields":[` +
+	`{"name":"id","type":"string","default":""},` +
+	`{"name":"recipient","type":"string"},` +
+	`{"name":"message","type":"string"},` +
+	`{"name":"sender","type":"string"},` +
+	`{"name":"type","type":"string"},` +
+	`{"name":"created_on","type":"long","default":0},` +
+	`{"name":"received_on","type":"long","default":0},` +
+	`{"name":"processed_on","type":"long","default":0},` +
+	`{"name":"metadata","type":{"type":"map","values":"string"},"default":{}},` +
+	`{"name":"body_encoding","type":"string","default":""},` +
+	`{"name":"body_reference","type":"string","default":""},` +
+	`{"name":"template_id","type":"string","default":""},` +
+	`{"name":"template_version","type":"long","default":0},` +
+	`{"name":"locale","type":"string","default":""},` +
+	`{"name":"priority","type":"string","default":""},` +
+	`{"name":"campaign_id","type":"string","default":""},` +
+	`{"name":"status","type":"string","default":""},` +
+	`{"name":"time_zone","type":"string","default":""}]}`
+
+type avroType struct {
+	Type   string
+	Name   string
+	Fields []avroField
+	Values *avroType
+	Items  *avroType
+	Union  []*avroType
+}
+
+type avroField struct {
+	Name       string
+	Type       *avroType
+	Default    interface{}
+	HasDefault bool
+}
+
+func parseAvroSchema(schema string) (*avroType, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, err
+	}
+
+	return parseAvroType(raw)
+}
+
+func parseAvroType(raw interface{}) (*avroType, error) {
+	switch typed := raw.(type) {
+	case string:
+		return &avroType{Type: typed}, nil
+	case []interface{}:
+		union := &avroType{Type: "union"}
+		for _, branch := range typed {
+			parsed, err := parseAvroType(branch)
+			if err != nil {
+				return nil, err
+			}
+			union.Union = append(union.Union, parsed)
+		}
+		return union, nil
+	case map[string]interface{}:
+		kind, _ := typed["type"].(string)
+		parsed := &avroType{Type: kind}
+		parsed.Name, _ = typed["name"].(string)
+
+		switch kind {
+		case "record":
+			fields, _ := typed["fields"].([]interface{})
+			for _, rawField := range fields {
+				definition, _ := rawField.(map[string]interface{})
+				fieldType, err := parseAvroType(definition["type"])
+				if err != nil {
+					return nil, err
+				}
+
+				field := avroField{Type: fieldType}
+				field.Name, _ = definition["name"].(string)
+				field.Default, field.HasDefault = definition["default"]
+				parsed.Fields = append(parsed.Fields, field)
+			}
+		case "map":
+			values, err := parseAvroType(typed["values"])
+			if err != nil {
+				return nil, err
+			}
+			parsed.Values = values
+		case "array":
+			items, err := parseAvroType(typed["items"])
+			if err != nil {
+				return nil, err
+			}
+			parsed.Items = items
+		case "":
+			// A nested definition such as {"type": {"type": "map", ...}}
+			return parseAvroType(typed["type"])
+		}
+		return parsed, nil
+	}
+
+	return nil, fmt.Errorf("unsupported avro schema %v", raw)
+}
+
+func encodeAvro(buffer *bytes.Buffer, t *avroType, value interface{}) error {
+	switch t.Type {
+	case "null":
+		return nil
+	case "boolean":
+		if b, _ := value.(bool); b {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+	case "int", "long":
+		writeLong(buffer, toInt64(value))
+	case "float":
+		binary.Write(buffer, binary.LittleEndian, math.Float32bits(float32(toFloat64(value))))
+	case "double":
+		binary.Write(buffer, binary.LittleEndian, math.Float64bits(toFloat64(value)))
+	case "string", "bytes":
+		text := toString(value)
+		writeLong(buffer, int64(len(text)))
+		buffer.WriteString(text)
+	case "record":
+		record, _ := value.(map[string]interface{})
+		for _, field := range t.Fields {
+			fieldValue, ok := record[field.Name]
+			if !ok {
+				fieldValue = field.Default
+			}
+			if err := encodeAvro(buffer, field.Type, fieldValue); err != nil {
+				return fmt.Errorf("%s: %v", field.Name, err)
+			}
+		}
+	case "map":
+		entries, _ := value.(map[string]interface{})
+		if len(entries) > 0 {
+			keys := make([]string, 0, len(entries))
+			for key := range entries {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			writeLong(buffer, int64(len(keys)))
+			for _, key := range keys {
+				writeLong(buffer, int64(len(key)))
+				buffer.WriteString(key)
+				if err := encodeAvro(buffer, t.Values, entries[key]); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buffer, 0)
+	case "array":
+		items, _ := value.([]interface{})
+		if len(items) > 0 {
+			writeLong(buffer, int64(len(items)))
+			for _, item := range items {
+				if err := encodeAvro(buffer, t.Items, item); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buffer, 0)
+	case "union":
+		for index, branch := range t.Union {
+			if (value == nil) == (branch.Type == "null") {
+				writeLong(buffer, int64(index))
+				return encodeAvro(buffer, branch, value)
+			}
+		}
+		return errors.New("no union branch matches the value")
+	default:
+		return fmt.Errorf("unsupported avro type %s", t.Type)
+	}
+
+	return nil
+}
+
+func decodeAvro(reader *bytes.Reader, t *avroType) (interface{}, error) {
+	switch t.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := reader.ReadByte()
+		return b == 1, err
+	case "int", "long":
+		return readLong(reader)
+	case "float":
+		var bits uint32
+		err := binary.Read(reader, binary.LittleEndian, &bits)
+		return float64(math.Float32frombits(bits)), err
+	case "double":
+		var bits uint64
+		err := binary.Read(reader, binary.LittleEndian, &bits)
+		return math.Float64frombits(bits), err
+	case "string", "bytes":
+		return readString(reader)
+	case "record":
+		record := map[string]interface{}{}
+		for _, field := range t.Fields {
+			value, err := decodeAvro(reader, field.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", field.Name, err)
+			}
+			record[field.Name] = value
+		}
+		return record, nil
+	case "map":
+		entries := map[string]interface{}{}
+		err := readBlocks(reader, func() error {
+			key, err := readString(reader)
+			if err != nil {
+				return err
+			}
+			value, err := decodeAvro(reader, t.Values)
+			entries[key] = value
+			return err
+		})
+		return entries, err
+	case "array":
+		items := []interface{}{}
+		err := readBlocks(reader, func() error {
+			item, err := decodeAvro(reader, t.Items)
+			items = append(items, item)
+			return err
+		})
+		return items, err
+	case "union":
+		index, err := readLong(reader)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(t.Union) {
+			return nil, fmt.Errorf("union branch %d out of range", index)
+		}
+		return decodeAvro(reader, t.Union[index])
+	}
+
+	return nil, fmt.Errorf("unsupported avro type %s", t.Type)
+}
+
+func readBlocks(reader *bytes.Reader, readItem func() error) error {
+	for {
+		count, err := readLong(reader)
+		if err != nil || count == 0 {
+			return err
+		}
+
+		// A negative count is followed by the block size in bytes
+		if count < 0 {
+			count = -count
+			if _, err := readLong(reader); err != nil {
+				return err
+			}
+		}
+
+		for i := int64(0); i < count; i++ {
+			if err := readItem(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeLong(buffer *bytes.Buffer, value int64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutVarint(encoded, value)])
+}
+
+func readLong(reader *bytes.Reader) (int64, error) {
+	return binary.ReadVarint(reader)
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	length, err := readLong(reader)
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || length > int64(reader.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	content := make([]byte, length)
+	_, err = io.ReadFull(reader, content)
+	return string(content), err
+}
+
+func toInt64(value interface{}) int64 {
+	switch typed := value.(type) {
+	case int64:
+		return typed
+	case int:
+		return int64(typed)
+	case float64:
+		return int64(typed)
+	}
+
+	return 0
+}
+
+func toFloat64(value interface{}) float64 {
+	switch typed := value.(type) {
+	case float64:
+		return typed
+	case int64:
+		return float64(typed)
+	}
+
+	return 0
+}
+
+func toString(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
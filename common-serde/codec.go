@@ -0,0 +1,257 @@
+package common_serde
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	JSON_FORMAT     = "json"
+	AVRO_FORMAT     = "avro"
+	PROTOBUF_FORMAT = "protobuf"
+)
+
+// Codec serializes messages in the configured format and deserializes any
+// of them, payloads without the wire format prefix are read as plain JSON
+type Codec struct {
+	Format   string
+	Registry Registry
+
+	mutex     sync.RWMutex
+	schemaIDs map[string]int
+}
+
+// NewCodec reads the "serialization" section of the provisioner configuration,
+// {"format": "avro", "schema_registry_url": "http://registry:8081"}, the
+// SCHEMA_REGISTRY_URL setting overrides the registry address
+func NewCodec(configuration map[string]interface{}) (*Codec, error) {
+	section, _ := configuration["serialization"].(map[string]interface{})
+
+	format, _ := section["format"].(string)
+	format = strings.ToLower(format)
+	if format == "" {
+		format = JSON_FORMAT
+	}
+
+	registryURL, _ := section["schema_registry_url"].(string)
+	registryURL = common_config.Get(common_config.SCHEMA_REGISTRY_URL, registryURL)
+
+	var registry Registry
+	if registryURL != "" {
+		registry = NewHTTPRegistry(strings.TrimSuffix(registryURL, "/"))
+	}
+
+	return NewCodecWithRegistry(format, registry)
+}
+
+// NewCodecWithRegistry builds a codec on any registry, tests pass a
+// MockRegistry shared by their producing and consuming codecs
+func NewCodecWithRegistry(format string, registry Registry) (*Codec, error) {
+	codec := &Codec{Format: format, Registry: registry, schemaIDs: map[string]int{}}
+	switch format {
+	case JSON_FORMAT:
+	case AVRO_FORMAT, PROTOBUF_FORMAT:
+		if codec.Registry == nil {
+			return nil, fmt.Errorf("%s serialization requires a schema registry", format)
+		}
+	default:
+		return nil, fmt.Errorf("unknown serialization format %s", format)
+	}
+
+	return codec, nil
+}
+
+func (c *Codec) Serialize(topic string, message common_models.Message) ([]byte, error) {
+	switch c.Format {
+	case AVRO_FORMAT:
+		schemaID, err := c.schemaID(topic, AVRO, MESSAGE_AVRO_SCHEMA)
+		if err != nil {
+			return nil, err
+		}
+
+		schema, _ := parseAvroSchema(MESSAGE_AVRO_SCHEMA)
+		buffer := &bytes.Buffer{}
+		if err := encodeAvro(buffer, schema, messageRecord(message)); err != nil {
+			return nil, err
+		}
+		return encodeWire(schemaID, buffer.Bytes()), nil
+	case PROTOBUF_FORMAT:
+		schemaID, err := c.schemaID(topic, PROTOBUF, MESSAGE_PROTOBUF_SCHEMA)
+		if err != nil {
+			return nil, err
+		}
+
+		payload := append(encodeMessageIndexes(), encodeProtobuf(messageRecord(message))...)
+		return encodeWire(schemaID, payload), nil
+	}
+
+	return json.Marshal(message)
+}
+
+func (c *Codec) Deserialize(data []byte) (common_models.Message, error) {
+	var message common_models.Message
+
+	if !IsWireFormat(data) {
+		err := json.Unmarshal(data, &message)
+		return message, err
+	}
+
+	if c.Registry == nil {
+		return message, fmt.Errorf("payload needs a schema registry to be decoded")
+	}
+
+	schemaID, payload, err := decodeWire(data)
+	if err != nil {
+		return message, err
+	}
+
+	schema, err := c.Registry.SchemaByID(schemaID)
+	if err != nil {
+		return message, err
+	}
+
+	var record map[string]interface{}
+	switch schema.SchemaType {
+	case AVRO:
+		writer, err := parseAvroSchema(schema.Schema)
+		if err != nil {
+			return message, err
+		}
+
+		decoded, err := decodeAvro(bytes.NewReader(payload), writer)
+		if err != nil {
+			return message, err
+		}
+		record, _ = decoded.(map[string]interface{})
+	case PROTOBUF:
+		payload, err = skipMessageIndexes(payload)
+		if err != nil {
+			return message, err
+		}
+
+		record, err = decodeProtobuf(payload)
+		if err != nil {
+			return message, err
+		}
+	default:
+		return message, fmt.Errorf("unsupported schema type %s", schema.SchemaType)
+	}
+
+	return recordMessage(record), nil
+}
+
+// CheckCompatibility tells whether the message schema of the current format
+// can be registered for the topic without breaking its existing consumers
+func (c *Codec) CheckCompatibility(topic string) (bool, error) {
+	switch c.Format {
+	case AVRO_FORMAT:
+		return c.Registry.IsCompatible(subject(topic), AVRO, MESSAGE_AVRO_SCHEMA)
+	case PROTOBUF_FORMAT:
+		return c.Registry.IsCompatible(subject(topic), PROTOBUF, MESSAGE_PROTOBUF_SCHEMA)
+	}
+
+	return true, nil
+}
+
+// Schemas are registered once per subject, the registry rejects incompatible ones
+func (c *Codec) schemaID(topic string, schemaType string, schema string) (int, error) {
+	c.mutex.RLock()
+	id, ok := c.schemaIDs[topic]
+	c.mutex.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := c.Registry.Register(subject(topic), schemaType, schema)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	c.schemaIDs[topic] = id
+	c.mutex.Unlock()
+
+	return id, nil
+}
+
+// Topic name strategy of the Confluent serializers
+func subject(topic string) string {
+	return topic + "-value"
+}
+
+func messageRecord(message common_models.Message) map[string]interface{} {
+	id := ""
+	if message.Id.Valid() {
+		id = message.Id.Hex()
+	}
+
+	metadata := map[string]interface{}{}
+	for key, value := range message.Metadata {
+		metadata[key] = value
+	}
+
+	return map[string]interface{}{
+		"id":             id,
+		"recipient":      message.Recipient,
+		"message":        message.Message,
+		"sender":         message.Sender,
+		"type":           message.Type,
+		"created_on":     message.CreatedOn,
+		"received_on":    message.ReceivedOn,
+		"processed_on":   message.ProcessedOn,
+		"metadata":       metadata,
+		"body_encoding":  message.BodyEncoding,
+		"body_reference": message.BodyReference,
+
+		"template_id":      message.TemplateId,
+		"template_version": int64(message.TemplateVersion),
+		"locale":           message.Locale,
+		"priority":         message.Priority,
+		"campaign_id":      message.CampaignId,
+		"status":           message.Status,
+		"time_zone":        message.TimeZone,
+	}
+}
+
+func recordMessage(record map[string]interface{}) common_models.Message {
+	message := common_models.Message{
+		Recipient:   toString(record["recipient"]),
+		Message:     toString(record["message"]),
+		Sender:      toString(record["sender"]),
+		Type:        toString(record["type"]),
+		CreatedOn:   toInt64(record["created_on"]),
+		ReceivedOn:  toInt64(record["received_on"]),
+		ProcessedOn: toInt64(record["processed_on"]),
+
+		BodyEncoding:  toString(record["body_encoding"]),
+		BodyReference: toString(record["body_reference"]),
+
+		TemplateId:      toString(record["template_id"]),
+		TemplateVersion: int(toInt64(record["template_version"])),
+		Locale:          toString(record["locale"]),
+		Priority:        toString(record["priority"]),
+		CampaignId:      toString(record["campaign_id"]),
+		Status:          toString(record["status"]),
+		TimeZone:        toString(record["time_zone"]),
+	}
+
+	if id := toString(record["id"]); bson.IsObjectIdHex(id) {
+		message.Id = bson.ObjectIdHex(id)
+	}
+
+	if metadata, ok := record["metadata"].(map[string]interface{}); ok && len(metadata) > 0 {
+		message.Metadata = map[string]string{}
+		for key, value := range metadata {
+			message.Metadata[key] = toString(value)
+		}
+	}
+
+	return message
+}
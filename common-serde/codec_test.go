@@ -0,0 +1,162 @@
+package common_serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testMessage() common_models.Message {
+	return common_models.Message{
+		Id:              bson.NewObjectId(),
+		Recipient:       "+18095551234",
+		Message:         "Your code is 123456",
+		Sender:          "bank",
+		Type:            common_models.OneTimePassword,
+		CreatedOn:       1700000000000000000,
+		ReceivedOn:      1700000000000000001,
+		ProcessedOn:     1700000000000000002,
+		Metadata:        map[string]string{"tenant": "acme", "region": "do"},
+		BodyEncoding:    "gzip",
+		BodyReference:   "gridfs:abc",
+		TemplateId:      "welcome",
+		TemplateVersion: 3,
+		Locale:          "es-DO",
+		Priority:        common_models.HIGH_PRIORITY,
+		CampaignId:      "5f1b2c3d4e5f6a7b8c9d0e1f",
+		Status:          common_models.FAILED,
+		TimeZone:        "America/Santo_Domingo",
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{JSON_FORMAT, AVRO_FORMAT, PROTOBUF_FORMAT} {
+		t.Run(format, func(t *testing.T) {
+			registry := NewMockRegistry()
+			producer, err := NewCodecWithRegistry(format, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A separate codec on the same registry, like a dispatcher reading what a producer wrote
+			consumer, _ := NewCodecWithRegistry(JSON_FORMAT, registry)
+
+			message := testMessage()
+			data, err := producer.Serialize("messaging_cmp", message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := consumer.Deserialize(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, message) {
+				t.Fatalf("decoded %+v, want %+v", decoded, message)
+			}
+		})
+	}
+}
+
+func TestRoundTripEmptyMessage(t *testing.T) {
+	for _, format := range []string{AVRO_FORMAT, PROTOBUF_FORMAT} {
+		codec, _ := NewCodecWithRegistry(format, NewMockRegistry())
+
+		message := common_models.Message{Recipient: "user@example.com", Message: "hi", Sender: "shop", Type: "TRX"}
+		data, err := codec.Serialize("messaging_cmp", message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := codec.Deserialize(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("%s decoded %+v, want %+v", format, decoded, message)
+		}
+	}
+}
+
+func TestWireHeader(t *testing.T) {
+	registry := NewMockRegistry()
+	registry.Register("other-value", AVRO, `{"type":"record","name":"Other","fields":[]}`)
+
+	for _, format := range []string{AVRO_FORMAT, PROTOBUF_FORMAT} {
+		codec, _ := NewCodecWithRegistry(format, registry)
+		data, err := codec.Serialize("messaging_"+format, testMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsWireFormat(data) || data[0] != MAGIC_BYTE {
+			t.Fatalf("%s payload doesn't start with the magic byte: %v", format, data[:5])
+		}
+
+		id := int(binary.BigEndian.Uint32(data[1:5]))
+		schema, err := registry.SchemaByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == AVRO_FORMAT && schema.Schema != MESSAGE_AVRO_SCHEMA {
+			t.Fatalf("schema %d isn't the message schema", id)
+		}
+		if format == PROTOBUF_FORMAT && (schema.Schema != MESSAGE_PROTOBUF_SCHEMA || data[5] != 0) {
+			t.Fatalf("schema %d isn't the message schema or the message indexes are missing", id)
+		}
+	}
+}
+
+func TestSchemaRegisteredOncePerSubject(t *testing.T) {
+	registry := NewMockRegistry()
+	first, _ := NewCodecWithRegistry(AVRO_FORMAT, registry)
+	second, _ := NewCodecWithRegistry(AVRO_FORMAT, registry)
+
+	a, _ := first.Serialize("messaging_cmp", testMessage())
+	b, _ := second.Serialize("messaging_cmp", testMessage())
+	c, _ := second.Serialize("messaging_trx", testMessage())
+
+	if !bytes.Equal(a[:5], b[:5]) {
+		t.Fatalf("codecs got different schema ids for one subject: %v %v", a[:5], b[:5])
+	}
+	if !bytes.Equal(a[:5], c[:5]) {
+		t.Fatalf("an identical schema got a new id on another subject: %v %v", a[:5], c[:5])
+	}
+}
+
+func TestDeserializePlainJSON(t *testing.T) {
+	codec, _ := NewCodecWithRegistry(AVRO_FORMAT, NewMockRegistry())
+
+	decoded, err := codec.Deserialize([]byte(`{"recipient":"+18095551234","message":"hi","sender":"bank","type":"TRX"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Recipient != "+18095551234" || decoded.Message != "hi" {
+		t.Fatalf("decoded %+v", decoded)
+	}
+}
+
+func TestDeserializeUnknownSchema(t *testing.T) {
+	codec, _ := NewCodecWithRegistry(JSON_FORMAT, NewMockRegistry())
+
+	if _, err := codec.Deserialize(encodeWire(42, []byte{0})); err == nil {
+		t.Fatal("decoded a payload of an unknown schema")
+	}
+	if _, _, err := decodeWire([]byte{0, 0, 1}); err != ErrNotWireFormat {
+		t.Fatalf("short payload returned %v", err)
+	}
+}
+
+func TestCodecRequiresRegistry(t *testing.T) {
+	for _, format := range []string{AVRO_FORMAT, PROTOBUF_FORMAT} {
+		if _, err := NewCodecWithRegistry(format, nil); err == nil {
+			t.Fatalf("%s codec built without a registry", format)
+		}
+	}
+	if _, err := NewCodecWithRegistry("xml", nil); err == nil {
+		t.Fatal("built a codec for an unknown format")
+	}
+}
@@ -0,0 +1,115 @@
+package common_serde
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// CheckCompatibility verifies that data written with previous can still be
+// read with next (backward compatibility, the schema registry default)
+func CheckCompatibility(previous Schema, next Schema) error {
+	if previous.SchemaType != next.SchemaType {
+		return fmt.Errorf("schema type changes from %s to %s", previous.SchemaType, next.SchemaType)
+	}
+
+	switch next.SchemaType {
+	case AVRO:
+		return checkAvroCompatibility(previous.Schema, next.Schema)
+	case PROTOBUF:
+		return checkProtobufCompatibility(previous.Schema, next.Schema)
+	}
+
+	return fmt.Errorf("unsupported schema type %s", next.SchemaType)
+}
+
+func checkAvroCompatibility(previous string, next string) error {
+	writer, err := parseAvroSchema(previous)
+	if err != nil {
+		return err
+	}
+	reader, err := parseAvroSchema(next)
+	if err != nil {
+		return err
+	}
+
+	return avroReadable(writer, reader, reader.Name)
+}
+
+func avroReadable(writer *avroType, reader *avroType, path string) error {
+	if reader.Type == "union" {
+		for _, branch := range reader.Union {
+			if avroReadable(writer, branch, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: no branch of the union can read %s", path, writer.Type)
+	}
+
+	if writer.Type != reader.Type && !avroPromotable(writer.Type, reader.Type) {
+		return fmt.Errorf("%s: %s can't be read as %s", path, writer.Type, reader.Type)
+	}
+
+	switch reader.Type {
+	case "record":
+		written := map[string]avroField{}
+		for _, field := range writer.Fields {
+			written[field.Name] = field
+		}
+
+		for _, field := range reader.Fields {
+			previous, ok := written[field.Name]
+			if !ok {
+				if !field.HasDefault {
+					return fmt.Errorf("%s.%s: new field without a default", path, field.Name)
+				}
+				continue
+			}
+
+			if err := avroReadable(previous.Type, field.Type, path+"."+field.Name); err != nil {
+				return err
+			}
+		}
+	case "map":
+		return avroReadable(writer.Values, reader.Values, path+"{}")
+	case "array":
+		return avroReadable(writer.Items, reader.Items, path+"[]")
+	}
+
+	return nil
+}
+
+func avroPromotable(writer string, reader string) bool {
+	promotions := map[string][]string{
+		"int":    {"long", "float", "double"},
+		"long":   {"float", "double"},
+		"float":  {"double"},
+		"string": {"bytes"},
+		"bytes":  {"string"},
+	}
+
+	for _, allowed := range promotions[writer] {
+		if allowed == reader {
+			return true
+		}
+	}
+
+	return false
+}
+
+var protobufFieldPattern = regexp.MustCompile(`(?m)^\s*(?:repeated\s+|optional\s+)?(map<[^>]+>|[\w.]+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+
+// A field number may be added or removed but never reused with another type
+func checkProtobufCompatibility(previous string, next string) error {
+	fields := map[string]string{}
+	for _, match := range protobufFieldPattern.FindAllStringSubmatch(previous, -1) {
+		fields[match[3]] = match[1]
+	}
+
+	for _, match := range protobufFieldPattern.FindAllStringSubmatch(next, -1) {
+		if previousType, ok := fields[match[3]]; ok && previousType != match[1] {
+			return fmt.Errorf("field %s = %s changes type from %s to %s", match[2], match[3], previousType, match[1])
+		}
+	}
+
+	return nil
+}
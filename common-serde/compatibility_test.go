@@ -0,0 +1,111 @@
+package common_serde
+
+import (
+	"strings"
+	"testing"
+)
+
+const baseAvro = `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"},{"name":"attempts","type":"int"}]}`
+
+func TestAvroCompatibility(t *testing.T) {
+	cases := []struct {
+		name       string
+		next       string
+		compatible bool
+	}{
+		{"identical", baseAvro, true},
+		{"added field with default", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"},{"name":"attempts","type":"int"},{"name":"locale","type":"string","default":""}]}`, true},
+		{"added field without default", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"},{"name":"attempts","type":"int"},{"name":"locale","type":"string"}]}`, false},
+		{"removed field", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"}]}`, true},
+		{"renamed field", `{"type":"record","name":"Message","fields":[{"name":"to","type":"string"},{"name":"attempts","type":"int"}]}`, false},
+		{"promoted int to long", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"},{"name":"attempts","type":"long"}]}`, true},
+		{"narrowed type", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"int"},{"name":"attempts","type":"int"}]}`, false},
+		{"widened to union", `{"type":"record","name":"Message","fields":[{"name":"recipient","type":["null","string"]},{"name":"attempts","type":"int"}]}`, true},
+	}
+
+	for _, c := range cases {
+		err := CheckCompatibility(Schema{SchemaType: AVRO, Schema: baseAvro}, Schema{SchemaType: AVRO, Schema: c.next})
+		if (err == nil) != c.compatible {
+			t.Errorf("%s: compatible %v, got %v", c.name, c.compatible, err)
+		}
+	}
+}
+
+func TestMessageSchemasEvolveCompatibly(t *testing.T) {
+	// The schemas before template, priority and campaign fields were added
+	previousAvro := MESSAGE_AVRO_SCHEMA[:strings.Index(MESSAGE_AVRO_SCHEMA, `,{"name":"template_id"`)] + "]}"
+	if err := CheckCompatibility(Schema{SchemaType: AVRO, Schema: previousAvro}, Schema{SchemaType: AVRO, Schema: MESSAGE_AVRO_SCHEMA}); err != nil {
+		t.Fatal(err)
+	}
+
+	previousProtobuf := MESSAGE_PROTOBUF_SCHEMA[:strings.Index(MESSAGE_PROTOBUF_SCHEMA, "string template_id")] + "}"
+	if err := CheckCompatibility(Schema{SchemaType: PROTOBUF, Schema: previousProtobuf}, Schema{SchemaType: PROTOBUF, Schema: MESSAGE_PROTOBUF_SCHEMA}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtobufCompatibility(t *testing.T) {
+	previous := `message Message {
+  string recipient = 1;
+  int64 created_on = 2;
+}`
+
+	cases := []struct {
+		name       string
+		next       string
+		compatible bool
+	}{
+		{"added field", "message Message {\n  string recipient = 1;\n  int64 created_on = 2;\n  string locale = 3;\n}", true},
+		{"removed field", "message Message {\n  string recipient = 1;\n}", true},
+		{"renamed field", "message Message {\n  string to = 1;\n  int64 created_on = 2;\n}", true},
+		{"reused number with another type", "message Message {\n  string recipient = 1;\n  string created_on = 2;\n}", false},
+	}
+
+	for _, c := range cases {
+		err := CheckCompatibility(Schema{SchemaType: PROTOBUF, Schema: previous}, Schema{SchemaType: PROTOBUF, Schema: c.next})
+		if (err == nil) != c.compatible {
+			t.Errorf("%s: compatible %v, got %v", c.name, c.compatible, err)
+		}
+	}
+}
+
+func TestSchemaTypeChange(t *testing.T) {
+	if err := CheckCompatibility(Schema{SchemaType: AVRO, Schema: baseAvro}, Schema{SchemaType: PROTOBUF, Schema: MESSAGE_PROTOBUF_SCHEMA}); err == nil {
+		t.Fatal("a schema changed type without an error")
+	}
+}
+
+func TestMockRegistryRejectsIncompatibleVersions(t *testing.T) {
+	registry := NewMockRegistry()
+	if _, err := registry.Register("messaging_cmp-value", AVRO, baseAvro); err != nil {
+		t.Fatal(err)
+	}
+
+	incompatible := `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"string"},{"name":"attempts","type":"int"},{"name":"locale","type":"string"}]}`
+	if compatible, _ := registry.IsCompatible("messaging_cmp-value", AVRO, incompatible); compatible {
+		t.Fatal("incompatible schema reported compatible")
+	}
+	if _, err := registry.Register("messaging_cmp-value", AVRO, incompatible); err == nil {
+		t.Fatal("registered an incompatible schema")
+	} else if registryError, ok := err.(*RegistryError); !ok || registryError.StatusCode != 409 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Other subjects evolve on their own
+	if _, err := registry.Register("messaging_trx-value", AVRO, incompatible); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodecCheckCompatibility(t *testing.T) {
+	registry := NewMockRegistry()
+	registry.Register("messaging_cmp-value", AVRO, `{"type":"record","name":"Message","fields":[{"name":"recipient","type":"long"}]}`)
+
+	codec, _ := NewCodecWithRegistry(AVRO_FORMAT, registry)
+	if compatible, err := codec.CheckCompatibility("messaging_cmp"); err != nil || compatible {
+		t.Fatalf("message schema compatible with a long recipient: %v %v", compatible, err)
+	}
+	if compatible, err := codec.CheckCompatibility("messaging_trx"); err != nil || !compatible {
+		t.Fatalf("message schema incompatible with an empty subject: %v %v", compatible, err)
+	}
+}
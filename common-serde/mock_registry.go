@@ -0,0 +1,83 @@
+package common_serde
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// MockRegistry is an in memory registry for tests, it enforces backward
+// compatibility between the versions of a subject. Its schema ids only exist
+// in the process that registered them so services never select it
+type MockRegistry struct {
+	mutex    sync.Mutex
+	schemas  map[int]Schema
+	subjects map[string][]int
+}
+
+func NewMockRegistry() *MockRegistry {
+	return &MockRegistry{schemas: map[int]Schema{}, subjects: map[string][]int{}}
+}
+
+func (r *MockRegistry) Register(subject string, schemaType string, schema string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, id := range r.subjects[subject] {
+		if r.schemas[id].Schema == schema {
+			return id, nil
+		}
+	}
+
+	if err := r.checkLatest(subject, schemaType, schema); err != nil {
+		return 0, err
+	}
+
+	// Like the schema registry, an identical schema keeps its id across subjects
+	id := 0
+	for existing, registered := range r.schemas {
+		if registered.SchemaType == schemaType && registered.Schema == schema {
+			id = existing
+		}
+	}
+	if id == 0 {
+		id = len(r.schemas) + 1
+		r.schemas[id] = Schema{ID: id, SchemaType: schemaType, Schema: schema}
+	}
+	r.subjects[subject] = append(r.subjects[subject], id)
+
+	return id, nil
+}
+
+func (r *MockRegistry) SchemaByID(id int) (Schema, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	schema, ok := r.schemas[id]
+	if !ok {
+		return Schema{}, &RegistryError{StatusCode: http.StatusNotFound, Code: 40403, Message: fmt.Sprintf("schema %d not found", id)}
+	}
+
+	return schema, nil
+}
+
+func (r *MockRegistry) IsCompatible(subject string, schemaType string, schema string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.checkLatest(subject, schemaType, schema) == nil, nil
+}
+
+func (r *MockRegistry) checkLatest(subject string, schemaType string, schema string) error {
+	versions := r.subjects[subject]
+	if len(versions) == 0 {
+		return nil
+	}
+
+	latest := r.schemas[versions[len(versions)-1]]
+	if err := CheckCompatibility(latest, Schema{SchemaType: schemaType, Schema: schema}); err != nil {
+		return &RegistryError{StatusCode: http.StatusConflict, Code: 409, Message: err.Error()}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package common_serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Protobuf schema of common_models.Message, field numbers must never be reused
+const MESSAGE_PROTOBUF_SCHEMA = `syntax = "proto3";
+package com.hectorandac.messaging;
+
+message Message {
+  string id = 1;
+  string recipient = 2;
+  string message = 3;
+  string sender = 4;
+  string type = 5;
+  int64 created_on = 6;
+  int64 received_on = 7;
+  int64 processed_on = 8;
+  map<string, string> metadata = 9;
+  string body_encoding = 10;
+  string body_reference = 11;
+  string template_id = 12;
+  int64 template_version = 13;
+  string locale = 14;
+  string priority = 15;
+  string campaign_id = 16;
+  string status = 17;
+  string time_zone = 18;
+}
+`
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Field numbers of MESSAGE_PROTOBUF_SCHEMA
+var protobufStringFields = map[int]string{1: "id", 2: "recipient", 3: "message", 4: "sender", 5: "type", 10: "body_encoding", 11: "body_reference", 12: "template_id", 14: "locale", 15: "priority", 16: "campaign_id", 17: "status", 18: "time_zone"}
+var protobufLongFields = map[int]string{6: "created_on", 7: "received_on", 8: "processed_on", 13: "template_version"}
+
+const protobufMetadataField = 9
+
+func encodeProtobuf(record map[string]interface{}) []byte {
+	buffer := &bytes.Buffer{}
+
+	for _, number := range sortedNumbers(protobufStringFields) {
+		if value := toString(record[protobufStringFields[number]]); value != "" {
+			writeBytesField(buffer, number, []byte(value))
+		}
+	}
+
+	for _, number := range sortedNumbers(protobufLongFields) {
+		if value := toInt64(record[protobufLongFields[number]]); value != 0 {
+			writeTag(buffer, number, wireVarint)
+			writeUvarint(buffer, uint64(value))
+		}
+	}
+
+	metadata, _ := record["metadata"].(map[string]interface{})
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		entry := &bytes.Buffer{}
+		writeBytesField(entry, 1, []byte(key))
+		writeBytesField(entry, 2, []byte(toString(metadata[key])))
+		writeBytesField(buffer, protobufMetadataField, entry.Bytes())
+	}
+
+	return buffer.Bytes()
+}
+
+// Unknown fields are skipped so messages written by newer schemas still decode
+func decodeProtobuf(payload []byte) (map[string]interface{}, error) {
+	record := map[string]interface{}{}
+	metadata := map[string]interface{}{}
+	record["metadata"] = metadata
+
+	reader := bytes.NewReader(payload)
+	for reader.Len() > 0 {
+		number, wireType, err := readTag(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch wireType {
+		case wireVarint:
+			value, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			if name, ok := protobufLongFields[number]; ok {
+				record[name] = int64(value)
+			}
+		case wireBytes:
+			value, err := readBytes(reader)
+			if err != nil {
+				return nil, err
+			}
+			if name, ok := protobufStringFields[number]; ok {
+				record[name] = string(value)
+			} else if number == protobufMetadataField {
+				key, entryValue, err := decodeMapEntry(value)
+				if err != nil {
+					return nil, err
+				}
+				metadata[key] = entryValue
+			}
+		case 1:
+			_, err = reader.Seek(8, io.SeekCurrent)
+		case 5:
+			_, err = reader.Seek(4, io.SeekCurrent)
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+func decodeMapEntry(payload []byte) (string, string, error) {
+	var key, value string
+
+	reader := bytes.NewReader(payload)
+	for reader.Len() > 0 {
+		number, wireType, err := readTag(reader)
+		if err != nil {
+			return "", "", err
+		}
+		if wireType != wireBytes {
+			return "", "", fmt.Errorf("unexpected wire type %d in map entry", wireType)
+		}
+
+		content, err := readBytes(reader)
+		if err != nil {
+			return "", "", err
+		}
+		if number == 1 {
+			key = string(content)
+		} else if number == 2 {
+			value = string(content)
+		}
+	}
+
+	return key, value, nil
+}
+
+// Confluent prefixes protobuf payloads with the index path of the message
+// type in the schema, a single zero stands for the first message
+func encodeMessageIndexes() []byte {
+	return []byte{0}
+}
+
+func skipMessageIndexes(payload []byte) ([]byte, error) {
+	reader := bytes.NewReader(payload)
+	count, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		if _, err := binary.ReadVarint(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	return payload[len(payload)-reader.Len():], nil
+}
+
+func writeTag(buffer *bytes.Buffer, number int, wireType int) {
+	writeUvarint(buffer, uint64(number<<3|wireType))
+}
+
+func writeBytesField(buffer *bytes.Buffer, number int, value []byte) {
+	writeTag(buffer, number, wireBytes)
+	writeUvarint(buffer, uint64(len(value)))
+	buffer.Write(value)
+}
+
+func writeUvarint(buffer *bytes.Buffer, value uint64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutUvarint(encoded, value)])
+}
+
+func readTag(reader *bytes.Reader) (int, int, error) {
+	tag, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(tag >> 3), int(tag & 7), nil
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	content := make([]byte, length)
+	_, err = io.ReadFull(reader, content)
+	return content, err
+}
+
+func sortedNumbers(fields map[int]string) []int {
+	numbers := make([]int, 0, len(fields))
+	for number := range fields {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	return numbers
+}
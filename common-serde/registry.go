@@ -0,0 +1,148 @@
+package common_serde
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	AVRO     = "AVRO"
+	PROTOBUF = "PROTOBUF"
+)
+
+type Schema struct {
+	ID         int
+	SchemaType string
+	Schema     string
+}
+
+// Registry is the subset of the Confluent Schema Registry API the serializers rely on
+type Registry interface {
+	Register(subject string, schemaType string, schema string) (int, error)
+	SchemaByID(id int) (Schema, error)
+	IsCompatible(subject string, schemaType string, schema string) (bool, error)
+}
+
+// RegistryError is returned for non 2xx responses of the schema registry
+type RegistryError struct {
+	StatusCode int
+	Code       int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("schema registry returned status %d (%d): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// HTTPRegistry talks to a Confluent compatible schema registry, schemas are cached by id
+type HTTPRegistry struct {
+	URL        string
+	HTTPClient *http.Client
+
+	mutex sync.RWMutex
+	cache map[int]Schema
+}
+
+func NewHTTPRegistry(url string) *HTTPRegistry {
+	return &HTTPRegistry{URL: url, HTTPClient: &http.Client{Timeout: 10 * time.Second}, cache: map[int]Schema{}}
+}
+
+func (r *HTTPRegistry) Register(subject string, schemaType string, schema string) (int, error) {
+	var response struct {
+		ID int `json:"id"`
+	}
+
+	err := r.request("POST", "/subjects/"+subject+"/versions", schemaRequest(schemaType, schema), &response)
+	return response.ID, err
+}
+
+func (r *HTTPRegistry) SchemaByID(id int) (Schema, error) {
+	r.mutex.RLock()
+	schema, ok := r.cache[id]
+	r.mutex.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	var response struct {
+		SchemaType string `json:"schemaType"`
+		Schema     string `json:"schema"`
+	}
+	if err := r.request("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &response); err != nil {
+		return Schema{}, err
+	}
+
+	// The registry omits the type for Avro, its historical default
+	if response.SchemaType == "" {
+		response.SchemaType = AVRO
+	}
+
+	schema = Schema{ID: id, SchemaType: response.SchemaType, Schema: response.Schema}
+	r.mutex.Lock()
+	r.cache[id] = schema
+	r.mutex.Unlock()
+
+	return schema, nil
+}
+
+func (r *HTTPRegistry) IsCompatible(subject string, schemaType string, schema string) (bool, error) {
+	var response struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+
+	err := r.request("POST", "/compatibility/subjects/"+subject+"/versions/latest", schemaRequest(schemaType, schema), &response)
+	if registryError, ok := err.(*RegistryError); ok && registryError.StatusCode == http.StatusNotFound {
+		return true, nil
+	}
+
+	return response.IsCompatible, err
+}
+
+func schemaRequest(schemaType string, schema string) map[string]interface{} {
+	body := map[string]interface{}{"schema": schema}
+	if schemaType != AVRO {
+		body["schemaType"] = schemaType
+	}
+
+	return body
+}
+
+func (r *HTTPRegistry) request(method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, r.URL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		registryError := &RegistryError{StatusCode: resp.StatusCode}
+		json.Unmarshal(content, registryError)
+		return registryError
+	}
+
+	return json.Unmarshal(content, result)
+}
@@ -0,0 +1,31 @@
+package common_serde
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Confluent wire format: a zero magic byte and the big endian schema id precede the payload
+const MAGIC_BYTE = 0
+
+var ErrNotWireFormat = errors.New("payload is not in the schema registry wire format")
+
+func encodeWire(schemaID int, payload []byte) []byte {
+	data := make([]byte, 5, 5+len(payload))
+	data[0] = MAGIC_BYTE
+	binary.BigEndian.PutUint32(data[1:5], uint32(schemaID))
+	return append(data, payload...)
+}
+
+func decodeWire(data []byte) (int, []byte, error) {
+	if !IsWireFormat(data) {
+		return 0, nil, ErrNotWireFormat
+	}
+
+	return int(binary.BigEndian.Uint32(data[1:5])), data[5:], nil
+}
+
+// IsWireFormat tells registry encoded payloads apart from plain JSON ones, which always start with "{"
+func IsWireFormat(data []byte) bool {
+	return len(data) >= 5 && data[0] == MAGIC_BYTE
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+// How long the status of a campaign is trusted before asking core again
+const CAMPAIGN_STATUS_TTL = 10 * time.Second
+
+type campaignStatus struct {
+	cancelled bool
+	expiresOn time.Time
+}
+
+var campaignStatusLock sync.Mutex
+var campaignStatuses map[string]campaignStatus = make(map[string]campaignStatus)
+
+// Tells if the campaign was cancelled. Messages are sent when core can't be
+// reached, a cancellation is best effort
+func campaignCancelled(campaignId string) bool {
+	campaignStatusLock.Lock()
+	cached, ok := campaignStatuses[campaignId]
+	campaignStatusLock.Unlock()
+	if ok && time.Now().Before(cached.expiresOn) {
+		return cached.cancelled
+	}
+
+	host, err := common_config.Endpoint(common_config.CORE_URL)
+	if err != nil {
+		return false
+	}
+
+	body, err := provisionerClient.GetJSON(host + "/campaign/" + url.PathEscape(campaignId))
+	if err != nil {
+		fmt.Printf("Couldn't check campaign %s: %v\n", campaignId, err)
+		return false
+	}
+
+	cancelled := body["status"] == common_models.CANCELLED
+	campaignStatusLock.Lock()
+	campaignStatuses[campaignId] = campaignStatus{cancelled: cancelled, expiresOn: time.Now().Add(CAMPAIGN_STATUS_TTL)}
+	campaignStatusLock.Unlock()
+
+	return cancelled
+}
@@ -0,0 +1,235 @@
+package lanes
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/mitchellh/mapstructure"
+)
+
+type Settings struct {
+	BufferSize   int `mapstructure:"buffer_size"`
+	StarvationMs int `mapstructure:"starvation_ms"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{BufferSize: 500, StarvationMs: 2000}
+}
+
+// NewSettings reads the priority_lanes section of the configuration
+func NewSettings(configuration map[string]interface{}) (Settings, error) {
+	settings := DefaultSettings()
+	if err := mapstructure.Decode(configuration["priority_lanes"], &settings); err != nil {
+		return settings, fmt.Errorf("invalid priority_lanes: %v", err)
+	}
+
+	if settings.BufferSize < 1 || settings.StarvationMs < 1 {
+		return settings, fmt.Errorf("priority_lanes needs a positive buffer_size and starvation_ms")
+	}
+
+	return settings, nil
+}
+
+// Consumer is the part of *kafka.Consumer the scheduler drives
+type Consumer interface {
+	Pause(partitions []kafka.TopicPartition) error
+	Resume(partitions []kafka.TopicPartition) error
+	Seek(partition kafka.TopicPartition, timeoutMs int) error
+}
+
+type entry struct {
+	msg    *kafka.Message
+	readOn time.Time
+}
+
+// Scheduler buffers the messages read from the lanes of a queue and hands
+// them out the most urgent lane first. A message of a lower lane waiting
+// longer than StarvationMs goes ahead so bulk lanes keep moving under a
+// steady flow of urgent messages. Each lane keeps the order it was read in
+// and buffers up to BufferSize messages, a full lane has its partitions
+// paused so the consumer keeps reading the others
+type Scheduler struct {
+	Settings Settings
+	Lanes    []string
+
+	lock    sync.Mutex
+	buffers map[string][]entry
+	length  int
+	paused  map[string]kafka.TopicPartition
+}
+
+func NewScheduler(lanes []string, settings Settings) *Scheduler {
+	return &Scheduler{Settings: settings, Lanes: lanes, buffers: map[string][]entry{}, paused: map[string]kafka.TopicPartition{}}
+}
+
+func partitionName(topic string, partition int32) string {
+	return topic + "/" + strconv.Itoa(int(partition))
+}
+
+// Push buffers msg and tells if its lane reached BufferSize
+func (s *Scheduler) Push(msg *kafka.Message) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	topic := *msg.TopicPartition.Topic
+	s.buffers[topic] = append(s.buffers[topic], entry{msg: msg, readOn: time.Now()})
+	s.length++
+
+	return len(s.buffers[topic]) >= s.Settings.BufferSize
+}
+
+// Pause stops fetching the partition of msg until its lane drains, it is
+// rewound past msg so nothing fetched in the meantime is lost
+func (s *Scheduler) Pause(consumer Consumer, msg *kafka.Message) error {
+	partition := kafka.TopicPartition{Topic: msg.TopicPartition.Topic, Partition: msg.TopicPartition.Partition, Offset: msg.TopicPartition.Offset + 1}
+
+	if err := consumer.Pause([]kafka.TopicPartition{partition}); err != nil {
+		return err
+	}
+	if err := consumer.Seek(partition, 1000); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paused[partitionName(*partition.Topic, partition.Partition)] = partition
+
+	return nil
+}
+
+// Held tells if msg belongs to a partition paused by the scheduler, the
+// rewind delivers it again once resumed
+func (s *Scheduler) Held(msg *kafka.Message) bool {
+	return s.Holds(*msg.TopicPartition.Topic, msg.TopicPartition.Partition)
+}
+
+func (s *Scheduler) Holds(topic string, partition int32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.paused[partitionName(topic, partition)]
+	return ok
+}
+
+// ResumeDrained resumes the partitions of lanes drained to half their
+// buffer. Partitions still held by someone else are left paused for them
+func (s *Scheduler) ResumeDrained(consumer Consumer, held func(topic string, partition int32) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, partition := range s.paused {
+		if len(s.buffers[*partition.Topic]) > s.Settings.BufferSize/2 {
+			continue
+		}
+
+		if !held(*partition.Topic, partition.Partition) {
+			resumed := kafka.TopicPartition{Topic: partition.Topic, Partition: partition.Partition}
+			if err := consumer.Resume([]kafka.TopicPartition{resumed}); err != nil {
+				fmt.Printf("Couldn't resume %s: %v\n", name, err)
+			}
+		}
+		delete(s.paused, name)
+	}
+}
+
+func (s *Scheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.length
+}
+
+// Full tells if the consumer should stop reading ahead, only reached when
+// every lane is full since full lanes are paused
+func (s *Scheduler) Full() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.length >= s.Settings.BufferSize*len(s.Lanes)
+}
+
+// Next removes and returns the message to dispatch, nil when none is buffered
+func (s *Scheduler) Next(now time.Time) *kafka.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	starvation := time.Duration(s.Settings.StarvationMs) * time.Millisecond
+
+	picked := ""
+	oldest := time.Duration(0)
+	for i, lane := range s.Lanes {
+		buffer := s.buffers[lane]
+		if len(buffer) == 0 {
+			continue
+		}
+		if picked == "" {
+			picked = lane
+		}
+		if waited := now.Sub(buffer[0].readOn); i > 0 && waited >= starvation && waited > oldest {
+			picked, oldest = lane, waited
+		}
+	}
+
+	// Topics that aren't lanes of the queue come last
+	if picked == "" {
+		for topic, buffer := range s.buffers {
+			if len(buffer) > 0 {
+				picked = topic
+				break
+			}
+		}
+	}
+	if picked == "" {
+		return nil
+	}
+
+	next := s.buffers[picked][0]
+	s.buffers[picked] = s.buffers[picked][1:]
+	s.length--
+
+	return next.msg
+}
+
+// Drop discards the buffered messages of a partition, used once it is
+// rewound so they aren't dispatched twice
+func (s *Scheduler) Drop(topic string, partition int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	kept := []entry{}
+	for _, buffered := range s.buffers[topic] {
+		if buffered.msg.TopicPartition.Partition != partition {
+			kept = append(kept, buffered)
+		}
+	}
+
+	s.length -= len(s.buffers[topic]) - len(kept)
+	s.buffers[topic] = kept
+}
+
+// Reset discards every buffered message and paused partition, called once
+// partitions are revoked
+func (s *Scheduler) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.buffers = map[string][]entry{}
+	s.length = 0
+	s.paused = map[string]kafka.TopicPartition{}
+}
+
+// Buffered returns the number of messages waiting in each lane
+func (s *Scheduler) Buffered() map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buffered := map[string]int{}
+	for topic, buffer := range s.buffers {
+		buffered[topic] = len(buffer)
+	}
+
+	return buffered
+}
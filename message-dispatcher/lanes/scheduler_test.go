@@ -0,0 +1,161 @@
+package lanes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Records the partitions paused and resumed
+type recordingConsumer struct {
+	paused  []kafka.TopicPartition
+	resumed []kafka.TopicPartition
+}
+
+func (c *recordingConsumer) Pause(partitions []kafka.TopicPartition) error {
+	c.paused = append(c.paused, partitions...)
+	return nil
+}
+
+func (c *recordingConsumer) Resume(partitions []kafka.TopicPartition) error {
+	c.resumed = append(c.resumed, partitions...)
+	return nil
+}
+
+func (c *recordingConsumer) Seek(partition kafka.TopicPartition, timeoutMs int) error {
+	return nil
+}
+
+var testLanes = []string{"messaging_cmp-high", "messaging_cmp", "messaging_cmp-low"}
+
+func laneMessage(lane int, offset kafka.Offset) *kafka.Message {
+	topic := testLanes[lane]
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: offset}}
+}
+
+func dispatched(scheduler *Scheduler, now time.Time) []string {
+	order := []string{}
+	for msg := scheduler.Next(now); msg != nil; msg = scheduler.Next(now) {
+		order = append(order, *msg.TopicPartition.Topic+":"+msg.TopicPartition.Offset.String())
+	}
+
+	return order
+}
+
+func TestNextPrefersUrgentLanes(t *testing.T) {
+	scheduler := NewScheduler(testLanes, Settings{BufferSize: 10, StarvationMs: 2000})
+	scheduler.Push(laneMessage(2, 1))
+	scheduler.Push(laneMessage(1, 1))
+	scheduler.Push(laneMessage(0, 1))
+	scheduler.Push(laneMessage(1, 2))
+	scheduler.Push(laneMessage(0, 2))
+
+	order := dispatched(scheduler, time.Now())
+	expected := []string{"messaging_cmp-high:1", "messaging_cmp-high:2", "messaging_cmp:1", "messaging_cmp:2", "messaging_cmp-low:1"}
+	if len(order) != len(expected) {
+		t.Fatalf("dispatched %v, want %v", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("dispatched %v, want %v", order, expected)
+		}
+	}
+	if scheduler.Len() != 0 {
+		t.Errorf("%d messages left", scheduler.Len())
+	}
+}
+
+func TestStarvedLanesGoAhead(t *testing.T) {
+	scheduler := NewScheduler(testLanes, Settings{BufferSize: 10, StarvationMs: 2000})
+	scheduler.Push(laneMessage(2, 1))
+	scheduler.Push(laneMessage(1, 1))
+	for offset := kafka.Offset(1); offset <= 3; offset++ {
+		scheduler.Push(laneMessage(0, offset))
+	}
+
+	// Before the starvation delay urgent messages keep going first
+	if msg := scheduler.Next(time.Now()); *msg.TopicPartition.Topic != testLanes[0] {
+		t.Fatalf("dispatched %s before the starvation delay", *msg.TopicPartition.Topic)
+	}
+
+	// Once starved the lane waiting the longest goes ahead, one message at a time
+	later := time.Now().Add(3 * time.Second)
+	if msg := scheduler.Next(later); *msg.TopicPartition.Topic != testLanes[2] {
+		t.Errorf("dispatched %s, want the longest waiting lane", *msg.TopicPartition.Topic)
+	}
+	if msg := scheduler.Next(later); *msg.TopicPartition.Topic != testLanes[1] {
+		t.Errorf("dispatched %s, want the next starved lane", *msg.TopicPartition.Topic)
+	}
+	if msg := scheduler.Next(later); *msg.TopicPartition.Topic != testLanes[0] {
+		t.Errorf("dispatched %s, want urgent messages once nothing is starved", *msg.TopicPartition.Topic)
+	}
+}
+
+func TestFullLanesPauseUntilDrained(t *testing.T) {
+	scheduler := NewScheduler(testLanes, Settings{BufferSize: 4, StarvationMs: 2000})
+	consumer := &recordingConsumer{}
+
+	for offset := kafka.Offset(1); offset <= 4; offset++ {
+		msg := laneMessage(2, offset)
+		if full := scheduler.Push(msg); full != (offset == 4) {
+			t.Fatalf("offset %d reported full %v", offset, full)
+		} else if full {
+			scheduler.Pause(consumer, msg)
+		}
+	}
+	if len(consumer.paused) != 1 || consumer.paused[0].Offset != 5 {
+		t.Fatalf("paused %v, want the low lane rewound past offset 4", consumer.paused)
+	}
+	if !scheduler.Held(laneMessage(2, 5)) || scheduler.Held(laneMessage(0, 1)) {
+		t.Fatal("only the full lane should be held")
+	}
+	if scheduler.Full() {
+		t.Fatal("one full lane stopped every read")
+	}
+
+	notHeld := func(topic string, partition int32) bool { return false }
+	scheduler.Next(time.Now())
+	scheduler.ResumeDrained(consumer, notHeld)
+	if len(consumer.resumed) != 0 {
+		t.Fatalf("resumed with %d messages buffered", scheduler.Len())
+	}
+
+	scheduler.Next(time.Now())
+	scheduler.ResumeDrained(consumer, notHeld)
+	if len(consumer.resumed) != 1 || scheduler.Held(laneMessage(2, 5)) {
+		t.Errorf("lane drained to half its buffer wasn't resumed: %v", consumer.resumed)
+	}
+}
+
+func TestResumeLeavesPartitionsHeldElsewhere(t *testing.T) {
+	scheduler := NewScheduler(testLanes, Settings{BufferSize: 1, StarvationMs: 2000})
+	consumer := &recordingConsumer{}
+
+	msg := laneMessage(1, 1)
+	scheduler.Push(msg)
+	scheduler.Pause(consumer, msg)
+	scheduler.Next(time.Now())
+	scheduler.ResumeDrained(consumer, func(topic string, partition int32) bool { return true })
+
+	if len(consumer.resumed) != 0 || scheduler.Held(msg) {
+		t.Errorf("resumed %v, the throttle still holds the partition", consumer.resumed)
+	}
+}
+
+func TestDropDiscardsRewoundPartition(t *testing.T) {
+	scheduler := NewScheduler(testLanes, Settings{BufferSize: 10, StarvationMs: 2000})
+	other := laneMessage(1, 7)
+	other.TopicPartition.Partition = 1
+	scheduler.Push(laneMessage(1, 1))
+	scheduler.Push(other)
+	scheduler.Push(laneMessage(1, 2))
+
+	scheduler.Drop(testLanes[1], 0)
+	if scheduler.Len() != 1 {
+		t.Fatalf("%d messages left, want the other partition's", scheduler.Len())
+	}
+	if msg := scheduler.Next(time.Now()); msg != other {
+		t.Errorf("dispatched %v", msg.TopicPartition)
+	}
+}
@@ -1,51 +1,203 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_claimcheck "github.com/hectorandac/kafka-message-processor/common-claimcheck"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
 	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_provisioner "github.com/hectorandac/kafka-message-processor/common-provisioner"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	common_serde "github.com/hectorandac/kafka-message-processor/common-serde"
+	"github.com/hectorandac/kafka-message-processor/message-dispatcher/lanes"
+	"github.com/hectorandac/kafka-message-processor/message-dispatcher/throttle"
+	"github.com/hectorandac/kafka-message-processor/message-dispatcher/workers"
 )
 
+const SERVICE_NAME = "message-dispatcher"
+const CORE_COMPONENT = "core"
+
+// How long a read waits before checking if throttled partitions can resume
+const THROTTLE_POLL_INTERVAL = 100 * time.Millisecond
+
 var consumerClient *kafka.Consumer
 var producerClient *kafka.Producer
 var configuration map[string]interface{}
+var codec *common_serde.Codec
+var claimCheck *common_claimcheck.ClaimCheck
+var dispatchThrottle *throttle.Throttle = &throttle.Throttle{}
+var offsetTracker *workers.OffsetTracker
+var workerPool *workers.Pool
+var laneSettings lanes.Settings
+var laneScheduler *lanes.Scheduler
 var nextSubcriptionTarget string
+var subscriptionLanes []string
+var partitionKey string = common_models.DEFAULT_PARTITION_KEY
+var provisionerClient *common_provisioner.Client = common_provisioner.NewClient(SERVICE_NAME)
 
 func main() {
-	setupEnvironment()
-	consumerClient.SubscribeTopics([]string{nextSubcriptionTarget}, nil)
-	fmt.Printf("Registered to: %s\n", nextSubcriptionTarget)
+	common_health.Register(common_provisioner.COMPONENT)
+	common_health.Register(common_kafka.COMPONENT)
+	common_health.Register(CORE_COMPONENT)
+	common_health.RegisterCheck(common_kafka.COMPONENT, true, func() error { return common_kafka.Check(consumerClient)() })
+	common_health.RegisterCheck(common_provisioner.COMPONENT, false, provisionerClient.Check)
+	common_health.Handle("/throttle", func(w http.ResponseWriter, req *http.Request) {
+		common_health.WriteJSON(w, http.StatusOK, dispatchThrottle.State())
+	})
+	common_health.Handle("/workers", func(w http.ResponseWriter, req *http.Request) {
+		if workerPool == nil {
+			common_health.WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "workers are not started"})
+			return
+		}
+		common_health.WriteJSON(w, http.StatusOK, map[string]interface{}{"settings": workerPool.Settings, "queued": workerPool.InFlight(), "pending_offsets": offsetTracker.Pending()})
+	})
+	common_health.Handle("/lanes", func(w http.ResponseWriter, req *http.Request) {
+		if laneScheduler == nil {
+			common_health.WriteJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "lanes are not started"})
+			return
+		}
+		common_health.WriteJSON(w, http.StatusOK, map[string]interface{}{"lanes": laneScheduler.Lanes, "settings": laneScheduler.Settings, "buffered": laneScheduler.Buffered()})
+	})
+	common_health.Serve(common_config.Get(common_config.LISTEN_ADDRESS, ":3030"))
+
+	// Retried until it succeeds, a configuration error is fixed in the provisioner without restarting
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		err := setupEnvironment()
+		if err != nil {
+			fmt.Printf("Couldn't setup the environment (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		}
+		return err
+	})
+	laneScheduler = lanes.NewScheduler(subscriptionLanes, laneSettings)
+	consumerClient.SubscribeTopics(subscriptionLanes, rebalance)
+	fmt.Printf("Registered to: %s %v\n", nextSubcriptionTarget, subscriptionLanes)
 	defer consumerClient.Close()
 
 	for {
-		msg, err := consumerClient.ReadMessage(-1)
-		if err == nil {
-			var result common_models.Message
-			json.Unmarshal(msg.Value, &result)
-			result.ReceivedOn = time.Now().UnixNano()
-			messageProcessor(result)
-		} else {
-			fmt.Printf("Consumer error: %v (%v)\n", err, msg)
+		dispatchThrottle.ResumeDue(consumerClient, laneScheduler.Holds)
+		laneScheduler.ResumeDrained(consumerClient, dispatchThrottle.Holds)
+
+		// Reads ahead of the workers so urgent lanes can overtake what is buffered
+		timeout := THROTTLE_POLL_INTERVAL
+		if laneScheduler.Len() > 0 {
+			timeout = 0
+		}
+		for read := 0; read < laneScheduler.Settings.BufferSize && !laneScheduler.Full(); read++ {
+			msg, err := consumerClient.ReadMessage(timeout)
+			if kafkaError, ok := err.(kafka.Error); ok && kafkaError.Code() == kafka.ErrTimedOut {
+				break
+			} else if err != nil {
+				fmt.Printf("Consumer error: %v (%v)\n", err, msg)
+				break
+			}
+			timeout = 0
+
+			if dispatchThrottle.Held(msg) || laneScheduler.Held(msg) {
+				continue
+			}
+			// A full lane stops being read so the others keep flowing
+			if laneScheduler.Push(msg) {
+				if err := laneScheduler.Pause(consumerClient, msg); err != nil {
+					fmt.Printf("Couldn't pause %v: %v\n", msg.TopicPartition, err)
+				}
+			}
+		}
+
+		if msg := laneScheduler.Next(time.Now()); msg != nil {
+			dispatch(msg)
+		}
+	}
+}
+
+func dispatch(msg *kafka.Message) {
+	if dispatchThrottle.Held(msg) {
+		return
+	}
+
+	stored, err := codec.Deserialize(msg.Value)
+	result := stored
+	if err == nil {
+		result, err = claimCheck.Resolve(stored)
+	}
+	if err != nil {
+		fmt.Printf("Couldn't decode message on %s: %v\n", *msg.TopicPartition.Topic, err)
+		workerPool.Submit(msg, func() {})
+		return
+	}
+
+	// Lanes of a queue share its channel limits
+	if key, wait := dispatchThrottle.Take(nextSubcriptionTarget, result); wait > 0 {
+		if err := dispatchThrottle.Pause(consumerClient, msg, key, wait); err != nil {
+			fmt.Printf("Couldn't pause %v: %v\n", msg.TopicPartition, err)
 		}
+		laneScheduler.Drop(*msg.TopicPartition.Topic, msg.TopicPartition.Partition)
+		return
 	}
+	result.ReceivedOn = time.Now().UnixNano()
+
+	headers, _ := common_kafka.ReadHeaders(msg)
+	workerPool.Submit(msg, func() { messageProcessor(result, stored, headers) })
 }
 
-// Stubbed function that makes thread sleep for two senconds to mimic the time it would take to send a message to a mobile device
-func messageProcessor(message common_models.Message) {
+// Partitions are only handed over once the messages read from them were
+// processed and their offsets committed
+func rebalance(c *kafka.Consumer, event kafka.Event) error {
+	switch e := event.(type) {
+	case kafka.AssignedPartitions:
+		return c.Assign(e.Partitions)
+	case kafka.RevokedPartitions:
+		workerPool.Wait()
+		if _, err := c.Commit(); err != nil {
+			fmt.Printf("Couldn't commit revoked partitions: %v\n", err)
+		}
+		offsetTracker.Reset()
+		dispatchThrottle.Reset()
+		laneScheduler.Reset()
+		return c.Unassign()
+	}
+
+	return nil
+}
+
+// Processes a message read from a queue and reports it to the reporting queue,
+// messages of cancelled campaigns are reported as cancelled instead. stored
+// is the message as read, before its body was resolved, so the report reuses
+// its claim check reference
+func messageProcessor(message common_models.Message, stored common_models.Message, headers common_kafka.MessageHeaders) {
+	if message.CampaignId != "" && campaignCancelled(message.CampaignId) {
+		fmt.Printf("FROM QUEUE [%s] Message of cancelled campaign %s dropped\n", nextSubcriptionTarget, message.CampaignId)
+		message.Status = common_models.CANCELLED
+		produce(claimCheck.Reuse(message, stored), headers)
+		return
+	}
+
 	fmt.Printf("FROM QUEUE [%s] Message processed: %s\n", nextSubcriptionTarget, message.Message)
-	produce(message)
+	produce(claimCheck.Reuse(message, stored), headers)
 	message.ProcessedOn = time.Now().UnixNano()
 }
 
-func produce(message common_models.Message) {
+// Reports the message keeping the attempt and trace context it was received with
+func produce(message common_models.Message, headers common_kafka.MessageHeaders) {
 	topic := configuration["reporting_queue"].(string)
-	result, err := json.Marshal(message)
+	prepared, err := claimCheck.Prepare(topic, message)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	result, err := codec.Serialize(topic, prepared)
+
+	attempt := headers.Attempt
+	if attempt < 1 {
+		attempt = 1
+	}
 
 	if err != nil {
 		fmt.Println(err.Error())
@@ -53,8 +205,10 @@ func produce(message common_models.Message) {
 	}
 
 	err = producerClient.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: -1},
-		Value:          []byte(result),
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            message.PartitionKey(partitionKey),
+		Value:          result,
+		Headers:        common_kafka.HeadersFor(message, attempt, common_kafka.ChildTraceParent(headers.TraceParent)),
 	}, nil)
 
 	if err != nil {
@@ -71,76 +225,101 @@ func setupEnvironment() error {
 
 	err = setupServerConsumerTarget()
 	if err != nil {
+		// Built again by the next attempt
+		consumerClient.Close()
+		producerClient.Close()
 		return err
 	}
 
 	return nil
 }
 
+// Retries until the core service hands out a subscription target
 func setupServerConsumerTarget() error {
-	url := "http://0.0.0.0:3000/register_consumer"
-	body, err := getRequest(url)
-
+	host, err := common_config.Endpoint(common_config.CORE_URL)
 	if err != nil {
-		return errors.New("couldn't retrieve information form provisioning service")
+		return err
 	}
 
-	if body["result"] == "registered" {
-		nextSubcriptionTarget = body["subscription_target"].(string)
-	}
+	return common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		body, err := provisionerClient.GetJSON(host + "/register_consumer")
+		if err == nil && body["result"] != "registered" {
+			err = errors.New("core service didn't register the consumer")
+		}
 
-	return err
+		if err != nil {
+			fmt.Printf("Couldn't register the consumer (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(CORE_COMPONENT, err.Error())
+			return err
+		}
+
+		nextSubcriptionTarget, _ = body["subscription_target"].(string)
+		subscriptionLanes = []string{}
+		laneTopics, _ := body["lanes"].([]interface{})
+		for _, lane := range laneTopics {
+			if topic, ok := lane.(string); ok {
+				subscriptionLanes = append(subscriptionLanes, topic)
+			}
+		}
+		if len(subscriptionLanes) == 0 {
+			subscriptionLanes = []string{nextSubcriptionTarget}
+		}
+		common_health.SetReady(CORE_COMPONENT)
+		return nil
+	})
 }
 
 func setKafkaConfiguration() error {
-	url := "http://localhost:3010/config/kafka_service_config"
-	body, err := getRequest(url)
+	configuration, _ = provisionerClient.WaitForConfiguration(common_provisioner.KAFKA_SERVICE_CONFIG)
 
+	var err error
+	codec, err = common_serde.NewCodec(configuration)
 	if err != nil {
-		return errors.New("couldn't retrieve information form provisioning service")
+		return err
 	}
 
-	if body["status"] == "successful" {
-		configuration = body["result"].(map[string]interface{})
+	claimCheck, err = common_claimcheck.NewClaimCheck(configuration)
+	if err != nil {
+		return err
+	}
 
-		c, err := kafka.NewConsumer(&kafka.ConfigMap{
-			"bootstrap.servers": configuration["kafka_host"],
-			"group.id":          "message_dispatcher",
-			"auto.offset.reset": "earliest",
-		})
-		if err != nil {
-			panic(err)
-		}
-		consumerClient = c
+	dispatchThrottle, err = throttle.NewThrottle(configuration)
+	if err != nil {
+		return err
+	}
 
-		p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": configuration["kafka_host"]})
-		if err != nil {
-			panic(err)
-		}
-		producerClient = p
+	settings, err := workers.NewSettings(configuration)
+	if err != nil {
+		return err
+	}
 
-		return nil
-	} else {
-		return errors.New("unsuccessful request")
+	laneSettings, err = lanes.NewSettings(configuration)
+	if err != nil {
+		return err
 	}
-}
 
-func getRequest(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+	// Offsets are stored by the tracker once processed, not when they are read,
+	// and auto commit is forced on since nothing else commits them
+	c, err := common_kafka.NewConsumer(configuration, "message_dispatcher", kafka.ConfigMap{"enable.auto.offset.store": false, "enable.auto.commit": true})
 	if err != nil {
-		return map[string]interface{}{}, err
+		return err
 	}
+	consumerClient = c
+	offsetTracker = workers.NewOffsetTracker(consumerClient)
+	workerPool = workers.NewPool(settings, offsetTracker)
 
-	body, err := ioutil.ReadAll(resp.Body)
+	p, err := common_kafka.NewProducer(configuration)
 	if err != nil {
-		return map[string]interface{}{}, err
+		c.Close()
+		return err
 	}
+	producerClient = p
+	go common_kafka.LogDeliveryReports(producerClient)
 
-	return toJson(string(body)), err
-}
+	if key, ok := configuration["partition_key"].(string); ok && key != "" {
+		partitionKey = key
+	}
 
-func toJson(jsonString string) map[string]interface{} {
-	var result map[string]interface{}
-	json.Unmarshal([]byte(jsonString), &result)
-	return result
+	common_kafka.WaitForBrokers(consumerClient)
+	return nil
 }
@@ -0,0 +1,228 @@
+package throttle
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	CHANNEL_SCOPE = "channel"
+	SENDER_SCOPE  = "sender"
+)
+
+// Metadata naming the provider channel of a message, the topic is used when missing
+const CHANNEL_METADATA = "channel"
+
+// Limit caps the dispatch rate of a channel or sender to Rate messages per
+// second with bursts of up to Burst. Match restricts it to a single value
+type Limit struct {
+	Scope string  `json:"scope"`
+	Match string  `json:"match,omitempty"`
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// Consumer is the part of *kafka.Consumer the throttle drives
+type Consumer interface {
+	Pause(partitions []kafka.TopicPartition) error
+	Resume(partitions []kafka.TopicPartition) error
+	Seek(partition kafka.TopicPartition, timeoutMs int) error
+}
+
+type bucket struct {
+	tokens    float64
+	updatedOn time.Time
+	throttled int64
+}
+
+// PausedPartition is a partition waiting for the bucket Key to refill, it
+// is resumed from Offset so the throttled message is read again
+type PausedPartition struct {
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Key       string    `json:"key"`
+	ResumeOn  time.Time `json:"resume_on"`
+}
+
+// Throttle holds back messages exceeding the dispatch limits by pausing
+// their partition instead of dropping them
+type Throttle struct {
+	Limits []Limit
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	paused  map[string]PausedPartition
+}
+
+// NewThrottle reads the dispatch_limits section of the configuration
+func NewThrottle(configuration map[string]interface{}) (*Throttle, error) {
+	limits := []Limit{}
+	if err := mapstructure.Decode(configuration["dispatch_limits"], &limits); err != nil {
+		return nil, fmt.Errorf("invalid dispatch_limits: %v", err)
+	}
+
+	for _, limit := range limits {
+		if limit.Scope != CHANNEL_SCOPE && limit.Scope != SENDER_SCOPE {
+			return nil, fmt.Errorf("invalid dispatch limit scope %s", limit.Scope)
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return nil, fmt.Errorf("dispatch limit on %s needs a positive rate and a burst of at least 1", limit.Scope)
+		}
+	}
+
+	return &Throttle{Limits: limits, buckets: map[string]*bucket{}, paused: map[string]PausedPartition{}}, nil
+}
+
+func partitionName(topic string, partition int32) string {
+	return topic + "/" + strconv.Itoa(int(partition))
+}
+
+func scopeValue(scope string, topic string, message common_models.Message) string {
+	if scope == SENDER_SCOPE {
+		return message.Sender
+	}
+	if channel := message.Metadata[CHANNEL_METADATA]; channel != "" {
+		return channel
+	}
+
+	return topic
+}
+
+// Take consumes a token of every limit applying to the message, or returns
+// the bucket that is exhausted and how long until it refills
+func (t *Throttle) Take(topic string, message common_models.Message) (string, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	keys := []string{}
+	for _, limit := range t.Limits {
+		value := scopeValue(limit.Scope, topic, message)
+		if limit.Match != "" && limit.Match != value {
+			continue
+		}
+
+		// Every limit has its own bucket, a global and a matching limit on one value never share tokens
+		key := fmt.Sprintf("%s:%s:%g:%g:%s", limit.Scope, limit.Match, limit.Rate, limit.Burst, value)
+		current, ok := t.buckets[key]
+		if !ok {
+			current = &bucket{tokens: limit.Burst, updatedOn: now}
+			t.buckets[key] = current
+		}
+
+		current.tokens = math.Min(limit.Burst, current.tokens+now.Sub(current.updatedOn).Seconds()*limit.Rate)
+		current.updatedOn = now
+		if current.tokens < 1 {
+			// Tokens already taken for this message go back to their buckets
+			for _, previous := range keys {
+				t.buckets[previous].tokens++
+			}
+			current.throttled++
+			return key, time.Duration((1 - current.tokens) / limit.Rate * float64(time.Second))
+		}
+
+		current.tokens--
+		keys = append(keys, key)
+	}
+
+	return "", 0
+}
+
+// Pause stops fetching the partition of msg and rewinds it so msg is read
+// again once the partition is resumed
+func (t *Throttle) Pause(consumer Consumer, msg *kafka.Message, key string, wait time.Duration) error {
+	partition := kafka.TopicPartition{Topic: msg.TopicPartition.Topic, Partition: msg.TopicPartition.Partition, Offset: msg.TopicPartition.Offset}
+
+	if err := consumer.Pause([]kafka.TopicPartition{partition}); err != nil {
+		return err
+	}
+	if err := consumer.Seek(partition, 1000); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.paused[partitionName(*partition.Topic, partition.Partition)] = PausedPartition{
+		Topic:     *partition.Topic,
+		Partition: partition.Partition,
+		Offset:    int64(partition.Offset),
+		Key:       key,
+		ResumeOn:  time.Now().Add(wait),
+	}
+
+	return nil
+}
+
+// Held tells if msg belongs to a paused partition. Messages fetched before
+// the pause are skipped, the rewind delivers them again
+func (t *Throttle) Held(msg *kafka.Message) bool {
+	return t.Holds(*msg.TopicPartition.Topic, msg.TopicPartition.Partition)
+}
+
+func (t *Throttle) Holds(topic string, partition int32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, ok := t.paused[partitionName(topic, partition)]
+	return ok
+}
+
+// ResumeDue resumes the partitions whose bucket had time to refill.
+// Partitions still held by someone else are left paused for them
+func (t *Throttle) ResumeDue(consumer Consumer, held func(topic string, partition int32) bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for name, paused := range t.paused {
+		if now.Before(paused.ResumeOn) {
+			continue
+		}
+
+		topic := paused.Topic
+		if !held(topic, paused.Partition) {
+			if err := consumer.Resume([]kafka.TopicPartition{{Topic: &topic, Partition: paused.Partition}}); err != nil {
+				fmt.Printf("Couldn't resume %s: %v\n", name, err)
+			}
+		}
+		delete(t.paused, name)
+	}
+}
+
+// Reset forgets the paused partitions, called once they are revoked
+func (t *Throttle) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.paused = map[string]PausedPartition{}
+}
+
+// State lists the limits, the tokens left in each bucket and the paused partitions
+func (t *Throttle) State() map[string]interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	buckets := map[string]interface{}{}
+	for key, current := range t.buckets {
+		buckets[key] = map[string]interface{}{"tokens": current.tokens, "throttled": current.throttled, "updated_on": current.updatedOn}
+	}
+
+	paused := []PausedPartition{}
+	for _, partition := range t.paused {
+		paused = append(paused, partition)
+	}
+	sort.Slice(paused, func(i, j int) bool {
+		return partitionName(paused[i].Topic, paused[i].Partition) < partitionName(paused[j].Topic, paused[j].Partition)
+	})
+
+	return map[string]interface{}{"limits": t.Limits, "buckets": buckets, "paused": paused}
+}
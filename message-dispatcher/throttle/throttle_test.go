@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+// Records the partitions paused, resumed and rewound
+type recordingConsumer struct {
+	paused  []string
+	resumed []string
+	seeks   []kafka.Offset
+}
+
+func (c *recordingConsumer) Pause(partitions []kafka.TopicPartition) error {
+	for _, partition := range partitions {
+		c.paused = append(c.paused, partitionName(*partition.Topic, partition.Partition))
+	}
+	return nil
+}
+
+func (c *recordingConsumer) Resume(partitions []kafka.TopicPartition) error {
+	for _, partition := range partitions {
+		c.resumed = append(c.resumed, partitionName(*partition.Topic, partition.Partition))
+	}
+	return nil
+}
+
+func (c *recordingConsumer) Seek(partition kafka.TopicPartition, timeoutMs int) error {
+	c.seeks = append(c.seeks, partition.Offset)
+	return nil
+}
+
+func testThrottle(t *testing.T, limits ...interface{}) *Throttle {
+	throttle, err := NewThrottle(map[string]interface{}{"dispatch_limits": limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return throttle
+}
+
+func TestTakeRefillsBuckets(t *testing.T) {
+	throttle := testThrottle(t, map[string]interface{}{"scope": "channel", "rate": 50, "burst": 2})
+	message := common_models.Message{Sender: "bank"}
+
+	for i := 0; i < 2; i++ {
+		if key, wait := throttle.Take("messaging_trx", message); wait != 0 {
+			t.Fatalf("burst message %d throttled by %s", i, key)
+		}
+	}
+
+	key, wait := throttle.Take("messaging_trx", message)
+	if key == "" || wait <= 0 || wait > 20*time.Millisecond {
+		t.Fatalf("exhausted bucket returned %q and %v", key, wait)
+	}
+
+	time.Sleep(wait + 5*time.Millisecond)
+	if key, wait := throttle.Take("messaging_trx", message); wait != 0 {
+		t.Errorf("refilled bucket %s still waits %v", key, wait)
+	}
+}
+
+func TestTakeScopesAndRefunds(t *testing.T) {
+	throttle := testThrottle(t,
+		map[string]interface{}{"scope": "channel", "rate": 0.001, "burst": 2},
+		map[string]interface{}{"scope": "sender", "match": "bank", "rate": 0.001, "burst": 1},
+	)
+
+	cases := []struct {
+		name      string
+		topic     string
+		message   common_models.Message
+		throttled bool
+	}{
+		{name: "first of bank", topic: "messaging_trx", message: common_models.Message{Sender: "bank"}},
+		{name: "bank exhausted", topic: "messaging_trx", message: common_models.Message{Sender: "bank"}, throttled: true},
+		{name: "channel token refunded", topic: "messaging_trx", message: common_models.Message{Sender: "shop"}},
+		{name: "channel exhausted", topic: "messaging_trx", message: common_models.Message{Sender: "shop"}, throttled: true},
+		{name: "other topic", topic: "messaging_cmp", message: common_models.Message{Sender: "shop"}},
+		{name: "channel metadata", topic: "messaging_trx", message: common_models.Message{Sender: "shop", Metadata: map[string]string{CHANNEL_METADATA: "sms-b"}}},
+	}
+
+	for _, c := range cases {
+		_, wait := throttle.Take(c.topic, c.message)
+		if (wait > 0) != c.throttled {
+			t.Errorf("%s: waits %v, throttled should be %v", c.name, wait, c.throttled)
+		}
+	}
+}
+
+func TestNewThrottleValidates(t *testing.T) {
+	invalid := []interface{}{
+		map[string]interface{}{"scope": "recipient", "rate": 1, "burst": 1},
+		map[string]interface{}{"scope": "channel", "rate": 0, "burst": 1},
+		map[string]interface{}{"scope": "sender", "rate": 1, "burst": 0},
+	}
+
+	for _, limit := range invalid {
+		if _, err := NewThrottle(map[string]interface{}{"dispatch_limits": []interface{}{limit}}); err == nil {
+			t.Errorf("%v was accepted", limit)
+		}
+	}
+}
+
+func TestPauseAndResumeDue(t *testing.T) {
+	throttle := testThrottle(t)
+	consumer := &recordingConsumer{}
+	topic := "messaging_trx"
+	due := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 42}}
+	later := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 7}}
+	shared := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 3}}
+
+	throttle.Pause(consumer, due, "key", 0)
+	throttle.Pause(consumer, later, "key", time.Hour)
+	throttle.Pause(consumer, shared, "key", 0)
+	if len(consumer.paused) != 3 || consumer.seeks[0] != 42 {
+		t.Fatalf("paused %v and rewound to %v", consumer.paused, consumer.seeks)
+	}
+	if !throttle.Held(due) || !throttle.Holds(topic, 1) {
+		t.Fatal("paused partitions aren't held")
+	}
+
+	// Partition 2 is still held by the lanes, it's released without resuming
+	heldElsewhere := func(topic string, partition int32) bool { return partition == 2 }
+	throttle.ResumeDue(consumer, heldElsewhere)
+
+	if len(consumer.resumed) != 1 || consumer.resumed[0] != partitionName(topic, 0) {
+		t.Errorf("resumed %v, want only the due partition", consumer.resumed)
+	}
+	if throttle.Held(due) || throttle.Held(shared) || !throttle.Held(later) {
+		t.Errorf("held after resume: due %v, shared %v, later %v", throttle.Held(due), throttle.Held(shared), throttle.Held(later))
+	}
+
+	throttle.Reset()
+	if throttle.Held(later) {
+		t.Error("reset kept a paused partition")
+	}
+}
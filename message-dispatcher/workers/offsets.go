@@ -0,0 +1,102 @@
+package workers
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Committer is the part of *kafka.Consumer the tracker stores offsets with
+type Committer interface {
+	StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+}
+
+type partitionOffsets struct {
+	topic     string
+	partition int32
+	pending   []kafka.Offset
+	completed map[kafka.Offset]bool
+}
+
+// OffsetTracker stores the offset of a partition only once every message
+// before it completed. Messages of a partition may finish out of order when
+// the pool is ordered by key, a restart then reprocesses from the oldest
+// unfinished message instead of skipping it
+type OffsetTracker struct {
+	Consumer Committer
+
+	lock       sync.Mutex
+	partitions map[string]*partitionOffsets
+}
+
+func NewOffsetTracker(consumer Committer) *OffsetTracker {
+	return &OffsetTracker{Consumer: consumer, partitions: map[string]*partitionOffsets{}}
+}
+
+func partitionName(partition kafka.TopicPartition) string {
+	return *partition.Topic + "/" + strconv.Itoa(int(partition.Partition))
+}
+
+// Track registers msg as in flight, messages must be tracked in the order they are read
+func (tracker *OffsetTracker) Track(msg *kafka.Message) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	name := partitionName(msg.TopicPartition)
+	offsets, ok := tracker.partitions[name]
+	if !ok {
+		offsets = &partitionOffsets{topic: *msg.TopicPartition.Topic, partition: msg.TopicPartition.Partition, completed: map[kafka.Offset]bool{}}
+		tracker.partitions[name] = offsets
+	}
+
+	offsets.pending = append(offsets.pending, msg.TopicPartition.Offset)
+}
+
+// Done marks msg as processed and stores the offset following the longest
+// run of completed messages
+func (tracker *OffsetTracker) Done(msg *kafka.Message) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	offsets, ok := tracker.partitions[partitionName(msg.TopicPartition)]
+	if !ok {
+		return
+	}
+	offsets.completed[msg.TopicPartition.Offset] = true
+
+	advanced := false
+	next := kafka.Offset(0)
+	for len(offsets.pending) > 0 && offsets.completed[offsets.pending[0]] {
+		delete(offsets.completed, offsets.pending[0])
+		next = offsets.pending[0] + 1
+		offsets.pending = offsets.pending[1:]
+		advanced = true
+	}
+
+	if advanced {
+		topic := offsets.topic
+		tracker.Consumer.StoreOffsets([]kafka.TopicPartition{{Topic: &topic, Partition: offsets.partition, Offset: next}})
+	}
+}
+
+// Reset forgets every partition, called once they are revoked
+func (tracker *OffsetTracker) Reset() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.partitions = map[string]*partitionOffsets{}
+}
+
+// Pending returns the number of unfinished messages per partition
+func (tracker *OffsetTracker) Pending() map[string]int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	pending := map[string]int{}
+	for name, offsets := range tracker.partitions {
+		pending[name] = len(offsets.pending)
+	}
+
+	return pending
+}
@@ -0,0 +1,82 @@
+package workers
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Records the offsets stored per partition
+type recordingCommitter struct {
+	stored map[int32][]kafka.Offset
+}
+
+func (committer *recordingCommitter) StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	for _, offset := range offsets {
+		committer.stored[offset.Partition] = append(committer.stored[offset.Partition], offset.Offset)
+	}
+
+	return offsets, nil
+}
+
+func testMessage(partition int32, offset kafka.Offset) *kafka.Message {
+	topic := "messaging_trx"
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+func TestOffsetTrackerStoresLowestContiguousOffset(t *testing.T) {
+	committer := &recordingCommitter{stored: map[int32][]kafka.Offset{}}
+	tracker := NewOffsetTracker(committer)
+
+	messages := []*kafka.Message{testMessage(0, 10), testMessage(0, 11), testMessage(0, 12), testMessage(0, 13)}
+	for _, msg := range messages {
+		tracker.Track(msg)
+	}
+
+	// Completed out of order, nothing is stored until offset 10 is done
+	tracker.Done(messages[2])
+	tracker.Done(messages[1])
+	if stored := committer.stored[0]; len(stored) != 0 {
+		t.Fatalf("stored %v before the oldest message completed", stored)
+	}
+
+	tracker.Done(messages[0])
+	tracker.Done(messages[3])
+
+	expected := []kafka.Offset{13, 14}
+	stored := committer.stored[0]
+	if len(stored) != len(expected) {
+		t.Fatalf("stored %v, want %v", stored, expected)
+	}
+	for i := range expected {
+		if stored[i] != expected[i] {
+			t.Fatalf("stored %v, want %v", stored, expected)
+		}
+	}
+	if pending := tracker.Pending()["messaging_trx/0"]; pending != 0 {
+		t.Errorf("%d messages still pending", pending)
+	}
+}
+
+func TestOffsetTrackerKeepsPartitionsApart(t *testing.T) {
+	committer := &recordingCommitter{stored: map[int32][]kafka.Offset{}}
+	tracker := NewOffsetTracker(committer)
+
+	first, second := testMessage(0, 5), testMessage(1, 7)
+	tracker.Track(first)
+	tracker.Track(second)
+
+	tracker.Done(second)
+	if stored := committer.stored[1]; len(stored) != 1 || stored[0] != 8 {
+		t.Errorf("partition 1 stored %v, want [8]", stored)
+	}
+	if stored := committer.stored[0]; len(stored) != 0 {
+		t.Errorf("partition 0 stored %v before its message completed", stored)
+	}
+
+	tracker.Reset()
+	tracker.Done(first)
+	if stored := committer.stored[0]; len(stored) != 0 {
+		t.Errorf("stored %v for a revoked partition", stored)
+	}
+}
@@ -0,0 +1,112 @@
+package workers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	PARTITION_ORDER = "partition"
+	KEY_ORDER       = "key"
+)
+
+type Settings struct {
+	Workers   int
+	QueueSize int    `mapstructure:"queue_size"`
+	OrderBy   string `mapstructure:"order_by"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{Workers: 4, QueueSize: 1, OrderBy: PARTITION_ORDER}
+}
+
+// NewSettings reads the dispatcher_workers section of the configuration
+func NewSettings(configuration map[string]interface{}) (Settings, error) {
+	settings := DefaultSettings()
+	if err := mapstructure.Decode(configuration["dispatcher_workers"], &settings); err != nil {
+		return settings, fmt.Errorf("invalid dispatcher_workers: %v", err)
+	}
+
+	if settings.Workers < 1 || settings.QueueSize < 1 {
+		return settings, fmt.Errorf("dispatcher_workers needs at least one worker and a queue_size of at least 1")
+	}
+	if settings.OrderBy != PARTITION_ORDER && settings.OrderBy != KEY_ORDER {
+		return settings, fmt.Errorf("invalid dispatcher_workers order_by %s", settings.OrderBy)
+	}
+
+	return settings, nil
+}
+
+type job struct {
+	msg     *kafka.Message
+	process func()
+}
+
+// Pool processes messages on Workers goroutines. Every partition (or key when
+// ordered by key) always lands on the same worker, so its messages are
+// processed in the order they were read. Each worker queue holds QueueSize
+// messages, Submit blocks when it is full. Queues are kept short so waiting
+// messages stay in the lane scheduler where urgent lanes overtake them
+type Pool struct {
+	Settings Settings
+	Offsets  *OffsetTracker
+
+	queues  []chan job
+	pending sync.WaitGroup
+}
+
+func NewPool(settings Settings, offsets *OffsetTracker) *Pool {
+	pool := &Pool{Settings: settings, Offsets: offsets, queues: make([]chan job, settings.Workers)}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan job, settings.QueueSize)
+		go pool.work(pool.queues[i])
+	}
+
+	return pool
+}
+
+func (pool *Pool) work(queue chan job) {
+	for next := range queue {
+		next.process()
+		pool.Offsets.Done(next.msg)
+		pool.pending.Done()
+	}
+}
+
+func (pool *Pool) lane(msg *kafka.Message) int {
+	hash := fnv.New32a()
+	if pool.Settings.OrderBy == KEY_ORDER && len(msg.Key) > 0 {
+		hash.Write(msg.Key)
+	} else {
+		hash.Write([]byte(*msg.TopicPartition.Topic + "/" + strconv.Itoa(int(msg.TopicPartition.Partition))))
+	}
+
+	return int(hash.Sum32() % uint32(len(pool.queues)))
+}
+
+// Submit queues process for msg, tracking its offset until it completes
+func (pool *Pool) Submit(msg *kafka.Message, process func()) {
+	pool.Offsets.Track(msg)
+	pool.pending.Add(1)
+	pool.queues[pool.lane(msg)] <- job{msg: msg, process: process}
+}
+
+// Wait blocks until every submitted message was processed
+func (pool *Pool) Wait() {
+	pool.pending.Wait()
+}
+
+// InFlight returns the number of messages queued or being processed per worker
+func (pool *Pool) InFlight() []int {
+	lengths := make([]int, len(pool.queues))
+	for i, queue := range pool.queues {
+		lengths[i] = len(queue)
+	}
+
+	return lengths
+}
@@ -0,0 +1,70 @@
+package workers
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Submits interleaved messages of several partitions or keys with random
+// processing times and checks each one is processed in the order it was read
+func TestPoolKeepsOrder(t *testing.T) {
+	for _, orderBy := range []string{PARTITION_ORDER, KEY_ORDER} {
+		committer := &recordingCommitter{stored: map[int32][]kafka.Offset{}}
+		pool := NewPool(Settings{Workers: 3, QueueSize: 2, OrderBy: orderBy}, NewOffsetTracker(committer))
+
+		lock := sync.Mutex{}
+		processed := map[string][]int{}
+		for i := 0; i < 200; i++ {
+			msg := testMessage(int32(i%4), kafka.Offset(i/4))
+			group := fmt.Sprint(msg.TopicPartition.Partition)
+			if orderBy == KEY_ORDER {
+				// Keys spread over partitions, only the order of a key matters
+				msg = testMessage(0, kafka.Offset(i))
+				group = fmt.Sprintf("key-%d", i%5)
+				msg.Key = []byte(group)
+			}
+
+			sequence := i
+			pool.Submit(msg, func() {
+				time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+				lock.Lock()
+				processed[group] = append(processed[group], sequence)
+				lock.Unlock()
+			})
+		}
+		pool.Wait()
+
+		total := 0
+		for group, sequences := range processed {
+			total += len(sequences)
+			for i := 1; i < len(sequences); i++ {
+				if sequences[i] < sequences[i-1] {
+					t.Fatalf("%s: %s processed out of order: %v", orderBy, group, sequences)
+				}
+			}
+		}
+		if total != 200 {
+			t.Errorf("%s: processed %d messages, want 200", orderBy, total)
+		}
+	}
+}
+
+func TestPoolStoresOffsetsOnceProcessed(t *testing.T) {
+	committer := &recordingCommitter{stored: map[int32][]kafka.Offset{}}
+	pool := NewPool(Settings{Workers: 2, QueueSize: 1, OrderBy: PARTITION_ORDER}, NewOffsetTracker(committer))
+
+	for offset := kafka.Offset(0); offset < 10; offset++ {
+		pool.Submit(testMessage(0, offset), func() {})
+	}
+	pool.Wait()
+
+	stored := committer.stored[0]
+	if len(stored) == 0 || stored[len(stored)-1] != 10 {
+		t.Errorf("stored %v, want the last offset to be 10", stored)
+	}
+}
@@ -3,90 +3,205 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_claimcheck "github.com/hectorandac/kafka-message-processor/common-claimcheck"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
 	common_models "github.com/hectorandac/kafka-message-processor/common-models"
-	"github.com/hectorandac/kafka-message-processor/message-logger/utils"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	common_provisioner "github.com/hectorandac/kafka-message-processor/common-provisioner"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	common_serde "github.com/hectorandac/kafka-message-processor/common-serde"
+	"github.com/mitchellh/mapstructure"
 	"gopkg.in/mgo.v2"
 )
 
 var configuration map[string]interface{}
+var codec *common_serde.Codec
+var claimCheck *common_claimcheck.ClaimCheck
+var provisionerClient *common_provisioner.Client = common_provisioner.NewClient(SERVICE_NAME)
 
 const DATABASE = "logger"
-const PROVISIONING_URL = "http://localhost:3010/config/kafka_service_config"
+const SERVICE_NAME = "message-logger"
 
 func main() {
-	consumerClient, _ := setupEnvironment()
-	defer consumerClient.Close()
-	consumerClient.SubscribeTopics([]string{"messaging_otp", "messaging_trx", "messaging_cmp"}, nil)
+	common_health.Register(common_provisioner.COMPONENT)
+	common_health.Register(common_kafka.COMPONENT)
+	common_health.RegisterCheck(common_provisioner.COMPONENT, false, provisionerClient.Check)
+	common_health.Serve(common_config.Get(common_config.LISTEN_ADDRESS, ":3040"))
+
+	common_health.Register(common_mongo.COMPONENT)
+
+	// Retried until it succeeds, a configuration error is fixed in the provisioner without restarting
+	var consumerClient *kafka.Consumer
+	var gelfURL string
+	var dbConnection *mgo.Database
+	var dbSession *mgo.Session
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		url, err := common_config.Endpoint(common_config.GELF_URL)
+		if err != nil {
+			fmt.Printf("Couldn't setup the environment (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+			return err
+		}
+		gelfURL = url
+
+		consumerClient, err = setupEnvironment()
+		if err != nil {
+			fmt.Printf("Couldn't setup the environment (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+			return err
+		}
+
+		dbConnection, dbSession, err = connectDatabase()
+		if err != nil {
+			fmt.Printf("Couldn't connect to the database (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_mongo.COMPONENT, err.Error())
+			consumerClient.Close()
+			return err
+		}
 
-	dbConnection, dbSession := utils.MongoDB(configuration["database_address"].(string), DATABASE)
+		common_health.SetReady(common_mongo.COMPONENT)
+		return nil
+	})
+	common_health.RegisterCheck(common_kafka.COMPONENT, true, common_kafka.Check(consumerClient))
+	common_health.RegisterCheck(common_mongo.COMPONENT, true, common_mongo.Check(dbSession))
+	defer consumerClient.Close()
 	defer dbSession.Close()
+	topics := subscriptionTopics(configuration)
+	consumerClient.SubscribeTopics(topics, nil)
+	fmt.Printf("Registered to: %v\n", topics)
 
 	for {
 		msg, err := consumerClient.ReadMessage(-1)
 		if err == nil {
 			fmt.Printf("✅ Message on: %s, Date Time: %s\n", *msg.TopicPartition.Topic, time.Now())
-			go http.Post("http://0.0.0.0:5555/gelf", "application/json", bytes.NewBuffer(msg.Value))
-			go persistInDB(dbConnection, msg.Value)
+			result, err := codec.Deserialize(msg.Value)
+			if err == nil {
+				result, err = claimCheck.Resolve(result)
+			}
+			if err != nil {
+				fmt.Printf("Couldn't decode message on %s: %v\n", *msg.TopicPartition.Topic, err)
+				continue
+			}
+
+			// GELF expects JSON whatever the format the message was produced in
+			body, _ := json.Marshal(result)
+			go http.Post(gelfURL, "application/json", bytes.NewBuffer(body))
+			go persistInDB(dbConnection, result)
 		} else {
 			fmt.Printf("Consumer error: %v (%v)\n", err, msg)
 		}
 	}
 }
 
-func persistInDB(dbConnection *mgo.Database, message []byte) {
-	var result common_models.Message
-	json.Unmarshal(message, &result)
-	go dbConnection.C("messages").Insert(result)
+func persistInDB(dbConnection *mgo.Database, message common_models.Message) {
+	dbConnection.C("messages").Insert(message)
 }
 
-func setupEnvironment() (*kafka.Consumer, error) {
-	body, err := getRequest(PROVISIONING_URL)
+// Every topic the producer writes to: the queues and the routing targets,
+// each with its priority lanes when the queue has them
+func subscriptionTopics(configuration map[string]interface{}) []string {
+	queues := []struct {
+		Name          string
+		PriorityLanes bool `mapstructure:"priority_lanes"`
+	}{}
+	mapstructure.WeakDecode(configuration["queues"], &queues)
+
+	type route struct {
+		Targets []string
+		Splits  []struct{ Targets []string }
+	}
+	routes := []route{}
+	mapstructure.Decode(configuration["routing"], &routes)
+	rules := []route{}
+	mapstructure.Decode(configuration["routing_rules"], &rules)
+	defaultRoute := []string{}
+	mapstructure.Decode(configuration["default_route"], &defaultRoute)
+
+	reportingQueue, _ := configuration["reporting_queue"].(string)
+	lanes := map[string]bool{}
+	targets := []string{}
+	for _, queue := range queues {
+		if queue.Name != reportingQueue {
+			lanes[queue.Name] = queue.PriorityLanes
+			targets = append(targets, queue.Name)
+		}
+	}
+	for _, route := range append(routes, rules...) {
+		targets = append(targets, route.Targets...)
+		for _, split := range route.Splits {
+			targets = append(targets, split.Targets...)
+		}
+	}
+	targets = append(targets, defaultRoute...)
+
+	topics := []string{}
+	subscribed := map[string]bool{}
+	for _, target := range targets {
+		laneTopics := []string{target}
+		if lanes[target] {
+			laneTopics = common_models.LaneTopics(target)
+		}
 
-	if err != nil {
-		return &kafka.Consumer{}, errors.New("couldn't retrieve information form provisioning service")
+		for _, topic := range laneTopics {
+			if !subscribed[topic] {
+				subscribed[topic] = true
+				topics = append(topics, topic)
+			}
+		}
 	}
 
-	if body["status"] == "successful" {
+	if len(topics) == 0 {
+		return []string{"messaging_otp", "messaging_trx", "messaging_cmp"}
+	}
 
-		configuration = body["result"].(map[string]interface{})
+	return topics
+}
 
-		c, err := kafka.NewConsumer(&kafka.ConfigMap{
-			"bootstrap.servers": configuration["kafka_host"],
-			"group.id":          "message_reader",
-			"auto.offset.reset": "earliest",
-		})
-		if err != nil {
-			panic(err)
-		}
-		return c, nil
-	} else {
-		return &kafka.Consumer{}, errors.New("unsuccessful request")
+func setupEnvironment() (*kafka.Consumer, error) {
+	configuration, _ = provisionerClient.WaitForConfiguration(common_provisioner.KAFKA_SERVICE_CONFIG)
+
+	var err error
+	codec, err = common_serde.NewCodec(configuration)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func getRequest(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+	claimCheck, err = common_claimcheck.NewClaimCheck(configuration)
 	if err != nil {
-		return map[string]interface{}{}, err
+		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	c, err := common_kafka.NewConsumer(configuration, "message_reader")
 	if err != nil {
-		return map[string]interface{}{}, err
+		return nil, err
 	}
 
-	return toJson(string(body)), err
+	common_kafka.WaitForBrokers(c)
+	return c, nil
 }
 
-func toJson(jsonString string) map[string]interface{} {
-	var result map[string]interface{}
-	json.Unmarshal([]byte(jsonString), &result)
-	return result
+// The provisioner's database_address takes precedence over MONGODB_URL for the logger
+func connectDatabase() (*mgo.Database, *mgo.Session, error) {
+	mInfo, err := common_mongo.DialInfo(DATABASE)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if address, ok := configuration["database_address"].(string); ok && address != "" {
+		mInfo.Addrs = []string{address}
+	}
+
+	session, err := common_mongo.Dial(mInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session.DB(mInfo.Database), session, nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const CAMPAIGN_DELIVERY_COLLECTION = "campaign_delivery"
+
+// Deliveries are only claimed twice by a fan out resuming its last batch,
+// they are purged long after any campaign could resume
+const CAMPAIGN_DELIVERY_RETENTION = 7 * 24 * time.Hour
+
+var reportingQueue string
+
+type campaignDelivery struct {
+	Id        string    `bson:"_id"`
+	MessageId string    `bson:"message_id"`
+	CreatedOn int64     `bson:"created_on"`
+	PurgeOn   time.Time `bson:"purge_on"`
+}
+
+func campaignDeliveryKey(message common_models.Message) string {
+	return message.CampaignId + ":" + message.Recipient
+}
+
+// Marks the recipient of a campaign message as sent, false when it already
+// was. A fan out resuming after a crash resends its last batch and this keeps
+// those recipients from getting the message twice
+func claimCampaignDelivery(db *mgo.Database, message common_models.Message) (bool, error) {
+	if message.CampaignId == "" {
+		return true, nil
+	}
+
+	db.C(CAMPAIGN_DELIVERY_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"purge_on"}, ExpireAfter: time.Second})
+
+	now := time.Now()
+	delivery := campaignDelivery{Id: campaignDeliveryKey(message), MessageId: message.Id.Hex(), CreatedOn: now.UnixNano(), PurgeOn: now.Add(CAMPAIGN_DELIVERY_RETENTION)}
+	err := db.C(CAMPAIGN_DELIVERY_COLLECTION).Insert(delivery)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Gives the recipient back to the campaign when its message couldn't be sent
+func releaseCampaignDelivery(db *mgo.Database, message common_models.Message) {
+	if message.CampaignId == "" {
+		return
+	}
+
+	db.C(CAMPAIGN_DELIVERY_COLLECTION).Remove(bson.M{"_id": campaignDeliveryKey(message), "message_id": message.Id.Hex()})
+}
+
+// Core aggregates campaign counters from the reporting queue, the producer
+// reports there the campaign messages it queued or suppressed. Reports carry
+// no body
+func reportCampaignMessage(message common_models.Message, status string) {
+	if message.CampaignId == "" || reportingQueue == "" {
+		return
+	}
+
+	message.Status = status
+	message.Message, message.BodyEncoding, message.BodyReference = "", "", ""
+	message.Variables = nil
+
+	topic := reportingQueue
+	value, err := codec.Serialize(topic, message)
+	if err == nil {
+		err = producerClient.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            message.PartitionKey(partitionKey),
+			Value:          value,
+			Headers:        common_kafka.HeadersFor(message, 1, ""),
+		}, nil)
+	}
+	if err != nil {
+		fmt.Printf("Couldn't report campaign message %s: %v\n", message.Id.Hex(), err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	"github.com/hectorandac/kafka-message-processor/message-producer/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const DEFERRED_COLLECTION = "deferred"
+const DEFERRED_POLL_INTERVAL = 15 * time.Second
+const DEFERRED_LEASE = time.Minute
+const DEFERRED_BATCH_SIZE = 500
+const DEFERRED_COMPONENT = "deferred"
+
+var deliverySchedule *models.DeliverySchedule = &models.DeliverySchedule{}
+
+// Stored in the deferred collection until its window opens
+type deferredMessage struct {
+	Id          bson.ObjectId         `bson:"_id"`
+	Message     common_models.Message `bson:"message"`
+	TraceParent string                `bson:"trace_parent"`
+	DeliverOn   time.Time             `bson:"deliver_on"`
+	Delivered   []string              `bson:"delivered,omitempty"`
+}
+
+// Holds message until its delivery window opens
+func deferMessage(db *mgo.Database, message common_models.Message, traceParent string, deliverOn time.Time) error {
+	db.C(DEFERRED_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"deliver_on"}})
+
+	return db.C(DEFERRED_COLLECTION).Insert(deferredMessage{Id: message.Id, Message: message, TraceParent: traceParent, DeliverOn: deliverOn})
+}
+
+// Produces the deferred messages whose window opened unless their recipient
+// opted out in the meantime. Due messages are leased before producing so
+// several producers never send one twice and only removed once the brokers
+// acknowledged them, a producer crashing in between leaves the lease to
+// expire and the message is released again without the copies already sent
+func releaseDeferred() {
+	var db *mgo.Database
+	var session *mgo.Session
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		var err error
+		db, session, err = common_mongo.Connect(DATABASE)
+		if err != nil {
+			fmt.Printf("Couldn't connect to release deferred messages (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(DEFERRED_COMPONENT, err.Error())
+			return err
+		}
+
+		common_health.SetReady(DEFERRED_COMPONENT)
+		return nil
+	})
+	defer session.Close()
+
+	for {
+		for {
+			released, err := releaseDue(db)
+			if err != nil {
+				fmt.Printf("Couldn't read deferred messages: %v\n", err)
+				common_health.SetNotReady(DEFERRED_COMPONENT, err.Error())
+				session.Refresh()
+				break
+			}
+			common_health.SetReady(DEFERRED_COMPONENT)
+			if released < DEFERRED_BATCH_SIZE {
+				break
+			}
+		}
+
+		time.Sleep(DEFERRED_POLL_INTERVAL)
+	}
+}
+
+// Releases a batch of due messages, returns how many were due
+func releaseDue(db *mgo.Database) (int, error) {
+	now := time.Now()
+	due := []deferredMessage{}
+	if err := db.C(DEFERRED_COLLECTION).Find(bson.M{"deliver_on": bson.M{"$lte": now}}).Sort("deliver_on").Limit(DEFERRED_BATCH_SIZE).All(&due); err != nil {
+		return 0, err
+	}
+
+	deliveries := make(chan kafka.Event, DEFERRED_BATCH_SIZE)
+	pending := map[bson.ObjectId]int{}
+	failed := map[bson.ObjectId]bool{}
+	released := map[bson.ObjectId]common_models.Message{}
+	expected := 0
+	for _, deferred := range due {
+		// Leased by moving deliver_on, another producer that read it first wins
+		lease := bson.M{"$set": bson.M{"deliver_on": now.Add(DEFERRED_LEASE)}}
+		if err := db.C(DEFERRED_COLLECTION).Update(bson.M{"_id": deferred.Id, "deliver_on": deferred.DeliverOn}, lease); err != nil {
+			continue
+		}
+
+		// The recipient may have opted out while the message was held
+		action, err := suppressionAction(db, &deferred.Message)
+		if err == nil && action != ALLOW_SUPPRESSED {
+			db.C(DEFERRED_COLLECTION).RemoveId(deferred.Id)
+			continue
+		}
+
+		// Topics acknowledged by an earlier release are skipped
+		produced := 0
+		if err == nil {
+			produced, err = produceReported(deferred.Message, deferred.TraceParent, deliveries, deferred.Delivered)
+		}
+		expected += produced
+		pending[deferred.Id] += produced
+		released[deferred.Id] = deferred.Message
+		if err != nil {
+			fmt.Printf("Couldn't release deferred message %s: %v\n", deferred.Id.Hex(), err)
+			failed[deferred.Id] = true
+			continue
+		}
+		if produced == 0 {
+			db.C(DEFERRED_COLLECTION).RemoveId(deferred.Id)
+			if len(deferred.Delivered) > 0 {
+				reportCampaignMessage(deferred.Message, common_models.QUEUED)
+			}
+		}
+	}
+
+	// Every acknowledged copy is recorded, messages with a failed copy stay
+	// leased and only their missing copies are released again
+	for ; expected > 0; expected-- {
+		report, ok := (<-deliveries).(*kafka.Message)
+		if !ok {
+			continue
+		}
+
+		id, _ := report.Opaque.(bson.ObjectId)
+		pending[id]--
+		if report.TopicPartition.Error != nil {
+			fmt.Printf("Couldn't release deferred message %s: %v\n", id.Hex(), report.TopicPartition.Error)
+			failed[id] = true
+			continue
+		}
+		if pending[id] == 0 && !failed[id] {
+			db.C(DEFERRED_COLLECTION).RemoveId(id)
+			reportCampaignMessage(released[id], common_models.QUEUED)
+			continue
+		}
+
+		if err := db.C(DEFERRED_COLLECTION).UpdateId(id, bson.M{"$addToSet": bson.M{"delivered": *report.TopicPartition.Topic}}); err != nil {
+			fmt.Printf("Couldn't record the released copies of %s: %v\n", id.Hex(), err)
+		}
+	}
+
+	return len(due), nil
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Time zones of the calling codes the producer knows about, countries
+// spanning several zones map to their most populated one. Entries of the
+// time_zones configuration take precedence
+var DEFAULT_TIME_ZONES = map[string]string{
+	"1":    "America/New_York",
+	"1809": "America/Santo_Domingo",
+	"1829": "America/Santo_Domingo",
+	"1849": "America/Santo_Domingo",
+	"1787": "America/Puerto_Rico",
+	"1939": "America/Puerto_Rico",
+	"33":   "Europe/Paris",
+	"34":   "Europe/Madrid",
+	"39":   "Europe/Rome",
+	"44":   "Europe/London",
+	"49":   "Europe/Berlin",
+	"51":   "America/Lima",
+	"52":   "America/Mexico_City",
+	"54":   "America/Argentina/Buenos_Aires",
+	"55":   "America/Sao_Paulo",
+	"56":   "America/Santiago",
+	"57":   "America/Bogota",
+	"58":   "America/Caracas",
+	"91":   "Asia/Kolkata",
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Not persisted
+type DeliveryWindow struct {
+	Name    string
+	Types   []string
+	Senders []string
+	Start   string
+	End     string
+	Days    []string
+
+	start int
+	end   int
+}
+
+// Not persisted
+type DeliverySchedule struct {
+	Windows         []DeliveryWindow
+	TimeZones       map[string]string `mapstructure:"time_zones"`
+	DefaultTimeZone string            `mapstructure:"default_time_zone"`
+}
+
+// NewDeliverySchedule reads delivery_windows, time_zones and
+// default_time_zone from the configuration. Windows apply to campaigns when
+// they don't list any type
+func NewDeliverySchedule(configuration map[string]interface{}) (*DeliverySchedule, error) {
+	schedule := &DeliverySchedule{TimeZones: map[string]string{}, DefaultTimeZone: "UTC"}
+	if err := mapstructure.Decode(configuration["delivery_windows"], &schedule.Windows); err != nil {
+		return nil, fmt.Errorf("invalid delivery_windows: %v", err)
+	}
+	if err := mapstructure.Decode(configuration["time_zones"], &schedule.TimeZones); err != nil {
+		return nil, fmt.Errorf("invalid time_zones: %v", err)
+	}
+	if zone, ok := configuration["default_time_zone"].(string); ok && zone != "" {
+		schedule.DefaultTimeZone = zone
+	}
+
+	for prefix, zone := range schedule.TimeZones {
+		if _, err := time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("invalid time zone %s for %s", zone, prefix)
+		}
+	}
+	if _, err := time.LoadLocation(schedule.DefaultTimeZone); err != nil {
+		return nil, fmt.Errorf("invalid default_time_zone %s", schedule.DefaultTimeZone)
+	}
+
+	for i := range schedule.Windows {
+		window := &schedule.Windows[i]
+		if len(window.Types) == 0 {
+			window.Types = []string{common_models.Campaing}
+		}
+
+		var err error
+		if window.start, err = minuteOfDay(window.Start); err != nil {
+			return nil, fmt.Errorf("invalid start of delivery window %s: %v", window.Name, err)
+		}
+		if window.end, err = minuteOfDay(window.End); err != nil {
+			return nil, fmt.Errorf("invalid end of delivery window %s: %v", window.Name, err)
+		}
+		for _, day := range window.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return nil, fmt.Errorf("invalid day %s of delivery window %s", day, window.Name)
+			}
+		}
+	}
+
+	return schedule, nil
+}
+
+func minuteOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Location returns the time zone of the recipient, the explicit TimeZone of
+// the message wins over the one inferred from the longest calling code
+func (schedule *DeliverySchedule) Location(message common_models.Message) (*time.Location, error) {
+	if message.TimeZone != "" {
+		location, err := time.LoadLocation(message.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time_zone %s", message.TimeZone)
+		}
+		return location, nil
+	}
+
+	digits := strings.TrimSpace(message.Recipient)
+	if strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+	} else if strings.HasPrefix(digits, "00") {
+		digits = digits[2:]
+	} else {
+		digits = ""
+	}
+
+	zone := schedule.DefaultTimeZone
+	longest := 0
+	for _, zones := range []map[string]string{DEFAULT_TIME_ZONES, schedule.TimeZones} {
+		for prefix, candidate := range zones {
+			prefix = strings.TrimPrefix(prefix, "+")
+			if digits != "" && strings.HasPrefix(digits, prefix) && len(prefix) >= longest {
+				zone, longest = candidate, len(prefix)
+			}
+		}
+	}
+
+	return time.LoadLocation(zone)
+}
+
+func (window *DeliveryWindow) Matches(message common_models.Message) bool {
+	if !contains(window.Types, message.Type) {
+		return false
+	}
+
+	return len(window.Senders) == 0 || contains(window.Senders, message.Sender)
+}
+
+func (window *DeliveryWindow) allowsDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+
+	for _, name := range window.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// open tells if the window is open at local, windows ending before they start span midnight
+func (window *DeliveryWindow) open(local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	if window.start <= window.end {
+		return window.allowsDay(local.Weekday()) && minute >= window.start && minute < window.end
+	}
+
+	if minute >= window.start {
+		return window.allowsDay(local.Weekday())
+	}
+
+	return minute < window.end && window.allowsDay(local.AddDate(0, 0, -1).Weekday())
+}
+
+// opening returns the next time the window opens after local
+func (window *DeliveryWindow) opening(local time.Time) time.Time {
+	for days := 0; days <= 7; days++ {
+		day := local.AddDate(0, 0, days)
+		start := time.Date(day.Year(), day.Month(), day.Day(), window.start/60, window.start%60, 0, 0, local.Location())
+		if start.After(local) && window.allowsDay(start.Weekday()) {
+			return start
+		}
+	}
+
+	return local
+}
+
+// DeliverOn returns when message may be sent, now unless it falls outside
+// the first window matching it. Urgent messages are never deferred
+func (schedule *DeliverySchedule) DeliverOn(message common_models.Message, now time.Time) (time.Time, error) {
+	if message.Urgent() {
+		return now, nil
+	}
+
+	for i := range schedule.Windows {
+		window := &schedule.Windows[i]
+		if !window.Matches(message) {
+			continue
+		}
+
+		location, err := schedule.Location(message)
+		if err != nil {
+			return now, err
+		}
+
+		local := now.In(location)
+		if window.open(local) {
+			return now, nil
+		}
+
+		return window.opening(local), nil
+	}
+
+	return now, nil
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+func testSchedule(t *testing.T, windows ...interface{}) *DeliverySchedule {
+	schedule, err := NewDeliverySchedule(map[string]interface{}{
+		"delivery_windows":  windows,
+		"time_zones":        map[string]interface{}{"1809555": "America/Los_Angeles", "44": "Europe/Dublin"},
+		"default_time_zone": "UTC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return schedule
+}
+
+func mustTime(t *testing.T, zone string, value string) time.Time {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestLocationUsesLongestPrefix(t *testing.T) {
+	schedule := testSchedule(t)
+
+	cases := []struct {
+		recipient string
+		timeZone  string
+		zone      string
+	}{
+		{recipient: "+12125551234", zone: "America/New_York"},
+		{recipient: "+18095551234", zone: "America/Los_Angeles"},
+		{recipient: "+18095561234", zone: "America/Santo_Domingo"},
+		{recipient: "0018295551234", zone: "America/Santo_Domingo"},
+		{recipient: "+442079460958", zone: "Europe/Dublin"},
+		{recipient: "+6421555123", zone: "UTC"},
+		{recipient: "john@example.com", zone: "UTC"},
+		{recipient: "+18095551234", timeZone: "Asia/Tokyo", zone: "Asia/Tokyo"},
+	}
+
+	for _, c := range cases {
+		location, err := schedule.Location(common_models.Message{Recipient: c.recipient, TimeZone: c.timeZone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.String() != c.zone {
+			t.Errorf("%s: located in %s, want %s", c.recipient, location, c.zone)
+		}
+	}
+
+	if _, err := schedule.Location(common_models.Message{Recipient: "+18095551234", TimeZone: "Mars/Olympus"}); err == nil {
+		t.Error("unknown time_zone was accepted")
+	}
+}
+
+func TestDeliverOn(t *testing.T) {
+	schedule := testSchedule(t,
+		map[string]interface{}{"name": "night", "types": []string{"PROMO"}, "start": "22:00", "end": "06:00"},
+		map[string]interface{}{"name": "weekdays", "start": "09:00", "end": "17:00", "days": []string{"mon", "Tue", "wed", "thu", "fri"}},
+	)
+	zone := "America/Santo_Domingo"
+	campaign := common_models.Message{Type: common_models.Campaing, Recipient: "+18295551234"}
+	promo := common_models.Message{Type: "PROMO", Recipient: "+18295551234"}
+
+	cases := []struct {
+		name      string
+		message   common_models.Message
+		now       string
+		deliverOn string
+	}{
+		{name: "inside weekday window", message: campaign, now: "2026-10-14 10:00", deliverOn: "2026-10-14 10:00"},
+		{name: "before opening", message: campaign, now: "2026-10-14 07:30", deliverOn: "2026-10-14 09:00"},
+		{name: "at closing", message: campaign, now: "2026-10-14 17:00", deliverOn: "2026-10-15 09:00"},
+		{name: "friday evening waits for monday", message: campaign, now: "2026-10-16 18:00", deliverOn: "2026-10-19 09:00"},
+		{name: "sunday waits for monday", message: campaign, now: "2026-10-18 11:00", deliverOn: "2026-10-19 09:00"},
+		{name: "before midnight", message: promo, now: "2026-10-14 23:30", deliverOn: "2026-10-14 23:30"},
+		{name: "after midnight", message: promo, now: "2026-10-15 05:59", deliverOn: "2026-10-15 05:59"},
+		{name: "after the night window", message: promo, now: "2026-10-15 06:00", deliverOn: "2026-10-15 22:00"},
+		{name: "urgent never deferred", message: common_models.Message{Type: common_models.OneTimePassword, Recipient: "+18295551234"}, now: "2026-10-18 03:00", deliverOn: "2026-10-18 03:00"},
+		{name: "no matching window", message: common_models.Message{Type: common_models.Transactional, Recipient: "+18295551234"}, now: "2026-10-18 03:00", deliverOn: "2026-10-18 03:00"},
+	}
+
+	for _, c := range cases {
+		deliverOn, err := schedule.DeliverOn(c.message, mustTime(t, zone, c.now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := mustTime(t, zone, c.deliverOn); !deliverOn.Equal(expected) {
+			t.Errorf("%s: deliver on %v, want %v", c.name, deliverOn.In(expected.Location()), expected)
+		}
+	}
+}
+
+func TestNightWindowChecksTheDayItOpened(t *testing.T) {
+	// Opens friday night only, so the early hours of saturday are inside it
+	schedule := testSchedule(t, map[string]interface{}{"name": "friday night", "start": "22:00", "end": "02:00", "days": []string{"fri"}})
+	message := common_models.Message{Type: common_models.Campaing, Recipient: "+18295551234"}
+	zone := "America/Santo_Domingo"
+
+	cases := map[string]string{
+		"2026-10-16 23:00": "2026-10-16 23:00",
+		"2026-10-17 01:00": "2026-10-17 01:00",
+		"2026-10-18 01:00": "2026-10-23 22:00",
+		"2026-10-15 23:00": "2026-10-16 22:00",
+	}
+
+	for now, expected := range cases {
+		deliverOn, err := schedule.DeliverOn(message, mustTime(t, zone, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deliverOn.Equal(mustTime(t, zone, expected)) {
+			t.Errorf("%s: deliver on %v, want %s", now, deliverOn, expected)
+		}
+	}
+}
+
+func TestDeliverOnAcrossDaylightSaving(t *testing.T) {
+	schedule := testSchedule(t, map[string]interface{}{"name": "mornings", "start": "09:00", "end": "12:00"})
+	message := common_models.Message{Type: common_models.Campaing, Recipient: "+12125551234"}
+
+	// New York springs forward on 2026-03-08, the window still opens at 09:00 local
+	now := mustTime(t, "America/New_York", "2026-03-07 20:00")
+	deliverOn, err := schedule.DeliverOn(message, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := time.Date(2026, 3, 8, 13, 0, 0, 0, time.UTC)
+	if !deliverOn.Equal(expected) {
+		t.Errorf("deliver on %v, want %v", deliverOn.UTC(), expected)
+	}
+	if deliverOn.Sub(now) != 12*time.Hour {
+		t.Errorf("waits %v, the skipped hour must not be added", deliverOn.Sub(now))
+	}
+}
+
+func TestNewDeliveryScheduleValidates(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"delivery_windows": []interface{}{map[string]interface{}{"name": "bad", "start": "9am", "end": "17:00"}}},
+		{"delivery_windows": []interface{}{map[string]interface{}{"name": "bad", "start": "09:00", "end": "25:00"}}},
+		{"delivery_windows": []interface{}{map[string]interface{}{"name": "bad", "start": "09:00", "end": "17:00", "days": []string{"funday"}}}},
+		{"time_zones": map[string]interface{}{"1": "America/Nowhere"}},
+		{"default_time_zone": "Nowhere"},
+	}
+
+	for _, configuration := range invalid {
+		if _, err := NewDeliverySchedule(configuration); err == nil {
+			t.Errorf("%v was accepted", configuration)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const DEFAULT_OTP_PURPOSE = "default"
+const DEFAULT_OTP_MESSAGE = "Your verification code is {{code}}"
+
+// Not persisted
+type OtpSettings struct {
+	Length                int
+	TTLSeconds            int `mapstructure:"ttl_seconds"`
+	MaxAttempts           int `mapstructure:"max_attempts"`
+	LockoutSeconds        int `mapstructure:"lockout_seconds"`
+	ResendIntervalSeconds int `mapstructure:"resend_interval_seconds"`
+}
+
+func DefaultOtpSettings() OtpSettings {
+	return OtpSettings{Length: 6, TTLSeconds: 300, MaxAttempts: 5, LockoutSeconds: 900, ResendIntervalSeconds: 30}
+}
+
+func (settings OtpSettings) Validate() error {
+	if settings.Length < 4 || settings.Length > 10 {
+		return fmt.Errorf("otp length must be between 4 and 10, got %d", settings.Length)
+	}
+	if settings.TTLSeconds <= 0 || settings.MaxAttempts <= 0 || settings.LockoutSeconds < 0 || settings.ResendIntervalSeconds < 0 {
+		return fmt.Errorf("otp ttl_seconds and max_attempts must be positive, lockout_seconds and resend_interval_seconds can not be negative")
+	}
+
+	return nil
+}
+
+// Not persisted
+type OtpSendRequest struct {
+	Recipient  string            `json:"recipient" form:"recipient" binding:"required"`
+	Sender     string            `json:"sender" form:"sender" binding:"required"`
+	Purpose    string            `json:"purpose" form:"purpose"`
+	Message    string            `json:"message" form:"message"`
+	TemplateId string            `json:"template_id" form:"template_id"`
+	Locale     string            `json:"locale" form:"locale"`
+	Variables  map[string]string `json:"variables"`
+}
+
+// Not persisted
+type OtpVerifyRequest struct {
+	Recipient string `json:"recipient" form:"recipient" binding:"required"`
+	Purpose   string `json:"purpose" form:"purpose"`
+	Code      string `json:"code" form:"code" binding:"required"`
+}
+
+// Only a salted hash of the code is stored. PurgeOn drives the TTL index and
+// is pushed back when the challenge gets locked so the lockout outlives it
+type OtpChallenge struct {
+	Id          bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+	Recipient   string        `json:"recipient" bson:"recipient"`
+	Purpose     string        `json:"purpose" bson:"purpose"`
+	MessageId   bson.ObjectId `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	Salt        string        `json:"-" bson:"salt"`
+	CodeHash    string        `json:"-" bson:"code_hash"`
+	Attempts    int           `json:"attempts" bson:"attempts"`
+	MaxAttempts int           `json:"max_attempts" bson:"max_attempts"`
+	Superseded  bool          `json:"superseded" bson:"superseded"`
+	CreatedOn   int64         `json:"created_on" bson:"created_on"`
+	ExpiresOn   int64         `json:"expires_on" bson:"expires_on"`
+	VerifiedOn  int64         `json:"verified_on" bson:"verified_on"`
+	LockedUntil int64         `json:"locked_until" bson:"locked_until"`
+	PurgeOn     time.Time     `json:"-" bson:"purge_on"`
+}
+
+// GenerateOtpCode returns a uniformly distributed numeric code of length digits
+func GenerateOtpCode(length int) (string, error) {
+	code := make([]byte, length)
+	for i := range code {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + digit.Int64())
+	}
+
+	return string(code), nil
+}
+
+func NewOtpChallenge(recipient string, purpose string, code string, settings OtpSettings) (OtpChallenge, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return OtpChallenge{}, err
+	}
+
+	now := time.Now()
+	expiresOn := now.Add(time.Duration(settings.TTLSeconds) * time.Second)
+	challenge := OtpChallenge{
+		Id:          bson.NewObjectId(),
+		Recipient:   recipient,
+		Purpose:     purpose,
+		Salt:        hex.EncodeToString(salt),
+		MaxAttempts: settings.MaxAttempts,
+		CreatedOn:   now.UnixNano(),
+		ExpiresOn:   expiresOn.UnixNano(),
+		PurgeOn:     expiresOn,
+	}
+	challenge.CodeHash = challenge.hash(code)
+
+	return challenge, nil
+}
+
+func (challenge *OtpChallenge) hash(code string) string {
+	mac := hmac.New(sha256.New, []byte(challenge.Salt))
+	fmt.Fprintf(mac, "%s:%s:%s", challenge.Recipient, challenge.Purpose, code)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches compares code against the stored hash in constant time
+func (challenge *OtpChallenge) Matches(code string) bool {
+	return hmac.Equal([]byte(challenge.hash(code)), []byte(challenge.CodeHash))
+}
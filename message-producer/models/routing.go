@@ -1,7 +1,179 @@
 package models
 
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
 // Not persisted
 type Routing struct {
 	Context string
 	Targets []string
 }
+
+// Not persisted
+type RoutingSplit struct {
+	Weight  int
+	Targets []string
+}
+
+// Not persisted
+type RoutingRule struct {
+	Name              string
+	Order             int
+	Types             []string
+	Senders           []string
+	RecipientPrefixes []string          `mapstructure:"recipient_prefixes"`
+	CountryCodes      []string          `mapstructure:"country_codes"`
+	MinLength         int               `mapstructure:"min_length"`
+	MaxLength         int               `mapstructure:"max_length"`
+	Metadata          map[string]string `mapstructure:"metadata"`
+	Targets           []string
+	Splits            []RoutingSplit
+}
+
+// Router resolves the target topics of a message. Rules are evaluated by
+// ascending Order and the first match wins; messages no rule matches fall
+// back to the per Context routing and finally to the Default route.
+// Weighted splits are picked from the PartitionKey of the message so every
+// message sharing a key takes the same split and keeps its order
+type Router struct {
+	Rules        []RoutingRule
+	Contexts     map[string][]string
+	Default      []string
+	PartitionKey string
+}
+
+func NewRouter(rules []RoutingRule, contexts map[string][]string, defaultRoute []string, partitionKey string) *Router {
+	sorted := make([]RoutingRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Order < sorted[j].Order })
+
+	if contexts == nil {
+		contexts = map[string][]string{}
+	}
+
+	return &Router{Rules: sorted, Contexts: contexts, Default: defaultRoute, PartitionKey: partitionKey}
+}
+
+func (router *Router) Resolve(message common_models.Message) []string {
+	for _, rule := range router.Rules {
+		if rule.Matches(message) {
+			return rule.pickTargets(message.PartitionKey(router.PartitionKey))
+		}
+	}
+
+	if targets, ok := router.Contexts[message.Type]; ok {
+		return targets
+	}
+
+	return router.Default
+}
+
+func (rule *RoutingRule) Matches(message common_models.Message) bool {
+	if len(rule.Types) > 0 && !contains(rule.Types, message.Type) {
+		return false
+	}
+
+	if len(rule.Senders) > 0 && !contains(rule.Senders, message.Sender) {
+		return false
+	}
+
+	if len(rule.RecipientPrefixes) > 0 && !hasAnyPrefix(message.Recipient, rule.RecipientPrefixes) {
+		return false
+	}
+
+	if len(rule.CountryCodes) > 0 && !hasAnyCountryCode(message.Recipient, rule.CountryCodes) {
+		return false
+	}
+
+	length := len([]rune(message.Message))
+	if rule.MinLength > 0 && length < rule.MinLength {
+		return false
+	}
+	if rule.MaxLength > 0 && length > rule.MaxLength {
+		return false
+	}
+
+	for key, value := range rule.Metadata {
+		if actual, ok := message.Metadata[key]; !ok || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Picks one of the weighted splits by hashing key, a rule without splits
+// always routes to its Targets. Messages without a key all take the same split
+func (rule *RoutingRule) pickTargets(key []byte) []string {
+	total := 0
+	for _, split := range rule.Splits {
+		if split.Weight > 0 {
+			total += split.Weight
+		}
+	}
+
+	if total == 0 {
+		return rule.Targets
+	}
+
+	hash := fnv.New32a()
+	hash.Write(key)
+	pick := int(hash.Sum32() % uint32(total))
+	for _, split := range rule.Splits {
+		if split.Weight <= 0 {
+			continue
+		}
+		if pick < split.Weight {
+			return split.Targets
+		}
+		pick -= split.Weight
+	}
+
+	return rule.Targets
+}
+
+// Strips the international prefix ("+" or "00") so country codes can be compared as digits
+func internationalDigits(recipient string) string {
+	recipient = strings.TrimSpace(recipient)
+	if strings.HasPrefix(recipient, "+") {
+		return recipient[1:]
+	}
+
+	return strings.TrimPrefix(recipient, "00")
+}
+
+func hasAnyCountryCode(recipient string, countryCodes []string) bool {
+	digits := internationalDigits(recipient)
+	for _, code := range countryCodes {
+		if strings.HasPrefix(digits, strings.TrimPrefix(code, "+")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+func TestRouterResolve(t *testing.T) {
+	rules := []RoutingRule{
+		{Name: "catch all otp", Order: 20, Types: []string{common_models.OneTimePassword}, Targets: []string{"otp-default"}},
+		{Name: "dominican otp", Order: 10, Types: []string{common_models.OneTimePassword}, CountryCodes: []string{"+1809"}, Targets: []string{"otp-do"}},
+		{Name: "bank", Order: 30, Senders: []string{"bank"}, Metadata: map[string]string{"tier": "gold"}, Targets: []string{"gold"}},
+		{Name: "long", Order: 40, MinLength: 10, Targets: []string{"long"}},
+		{Name: "short", Order: 40, MaxLength: 3, RecipientPrefixes: []string{"short@"}, Targets: []string{"short"}},
+	}
+	contexts := map[string][]string{common_models.Transactional: {"messaging_trx"}}
+	router := NewRouter(rules, contexts, []string{"fallback"}, common_models.DEFAULT_PARTITION_KEY)
+
+	cases := []struct {
+		name    string
+		message common_models.Message
+		targets []string
+	}{
+		{name: "lower order wins", message: common_models.Message{Type: common_models.OneTimePassword, Recipient: "+18095551234"}, targets: []string{"otp-do"}},
+		{name: "00 prefix matches country", message: common_models.Message{Type: common_models.OneTimePassword, Recipient: "0018095551234"}, targets: []string{"otp-do"}},
+		{name: "next matching rule", message: common_models.Message{Type: common_models.OneTimePassword, Recipient: "+442079460958"}, targets: []string{"otp-default"}},
+		{name: "metadata match", message: common_models.Message{Type: "PROMO", Sender: "bank", Metadata: map[string]string{"tier": "gold"}}, targets: []string{"gold"}},
+		{name: "metadata mismatch", message: common_models.Message{Type: "PROMO", Sender: "bank", Metadata: map[string]string{"tier": "silver"}}, targets: []string{"fallback"}},
+		{name: "min length", message: common_models.Message{Type: "PROMO", Message: "a long enough body"}, targets: []string{"long"}},
+		{name: "max length and prefix", message: common_models.Message{Type: "PROMO", Recipient: "short@x.com", Message: "hey"}, targets: []string{"short"}},
+		{name: "context route", message: common_models.Message{Type: common_models.Transactional, Message: "hey"}, targets: []string{"messaging_trx"}},
+		{name: "default route", message: common_models.Message{Type: "PROMO", Message: "hey"}, targets: []string{"fallback"}},
+	}
+
+	for _, c := range cases {
+		if targets := router.Resolve(c.message); !reflect.DeepEqual(targets, c.targets) {
+			t.Errorf("%s: routed to %v, want %v", c.name, targets, c.targets)
+		}
+	}
+}
+
+func TestRouterKeepsRulesWithEqualOrder(t *testing.T) {
+	rules := []RoutingRule{
+		{Name: "first", Targets: []string{"first"}},
+		{Name: "second", Targets: []string{"second"}},
+	}
+	router := NewRouter(rules, nil, nil, common_models.DEFAULT_PARTITION_KEY)
+
+	if targets := router.Resolve(common_models.Message{}); !reflect.DeepEqual(targets, []string{"first"}) {
+		t.Errorf("routed to %v, rules of equal order must keep their configured order", targets)
+	}
+}
+
+func TestWeightedSplitIsStablePerKey(t *testing.T) {
+	rule := RoutingRule{
+		Targets: []string{"unused"},
+		Splits: []RoutingSplit{
+			{Weight: 3, Targets: []string{"a"}},
+			{Weight: 0, Targets: []string{"never"}},
+			{Weight: 1, Targets: []string{"b"}},
+		},
+	}
+	router := NewRouter([]RoutingRule{rule}, nil, nil, common_models.DEFAULT_PARTITION_KEY)
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		message := common_models.Message{Recipient: fmt.Sprintf("+1809555%04d", i)}
+		first := router.Resolve(message)
+		for attempt := 0; attempt < 3; attempt++ {
+			if again := router.Resolve(message); !reflect.DeepEqual(again, first) {
+				t.Fatalf("%s moved from %v to %v", message.Recipient, first, again)
+			}
+		}
+		counts[first[0]]++
+	}
+
+	if counts["never"] != 0 || counts["unused"] != 0 {
+		t.Errorf("zero weight or rule targets picked: %v", counts)
+	}
+	if share := float64(counts["a"]) / 4000; share < 0.7 || share > 0.8 {
+		t.Errorf("split a took %.2f of the messages, want about 0.75", share)
+	}
+}
+
+func TestRuleWithoutWeightsUsesTargets(t *testing.T) {
+	rule := RoutingRule{Targets: []string{"direct"}, Splits: []RoutingSplit{{Weight: 0, Targets: []string{"never"}}}}
+
+	if targets := rule.pickTargets([]byte("key")); !reflect.DeepEqual(targets, []string{"direct"}) {
+		t.Errorf("routed to %v, want the rule targets", targets)
+	}
+}
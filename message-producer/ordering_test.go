@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_claimcheck "github.com/hectorandac/kafka-message-processor/common-claimcheck"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_serde "github.com/hectorandac/kafka-message-processor/common-serde"
+	"github.com/hectorandac/kafka-message-processor/message-producer/models"
+)
+
+// Produces interleaved messages for several recipients through a weighted
+// split against an in process mock cluster and checks every recipient's
+// messages land on one topic and partition in the order they were sent
+func TestProduceKeepsRecipientOrder(t *testing.T) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"test.mock.num.brokers": 3, "enable.idempotence": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	producerClient = p
+	codec, _ = common_serde.NewCodec(map[string]interface{}{})
+	claimCheck, _ = common_claimcheck.NewClaimCheck(map[string]interface{}{})
+	router = models.NewRouter([]models.RoutingRule{{
+		Name:   "split",
+		Splits: []models.RoutingSplit{{Weight: 1, Targets: []string{"ordering-a"}}, {Weight: 1, Targets: []string{"ordering-b"}}},
+	}}, nil, nil, partitionKey)
+
+	recipients := []string{"+18095550001", "+18095550002", "+18095550003", "user@example.com"}
+	sent := 0
+	for i := 0; i < 20; i++ {
+		for _, recipient := range recipients {
+			message := common_models.Message{Recipient: recipient, Sender: "tests", Type: "TRX", Message: fmt.Sprint(i)}
+			if err := produce(message, ""); err != nil {
+				t.Fatal(err)
+			}
+			sent++
+		}
+	}
+
+	type position struct {
+		partition string
+		offset    kafka.Offset
+		sequence  int
+	}
+	last := map[string]position{}
+	timeout := time.After(30 * time.Second)
+	for delivered := 0; delivered < sent; {
+		select {
+		case event := <-p.Events():
+			report, ok := event.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			if report.TopicPartition.Error != nil {
+				t.Fatal(report.TopicPartition.Error)
+			}
+			delivered++
+
+			recipient := string(report.Key)
+			decoded, err := codec.Deserialize(report.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sequence int
+			fmt.Sscan(decoded.Message, &sequence)
+
+			current := fmt.Sprintf("%s[%d]", *report.TopicPartition.Topic, report.TopicPartition.Partition)
+			if previous, ok := last[recipient]; ok {
+				if previous.partition != current {
+					t.Fatalf("%s moved from %s to %s", recipient, previous.partition, current)
+				}
+				if report.TopicPartition.Offset <= previous.offset || sequence != previous.sequence+1 {
+					t.Fatalf("%s delivered message %d after %d", recipient, sequence, previous.sequence)
+				}
+			} else if sequence != 0 {
+				t.Fatalf("%s delivered message %d first", recipient, sequence)
+			}
+			last[recipient] = position{partition: current, offset: report.TopicPartition.Offset, sequence: sequence}
+		case <-timeout:
+			t.Fatal("timed out waiting for delivery reports")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/hectorandac/kafka-message-processor/message-producer/models"
+	"github.com/martini-contrib/render"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const OTP_COLLECTION = "otp"
+
+var otpSettings models.OtpSettings = models.DefaultOtpSettings()
+
+func ensureOtpIndexes(db *mgo.Database) {
+	db.C(OTP_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"recipient", "purpose", "-created_on"}})
+	db.C(OTP_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"purge_on"}, ExpireAfter: time.Second})
+}
+
+// Generates a code, stores its hash and sends it through the regular pipeline.
+// The code itself is never part of the response
+func sendOtp(request models.OtpSendRequest, req *http.Request, r render.Render, db *mgo.Database) {
+	ensureOtpIndexes(db)
+	request.Recipient = common_models.NormalizeRecipient(request.Recipient, defaultCountryCode)
+	if request.Purpose == "" {
+		request.Purpose = models.DEFAULT_OTP_PURPOSE
+	}
+
+	now := time.Now()
+	filter := bson.M{"recipient": request.Recipient, "purpose": request.Purpose}
+
+	locked := models.OtpChallenge{}
+	if err := db.C(OTP_COLLECTION).Find(bson.M{"recipient": request.Recipient, "purpose": request.Purpose, "locked_until": bson.M{"$gt": now.UnixNano()}}).One(&locked); err == nil {
+		tooManyRequests(r, "too many failed attempts, try again later", locked.LockedUntil)
+		return
+	}
+
+	// Failed attempts carry over to the new code so resending never resets the lockout
+	carried := 0
+	latest := models.OtpChallenge{}
+	if err := db.C(OTP_COLLECTION).Find(filter).Sort("-created_on").One(&latest); err == nil {
+		resendOn := latest.CreatedOn + int64(otpSettings.ResendIntervalSeconds)*int64(time.Second)
+		if latest.VerifiedOn == 0 && resendOn > now.UnixNano() {
+			tooManyRequests(r, "a code was sent recently, try again later", resendOn)
+			return
+		}
+		if latest.VerifiedOn == 0 && latest.LockedUntil == 0 && latest.PurgeOn.After(now) {
+			carried = latest.Attempts
+		}
+	}
+
+	code, err := models.GenerateOtpCode(otpSettings.Length)
+	if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	challenge, err := models.NewOtpChallenge(request.Recipient, request.Purpose, code, otpSettings)
+	if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	challenge.Attempts = carried
+
+	message, err := otpMessage(request, code, challenge)
+	if err != nil {
+		templateError(err, r)
+		return
+	}
+	if validationError := validate.Struct(message); validationError != nil {
+		r.JSON(400, map[string]interface{}{"error": validationError.Error(), "fields": common_models.FieldErrors(validationError)})
+		return
+	}
+	message.Id = bson.NewObjectId()
+	message.CreatedOn = now.UnixNano()
+	if !deliverable(&message, r, db) {
+		return
+	}
+	if !allowed(message, r, db) {
+		return
+	}
+	challenge.MessageId = message.Id
+
+	// Stored before producing so every delivered code can be verified
+	if err := db.C(OTP_COLLECTION).Insert(challenge); err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	traceParent := common_kafka.ChildTraceParent(req.Header.Get(common_kafka.HEADER_TRACEPARENT))
+	if err := produce(message, traceParent); err != nil {
+		db.C(OTP_COLLECTION).RemoveId(challenge.Id)
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Only the latest code of a recipient and purpose can be verified
+	db.C(OTP_COLLECTION).UpdateAll(
+		bson.M{"recipient": request.Recipient, "purpose": request.Purpose, "_id": bson.M{"$ne": challenge.Id}, "verified_on": 0},
+		bson.M{"$set": bson.M{"superseded": true}},
+	)
+
+	r.JSON(200, map[string]interface{}{"result": "success", "otp_id": challenge.Id, "message_id": message.Id, "expires_on": challenge.ExpiresOn})
+}
+
+func otpMessage(request models.OtpSendRequest, code string, challenge models.OtpChallenge) (common_models.Message, error) {
+	variables := map[string]string{}
+	for key, value := range request.Variables {
+		variables[key] = value
+	}
+	variables["code"] = code
+
+	message := common_models.Message{
+		Recipient: request.Recipient,
+		Sender:    request.Sender,
+		Type:      common_models.OneTimePassword,
+		Locale:    request.Locale,
+		Metadata:  map[string]string{"otp_id": challenge.Id.Hex(), "otp_purpose": request.Purpose},
+	}
+
+	if request.TemplateId != "" {
+		message.TemplateId = request.TemplateId
+		message.Variables = variables
+		return message, renderTemplate(&message)
+	}
+
+	body := request.Message
+	if body == "" {
+		body = models.DEFAULT_OTP_MESSAGE
+	}
+
+	template := common_models.Template{TemplateId: "otp", Bodies: map[string]string{common_models.DEFAULT_LOCALE: body}}
+	if !contains(common_models.TemplateVariables(body), "code") {
+		return message, &common_models.MissingVariablesError{Names: []string{"code"}}
+	}
+
+	text, err := template.Render(common_models.DEFAULT_LOCALE, variables)
+	message.Message = text
+
+	return message, err
+}
+
+// Checks a code against the latest challenge. Failed attempts are counted
+// atomically and carried over by resends, reaching MaxAttempts locks the
+// recipient out and a code can only be verified once. A failed attempt keeps
+// its challenge for LockoutSeconds so a resend still finds the count
+func verifyOtp(request models.OtpVerifyRequest, r render.Render, db *mgo.Database) {
+	ensureOtpIndexes(db)
+	request.Recipient = common_models.NormalizeRecipient(request.Recipient, defaultCountryCode)
+	if request.Purpose == "" {
+		request.Purpose = models.DEFAULT_OTP_PURPOSE
+	}
+
+	now := time.Now().UnixNano()
+	challenge := models.OtpChallenge{}
+	filter := bson.M{"recipient": request.Recipient, "purpose": request.Purpose, "superseded": false}
+	if err := db.C(OTP_COLLECTION).Find(filter).Sort("-created_on").One(&challenge); err != nil {
+		r.JSON(400, map[string]interface{}{"error": "no code was sent to this recipient"})
+		return
+	}
+
+	if challenge.LockedUntil > now {
+		tooManyRequests(r, "too many failed attempts, try again later", challenge.LockedUntil)
+		return
+	}
+	if challenge.VerifiedOn != 0 {
+		r.JSON(409, map[string]interface{}{"error": "code was already used"})
+		return
+	}
+	if challenge.ExpiresOn < now {
+		r.JSON(400, map[string]interface{}{"error": "code expired, request a new one"})
+		return
+	}
+	if challenge.Attempts >= challenge.MaxAttempts {
+		r.JSON(400, map[string]interface{}{"error": "too many failed attempts, request a new code"})
+		return
+	}
+
+	pending := bson.M{"_id": challenge.Id, "verified_on": 0, "attempts": bson.M{"$lt": challenge.MaxAttempts}}
+
+	if challenge.Matches(request.Code) {
+		err := db.C(OTP_COLLECTION).Update(pending, bson.M{"$set": bson.M{"verified_on": now}})
+		if err == mgo.ErrNotFound {
+			r.JSON(409, map[string]interface{}{"error": "code was already used"})
+		} else if err != nil {
+			r.JSON(500, map[string]interface{}{"error": err.Error()})
+		} else {
+			r.JSON(200, map[string]interface{}{"result": "verified", "otp_id": challenge.Id})
+		}
+		return
+	}
+
+	failed := bson.M{"$inc": bson.M{"attempts": 1}, "$max": bson.M{"purge_on": time.Now().Add(time.Duration(otpSettings.LockoutSeconds) * time.Second)}}
+	_, err := db.C(OTP_COLLECTION).Find(pending).Apply(mgo.Change{Update: failed, ReturnNew: true}, &challenge)
+	if err == mgo.ErrNotFound {
+		r.JSON(400, map[string]interface{}{"error": "too many failed attempts, request a new code"})
+		return
+	} else if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	remaining := challenge.MaxAttempts - challenge.Attempts
+	if remaining > 0 {
+		r.JSON(400, map[string]interface{}{"error": "invalid code", "remaining_attempts": remaining})
+		return
+	}
+
+	lockedUntil := time.Now().Add(time.Duration(otpSettings.LockoutSeconds) * time.Second)
+	update := bson.M{"locked_until": lockedUntil.UnixNano()}
+	if lockedUntil.After(challenge.PurgeOn) {
+		update["purge_on"] = lockedUntil
+	}
+	db.C(OTP_COLLECTION).UpdateId(challenge.Id, bson.M{"$set": update})
+
+	tooManyRequests(r, "too many failed attempts, try again later", lockedUntil.UnixNano())
+}
+
+func tooManyRequests(r render.Render, message string, until int64) {
+	seconds := (until-time.Now().UnixNano())/int64(time.Second) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	r.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	r.JSON(429, map[string]interface{}{"error": message, "retry_after": seconds})
+}
+
+func contains(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+
+	return false
+}
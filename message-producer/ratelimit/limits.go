@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	SENDER_SCOPE    = "sender"
+	RECIPIENT_SCOPE = "recipient"
+	TYPE_SCOPE      = "type"
+)
+
+const (
+	MEMORY_STORE = "memory"
+	MONGO_STORE  = "mongo"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst.
+// Match restricts it to a single sender, recipient or type
+type Limit struct {
+	Scope string
+	Match string
+	Rate  float64
+	Burst float64
+}
+
+type Settings struct {
+	Store  string
+	Limits []Limit
+}
+
+// Store keeps the buckets, Take consumes a token and returns how long to wait
+// for the next one when the bucket is empty
+type Store interface {
+	Take(key string, limit Limit, now time.Time) (time.Duration, error)
+	Refund(key string, limit Limit) error
+}
+
+// LimitError reports the limit a message exceeded
+type LimitError struct {
+	Scope      string
+	Value      string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s %s", e.Scope, e.Value)
+}
+
+// Seconds clients are told to wait, rounded up
+func (e *LimitError) RetryAfterSeconds() int64 {
+	return int64(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// NewSettings reads the rate_limits section of the configuration, no section means no limits
+func NewSettings(configuration map[string]interface{}) (Settings, error) {
+	settings := Settings{Store: MEMORY_STORE}
+	if err := mapstructure.Decode(configuration["rate_limits"], &settings); err != nil {
+		return settings, fmt.Errorf("invalid rate_limits: %v", err)
+	}
+
+	if settings.Store != MEMORY_STORE && settings.Store != MONGO_STORE {
+		return settings, fmt.Errorf("invalid rate_limits store %s", settings.Store)
+	}
+
+	for _, limit := range settings.Limits {
+		if limit.Scope != SENDER_SCOPE && limit.Scope != RECIPIENT_SCOPE && limit.Scope != TYPE_SCOPE {
+			return settings, fmt.Errorf("invalid rate limit scope %s", limit.Scope)
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return settings, fmt.Errorf("rate limit on %s needs a positive rate and a burst of at least 1", limit.Scope)
+		}
+	}
+
+	return settings, nil
+}
+
+func scopeValue(scope string, message common_models.Message) string {
+	switch scope {
+	case SENDER_SCOPE:
+		return message.Sender
+	case RECIPIENT_SCOPE:
+		return message.Recipient
+	default:
+		return message.Type
+	}
+}
+
+// Allow consumes a token of every limit applying to message. When one of them
+// is exhausted or fails the tokens already taken are given back, exhausted
+// limits return a LimitError
+func (settings Settings) Allow(store Store, message common_models.Message) error {
+	now := time.Now()
+	type taken struct {
+		key   string
+		limit Limit
+	}
+	consumed := []taken{}
+	refund := func() {
+		for _, previous := range consumed {
+			store.Refund(previous.key, previous.limit)
+		}
+	}
+
+	for _, limit := range settings.Limits {
+		value := scopeValue(limit.Scope, message)
+		if limit.Match != "" && limit.Match != value {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%s:%g:%g:%s", limit.Scope, limit.Match, limit.Rate, limit.Burst, value)
+		wait, err := store.Take(key, limit, now)
+		if err != nil {
+			refund()
+			return err
+		}
+
+		if wait > 0 {
+			refund()
+			return &LimitError{Scope: limit.Scope, Value: value, RetryAfter: wait}
+		}
+
+		consumed = append(consumed, taken{key: key, limit: limit})
+	}
+
+	return nil
+}
+
+// Refills the bucket for the time elapsed since updatedOn and takes one token
+func refill(tokens float64, updatedOn time.Time, limit Limit, now time.Time) (float64, time.Duration) {
+	elapsed := now.Sub(updatedOn).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(limit.Burst, tokens+elapsed*limit.Rate)
+	}
+
+	if tokens < 1 {
+		return tokens, time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+
+	return tokens - 1, 0
+}
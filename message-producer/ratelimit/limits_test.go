@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+func TestRefill(t *testing.T) {
+	now := time.Now()
+	limit := Limit{Scope: SENDER_SCOPE, Rate: 2, Burst: 5}
+
+	cases := []struct {
+		name      string
+		tokens    float64
+		elapsed   time.Duration
+		remaining float64
+		wait      time.Duration
+	}{
+		{name: "full bucket", tokens: 5, elapsed: 0, remaining: 4},
+		{name: "capped at burst", tokens: 4, elapsed: time.Hour, remaining: 4},
+		{name: "refilled by rate", tokens: 0, elapsed: time.Second, remaining: 1},
+		{name: "partial token waits", tokens: 0.5, elapsed: 0, remaining: 0.5, wait: 250 * time.Millisecond},
+		{name: "empty bucket waits", tokens: 0, elapsed: 0, remaining: 0, wait: 500 * time.Millisecond},
+		{name: "clock going back", tokens: 0, elapsed: -time.Second, remaining: 0, wait: 500 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		remaining, wait := refill(c.tokens, now.Add(-c.elapsed), limit, now)
+		if remaining != c.remaining || wait != c.wait {
+			t.Errorf("%s: got %g tokens and %v, want %g and %v", c.name, remaining, wait, c.remaining, c.wait)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	settings := Settings{Store: MEMORY_STORE, Limits: []Limit{
+		{Scope: SENDER_SCOPE, Rate: 0.001, Burst: 2},
+		{Scope: RECIPIENT_SCOPE, Rate: 0.001, Burst: 1},
+		{Scope: TYPE_SCOPE, Match: common_models.OneTimePassword, Rate: 0.001, Burst: 1},
+	}}
+	store := NewMemoryStore()
+
+	cases := []struct {
+		name      string
+		message   common_models.Message
+		limited   string
+		recipient string
+	}{
+		{name: "first message", message: common_models.Message{Sender: "a", Recipient: "+18095550001", Type: "TRX"}},
+		{name: "recipient exhausted", message: common_models.Message{Sender: "a", Recipient: "+18095550001", Type: "TRX"}, limited: RECIPIENT_SCOPE},
+		{name: "sender token refunded", message: common_models.Message{Sender: "a", Recipient: "+18095550002", Type: "TRX"}},
+		{name: "sender exhausted", message: common_models.Message{Sender: "a", Recipient: "+18095550003", Type: "TRX"}, limited: SENDER_SCOPE},
+		{name: "matched type", message: common_models.Message{Sender: "b", Recipient: "+18095550004", Type: common_models.OneTimePassword}},
+		{name: "matched type exhausted", message: common_models.Message{Sender: "c", Recipient: "+18095550005", Type: common_models.OneTimePassword}, limited: TYPE_SCOPE},
+	}
+
+	for _, c := range cases {
+		err := settings.Allow(store, c.message)
+		if c.limited == "" {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+
+		limitError, ok := err.(*LimitError)
+		if !ok || limitError.Scope != c.limited || limitError.RetryAfter <= 0 {
+			t.Errorf("%s: got %v, want a %s limit", c.name, err, c.limited)
+		}
+	}
+}
+
+// Fails Take on the keys of one scope
+type failingStore struct {
+	*MemoryStore
+	scope string
+}
+
+func (store failingStore) Take(key string, limit Limit, now time.Time) (time.Duration, error) {
+	if limit.Scope == store.scope {
+		return 0, errors.New("store unavailable")
+	}
+
+	return store.MemoryStore.Take(key, limit, now)
+}
+
+func TestAllowRefundsOnStoreError(t *testing.T) {
+	settings := Settings{Store: MEMORY_STORE, Limits: []Limit{
+		{Scope: SENDER_SCOPE, Rate: 0.001, Burst: 1},
+		{Scope: RECIPIENT_SCOPE, Rate: 0.001, Burst: 1},
+	}}
+	store := failingStore{MemoryStore: NewMemoryStore(), scope: RECIPIENT_SCOPE}
+	message := common_models.Message{Sender: "a", Recipient: "+18095550001", Type: "TRX"}
+
+	if err := settings.Allow(store, message); err == nil {
+		t.Fatal("store error was ignored")
+	}
+
+	store.scope = ""
+	if err := settings.Allow(store, message); err != nil {
+		t.Errorf("sender token wasn't refunded: %v", err)
+	}
+}
+
+func TestNewSettings(t *testing.T) {
+	cases := []struct {
+		name    string
+		section interface{}
+		valid   bool
+	}{
+		{name: "no section", section: nil, valid: true},
+		{name: "mongo store", section: map[string]interface{}{"store": "mongo"}, valid: true},
+		{name: "limits", section: map[string]interface{}{"limits": []interface{}{
+			map[string]interface{}{"scope": "sender", "rate": 10, "burst": 20},
+			map[string]interface{}{"scope": "type", "match": "OTP", "rate": 0.5, "burst": 1},
+		}}, valid: true},
+		{name: "unknown store", section: map[string]interface{}{"store": "redis"}},
+		{name: "unknown scope", section: map[string]interface{}{"limits": []interface{}{map[string]interface{}{"scope": "country", "rate": 1, "burst": 1}}}},
+		{name: "zero rate", section: map[string]interface{}{"limits": []interface{}{map[string]interface{}{"scope": "sender", "rate": 0, "burst": 1}}}},
+		{name: "burst below one", section: map[string]interface{}{"limits": []interface{}{map[string]interface{}{"scope": "sender", "rate": 1, "burst": 0.5}}}},
+		{name: "malformed section", section: "sender"},
+	}
+
+	for _, c := range cases {
+		_, err := NewSettings(map[string]interface{}{"rate_limits": c.section})
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: was accepted", c.name)
+		}
+	}
+}
+
+func TestMemoryStoreSweepsIdleBuckets(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Scope: RECIPIENT_SCOPE, Rate: 1, Burst: 1}
+	now := time.Now()
+
+	store.Take("idle", limit, now)
+	store.Take("active", limit, now.Add(MEMORY_IDLE))
+	if len(store.buckets) != 2 {
+		t.Fatalf("swept before the interval, %d buckets left", len(store.buckets))
+	}
+
+	store.Take("active", limit, now.Add(MEMORY_IDLE+MEMORY_SWEEP_INTERVAL+time.Second))
+	if _, ok := store.buckets["idle"]; ok || len(store.buckets) != 1 {
+		t.Errorf("idle bucket wasn't swept, %d buckets left", len(store.buckets))
+	}
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const MEMORY_IDLE = time.Hour
+const MEMORY_SWEEP_INTERVAL = time.Minute
+
+type bucket struct {
+	tokens    float64
+	updatedOn time.Time
+}
+
+// MemoryStore keeps the buckets of a single producer instance
+type MemoryStore struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	sweepOn time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (store *MemoryStore) Take(key string, limit Limit, now time.Time) (time.Duration, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	current, ok := store.buckets[key]
+	if !ok {
+		current = &bucket{tokens: limit.Burst, updatedOn: now}
+		store.buckets[key] = current
+	}
+
+	tokens, wait := refill(current.tokens, current.updatedOn, limit, now)
+	current.tokens, current.updatedOn = tokens, now
+
+	store.evict(now)
+
+	return wait, nil
+}
+
+func (store *MemoryStore) Refund(key string, limit Limit) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if current, ok := store.buckets[key]; ok {
+		current.tokens = math.Min(limit.Burst, current.tokens+1)
+	}
+
+	return nil
+}
+
+// Buckets idle for an hour are dropped every minute so recipients don't pile
+// up forever, sweeping on every Take would scan the map under the lock
+func (store *MemoryStore) evict(now time.Time) {
+	if now.Before(store.sweepOn) {
+		return
+	}
+
+	for key, current := range store.buckets {
+		if now.Sub(current.updatedOn) > MEMORY_IDLE {
+			delete(store.buckets, key)
+		}
+	}
+	store.sweepOn = now.Add(MEMORY_SWEEP_INTERVAL)
+}
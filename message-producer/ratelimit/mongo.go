@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const COLLECTION = "rate_limit"
+const UPDATE_ATTEMPTS = 5
+
+type mongoBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	UpdatedOn int64     `bson:"updated_on"`
+	PurgeOn   time.Time `bson:"purge_on"`
+}
+
+// MongoStore shares the buckets between producer instances. Updates are
+// compare and swap on updated_on so concurrent requests never lose a token
+type MongoStore struct {
+	Collection *mgo.Collection
+}
+
+// EnsureIndexes creates the index purging idle buckets, run once at setup
+func EnsureIndexes(db *mgo.Database) error {
+	return db.C(COLLECTION).EnsureIndex(mgo.Index{Key: []string{"purge_on"}, ExpireAfter: time.Second})
+}
+
+func NewMongoStore(db *mgo.Database) *MongoStore {
+	return &MongoStore{Collection: db.C(COLLECTION)}
+}
+
+func (store *MongoStore) Take(key string, limit Limit, now time.Time) (time.Duration, error) {
+	var err error
+	for attempt := 0; attempt < UPDATE_ATTEMPTS; attempt++ {
+		current := mongoBucket{}
+		err = store.Collection.FindId(key).One(&current)
+		if err == mgo.ErrNotFound {
+			tokens, wait := refill(limit.Burst, now, limit, now)
+			err = store.Collection.Insert(mongoBucket{Key: key, Tokens: tokens, UpdatedOn: now.UnixNano(), PurgeOn: purgeOn(tokens, limit, now)})
+			if mgo.IsDup(err) {
+				continue
+			}
+			return wait, err
+		} else if err != nil {
+			return 0, err
+		}
+
+		tokens, wait := refill(current.Tokens, time.Unix(0, current.UpdatedOn), limit, now)
+		updatedOn := now.UnixNano()
+		if updatedOn <= current.UpdatedOn {
+			updatedOn = current.UpdatedOn + 1
+		}
+
+		err = store.Collection.Update(
+			bson.M{"_id": key, "updated_on": current.UpdatedOn},
+			bson.M{"$set": bson.M{"tokens": tokens, "updated_on": updatedOn, "purge_on": purgeOn(tokens, limit, now)}},
+		)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		return wait, err
+	}
+
+	return 0, fmt.Errorf("couldn't update rate limit bucket %s: %v", key, err)
+}
+
+func (store *MongoStore) Refund(key string, limit Limit) error {
+	current := mongoBucket{}
+	if err := store.Collection.FindId(key).One(&current); err != nil {
+		return err
+	}
+
+	return store.Collection.Update(
+		bson.M{"_id": key, "updated_on": current.UpdatedOn},
+		bson.M{"$set": bson.M{"tokens": math.Min(limit.Burst, current.Tokens+1), "updated_on": current.UpdatedOn + 1}},
+	)
+}
+
+// A bucket can be dropped once it would be full again
+func purgeOn(tokens float64, limit Limit, now time.Time) time.Time {
+	return now.Add(time.Duration((limit.Burst-tokens)/limit.Rate*float64(time.Second)) + time.Minute)
+}
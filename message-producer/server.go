@@ -1,128 +1,392 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-martini/martini"
 	"github.com/go-playground/validator"
+	common_claimcheck "github.com/hectorandac/kafka-message-processor/common-claimcheck"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
 	common_models "github.com/hectorandac/kafka-message-processor/common-models"
-	"github.com/hectorandac/kafka-message-processor/message-producer/middlewares"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	common_provisioner "github.com/hectorandac/kafka-message-processor/common-provisioner"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	common_serde "github.com/hectorandac/kafka-message-processor/common-serde"
 	"github.com/hectorandac/kafka-message-processor/message-producer/models"
+	"github.com/hectorandac/kafka-message-processor/message-producer/ratelimit"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 	"github.com/mitchellh/mapstructure"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+const SERVICE_NAME = "message-producer"
+const DATABASE = "producer"
+
 var validate *validator.Validate
 var producerClient *kafka.Producer
-var routings map[string][]string = map[string][]string{}
+var codec *common_serde.Codec
+var claimCheck *common_claimcheck.ClaimCheck
+var router *models.Router = models.NewRouter(nil, nil, nil, common_models.DEFAULT_PARTITION_KEY)
+var laneQueues map[string]bool = make(map[string]bool)
+var defaultCountryCode string
+var partitionKey string = common_models.DEFAULT_PARTITION_KEY
+var rateLimits ratelimit.Settings
+var memoryStore *ratelimit.MemoryStore = ratelimit.NewMemoryStore()
+var provisionerClient *common_provisioner.Client = common_provisioner.NewClient(SERVICE_NAME)
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
 	validate = validator.New()
-	setupEnvironment()
+	if err := common_models.RegisterValidations(validate); err != nil {
+		panic(err)
+	}
+
+	common_health.Register(common_provisioner.COMPONENT)
+	common_health.Register(common_kafka.COMPONENT)
+	common_health.RegisterCheck(common_kafka.COMPONENT, true, func() error { return common_kafka.Check(producerClient)() })
+	common_health.RegisterCheck(common_provisioner.COMPONENT, false, provisionerClient.Check)
+	// Retried until it succeeds, a configuration error is fixed in the provisioner without restarting
+	go common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		_, err := setupEnvironment()
+		if err != nil {
+			fmt.Printf("Couldn't setup the environment (attempt %d): %v\n", attempt, err)
+		}
+		return err
+	})
 
 	m := martini.Classic()
-	m.Use(middlewares.MongoDB())
+	m.Use(common_health.RequireReady())
+	m.Use(common_mongo.MongoDB(DATABASE))
 	m.Use(render.Renderer())
 
+	m.Get("/livez", common_health.LivezHandler)
+	m.Get("/readyz", common_health.ReadyzHandler)
+
 	m.Post("/message", binding.Bind(common_models.Message{}), processMessage)
+	m.Post("/otp/send", binding.Bind(models.OtpSendRequest{}), sendOtp)
+	m.Post("/otp/verify", binding.Bind(models.OtpVerifyRequest{}), verifyOtp)
 
-	m.RunOnAddr(":3020")
+	m.RunOnAddr(common_config.Get(common_config.LISTEN_ADDRESS, ":3020"))
 }
 
-func processMessage(message common_models.Message, r render.Render, db *mgo.Database) {
+func processMessage(message common_models.Message, req *http.Request, r render.Render, db *mgo.Database) {
+	// Normalized first so suppressions, rate limits and partitioning see a single form of each recipient
+	message.Recipient = common_models.NormalizeRecipient(message.Recipient, defaultCountryCode)
+
+	if message.TemplateId != "" {
+		if err := renderTemplate(&message); err != nil {
+			templateError(err, r)
+			return
+		}
+	}
+
 	validationError := validate.Struct(message)
+	message.Id = bson.NewObjectId()
+	message.BodyEncoding, message.BodyReference, message.Status = "", "", ""
 	message.CreatedOn = time.Now().UnixNano()
 
 	if validationError != nil {
-		json := map[string]interface{}{"error": strings.Split(validationError.Error(), "\n")}
+		json := map[string]interface{}{"error": strings.Split(validationError.Error(), "\n"), "fields": common_models.FieldErrors(validationError)}
 		r.JSON(400, json)
 		return
 	}
 
-	// produce message
-	go produce(message)
+	// Claimed first so a resent campaign message is neither suppressed nor reported twice
+	claimed, err := claimCampaignDelivery(db, message)
+	if err != nil {
+		r.JSON(503, map[string]interface{}{"error": "couldn't check the campaign deliveries: " + err.Error()})
+		return
+	} else if !claimed {
+		r.JSON(200, map[string]interface{}{"result": "duplicate"})
+		return
+	}
+
+	if !deliverable(&message, r, db) {
+		return
+	}
+
+	if !allowed(message, r, db) {
+		releaseCampaignDelivery(db, message)
+		return
+	}
+
+	// Enqueued before answering so a client waiting for the response gets its messages ordered
+	traceParent := common_kafka.ChildTraceParent(req.Header.Get(common_kafka.HEADER_TRACEPARENT))
+
+	deliverOn, err := deliverySchedule.DeliverOn(message, time.Now())
+	if err != nil {
+		releaseCampaignDelivery(db, message)
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if deliverOn.After(time.Now()) {
+		if err := deferMessage(db, message, traceParent, deliverOn); err != nil {
+			releaseCampaignDelivery(db, message)
+			r.JSON(500, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"result": "deferred", "deliver_on": deliverOn, "message": message})
+		return
+	}
+
+	if err := produce(message, traceParent); err != nil {
+		releaseCampaignDelivery(db, message)
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	reportCampaignMessage(message, common_models.QUEUED)
 
 	r.JSON(200, map[string]interface{}{"result": "success", "message": message})
 }
 
-func produce(message common_models.Message) {
-	topics := routings[message.Type]
-	result, err := json.Marshal(message)
+func templateError(err error, r render.Render) {
+	if missing, ok := err.(*common_models.MissingVariablesError); ok {
+		r.JSON(400, map[string]interface{}{"error": err.Error(), "missing_variables": missing.Names})
+	} else if err == ErrTemplateNotFound {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else if _, ok := err.(*common_provisioner.StatusError); ok {
+		r.JSON(502, map[string]interface{}{"error": err.Error()})
+	} else if _, ok := err.(*common_provisioner.RequestError); ok {
+		r.JSON(502, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// Answers for messages to recipients that opted out. A suppressed message is
+// acknowledged without being produced, a rejected one fails the request
+func deliverable(message *common_models.Message, r render.Render, db *mgo.Database) bool {
+	action, err := suppressionAction(db, message)
+	if err != nil {
+		releaseCampaignDelivery(db, *message)
+		r.JSON(503, map[string]interface{}{"error": "couldn't check the suppression list: " + err.Error()})
+		return false
+	}
+
+	switch action {
+	case SUPPRESS:
+		r.JSON(200, map[string]interface{}{"result": common_models.SUPPRESSED, "message_id": message.Id})
+		return false
+	case REJECT_SUPPRESSED:
+		r.JSON(403, map[string]interface{}{"error": "recipient opted out of these messages", "message_id": message.Id})
+		return false
+	}
 
+	return true
+}
+
+// Requests build the Mongo store from their own session, the index is only created once
+func ensureRateLimitIndexes() error {
+	db, session, err := common_mongo.Connect(DATABASE)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return err
 	}
+	defer session.Close()
+
+	return ratelimit.EnsureIndexes(db)
+}
+
+// Answers 429 when the message exceeds one of the rate limits. Limits fail
+// open, a store error is logged and the message goes through
+func allowed(message common_models.Message, r render.Render, db *mgo.Database) bool {
+	var store ratelimit.Store = memoryStore
+	if rateLimits.Store == ratelimit.MONGO_STORE {
+		store = ratelimit.NewMongoStore(db)
+	}
+
+	err := rateLimits.Allow(store, message)
+	if limitError, ok := err.(*ratelimit.LimitError); ok {
+		r.Header().Set("Retry-After", strconv.FormatInt(limitError.RetryAfterSeconds(), 10))
+		r.JSON(429, map[string]interface{}{"error": err.Error(), "retry_after": limitError.RetryAfterSeconds()})
+		return false
+	} else if err != nil {
+		fmt.Printf("Couldn't check rate limits: %v\n", err)
+	}
+
+	return true
+}
+
+// Messages are keyed by partitionKey (the recipient unless configured
+// otherwise) and sent through the idempotent producer, so messages sharing a
+// key reach each topic in the order they were produced. Weighted splits are
+// picked from the same key and don't break that order. Messages of one key
+// with different priorities travel on different lanes of a queue with
+// priority lanes and are only ordered within their lane. The dispatcher reads
+// every partition sequentially and keeps that order up to the reporting queue
+func produce(message common_models.Message, traceParent string) error {
+	_, err := produceReported(message, traceParent, nil, nil)
+	return err
+}
+
+// Produces message reporting the delivery of every copy to deliveries, a nil
+// channel leaves the reports to the producer events. Copies for the topics
+// in skip aren't produced. Returns how many copies were produced
+func produceReported(message common_models.Message, traceParent string, deliveries chan kafka.Event, skip []string) (int, error) {
+	topics := router.Resolve(message)
+	produced := 0
 
 	for _, topic := range topics {
-		err = producerClient.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: -1},
-			Value:          []byte(result),
-		}, nil)
+		prepared, err := claimCheck.Prepare(topic, message)
+		if err != nil {
+			return produced, err
+		}
 
+		// Queues with priority lanes take urgent and bulk messages on separate topics
+		lane := topic
+		if laneQueues[topic] {
+			lane = common_models.LaneTopic(topic, message.Priority)
+		}
+		if contains(skip, lane) {
+			continue
+		}
+
+		result, err := codec.Serialize(lane, prepared)
 		if err != nil {
-			fmt.Println(err.Error())
+			return produced, err
 		}
 
+		err = producerClient.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &lane, Partition: kafka.PartitionAny},
+			Key:            message.PartitionKey(partitionKey),
+			Value:          result,
+			Headers:        common_kafka.HeadersFor(message, 1, traceParent),
+			Opaque:         message.Id,
+		}, deliveries)
+
+		if err != nil {
+			return produced, err
+		}
+		produced++
 	}
+
+	return produced, nil
 }
 
+// Blocks until the configuration and the brokers are available
 func setupEnvironment() (bool, error) {
-	url := "http://localhost:3010/config/kafka_service_config"
-	body, err := getRequest(url)
+	configuration, _ := provisionerClient.WaitForConfiguration(common_provisioner.KAFKA_SERVICE_CONFIG)
 
+	var err error
+	codec, err = common_serde.NewCodec(configuration)
 	if err != nil {
-		return false, errors.New("couldn't retrieve information form provisioning service")
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
 	}
 
-	if body["status"] == "successful" {
-		configuration := body["result"].(map[string]interface{})
+	claimCheck, err = common_claimcheck.NewClaimCheck(configuration)
+	if err != nil {
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
+	}
 
-		p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": configuration["kafka_host"]})
-		if err != nil {
-			panic(err)
-		}
+	routings := map[string][]string{}
+	routing_config, _ := configuration["routing"].([]interface{})
+	for _, element := range routing_config {
+		routing_map := element.(map[string]interface{})
+
+		routing := &models.Routing{}
+		mapstructure.Decode(routing_map, &routing)
+		routings[routing.Context] = routing.Targets
+	}
 
-		producerClient = p
+	rules := []models.RoutingRule{}
+	rules_config, _ := configuration["routing_rules"].([]interface{})
+	for _, element := range rules_config {
+		rule := models.RoutingRule{}
+		if err := mapstructure.Decode(element, &rule); err != nil {
+			err = fmt.Errorf("invalid routing rule: %v", err)
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+			return false, err
+		}
+		rules = append(rules, rule)
+	}
 
-		routing_config := configuration["routing"].([]interface{})
-		for _, element := range routing_config {
-			routing_map := element.(map[string]interface{})
+	var defaultRoute []string
+	mapstructure.Decode(configuration["default_route"], &defaultRoute)
 
-			routing := &models.Routing{}
-			mapstructure.Decode(routing_map, &routing)
-			routings[routing.Context] = routing.Targets
+	partitionKey = common_models.DEFAULT_PARTITION_KEY
+	if value, found := configuration["partition_key"]; found && value != "" {
+		key, _ := value.(string)
+		if !common_models.ValidPartitionKey(key) {
+			err = fmt.Errorf("invalid partition_key %v, use recipient, sender, type, metadata.<name> or none", value)
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+			return false, err
 		}
+		partitionKey = key
 	}
+	router = models.NewRouter(rules, routings, defaultRoute, partitionKey)
 
-	return true, nil
-}
+	queues := []struct {
+		Name          string
+		PriorityLanes bool `mapstructure:"priority_lanes"`
+	}{}
+	mapstructure.WeakDecode(configuration["queues"], &queues)
+	lanes := map[string]bool{}
+	for _, queue := range queues {
+		lanes[queue.Name] = queue.PriorityLanes
+	}
+	laneQueues = lanes
+
+	defaultCountryCode, _ = configuration["default_country_code"].(string)
+	reportingQueue, _ = configuration["reporting_queue"].(string)
 
-func getRequest(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+	settings := models.DefaultOtpSettings()
+	if err := mapstructure.Decode(configuration["otp"], &settings); err != nil {
+		err = fmt.Errorf("invalid otp settings: %v", err)
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
+	}
+	if err := settings.Validate(); err != nil {
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
+	}
+	otpSettings = settings
+
+	rateLimits, err = ratelimit.NewSettings(configuration)
 	if err != nil {
-		return map[string]interface{}{}, err
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
+	}
+	if rateLimits.Store == ratelimit.MONGO_STORE {
+		if err := ensureRateLimitIndexes(); err != nil {
+			common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+			return false, err
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	suppressionPolicy, err = newSuppressionPolicy(configuration)
 	if err != nil {
-		return map[string]interface{}{}, err
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
 	}
 
-	return toJson(string(body)), err
-}
+	deliverySchedule, err = models.NewDeliverySchedule(configuration)
+	if err != nil {
+		common_health.SetNotReady(common_provisioner.COMPONENT, err.Error())
+		return false, err
+	}
 
-func toJson(jsonString string) map[string]interface{} {
-	var result map[string]interface{}
-	json.Unmarshal([]byte(jsonString), &result)
-	return result
+	// Created last so a failed attempt doesn't leave a producer behind
+	p, err := common_kafka.NewProducer(configuration)
+	if err != nil {
+		common_health.SetNotReady(common_kafka.COMPONENT, err.Error())
+		return false, err
+	}
+	producerClient = p
+	go common_kafka.LogDeliveryReports(producerClient)
+	common_kafka.WaitForBrokers(producerClient)
+	go releaseDeferred()
+	go claimCheck.PurgeExpired()
+
+	return true, nil
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	ALLOW_SUPPRESSED  = "allow"
+	SUPPRESS          = "suppress"
+	REJECT_SUPPRESSED = "reject"
+)
+
+const SUPPRESSED_COLLECTION = "suppressed"
+
+// Short enough for an opt out to be honored within seconds
+const SUPPRESSION_CACHE_TTL = 30 * time.Second
+
+// Expired entries are swept every SUPPRESSION_CACHE_TTL, recipients past the
+// size are looked up without being cached until the next sweep
+const SUPPRESSION_CACHE_SIZE = 100000
+
+type cachedSuppressions struct {
+	suppressions []common_models.Suppression
+	expiresOn    time.Time
+}
+
+var suppressionCacheLock sync.Mutex
+var suppressionCache map[string]cachedSuppressions = make(map[string]cachedSuppressions)
+var suppressionCacheSweepOn time.Time
+
+// What happens to messages of each type sent to a suppressed recipient
+var suppressionPolicy map[string]string = defaultSuppressionPolicy()
+
+func defaultSuppressionPolicy() map[string]string {
+	return map[string]string{
+		common_models.Campaing:        SUPPRESS,
+		common_models.Transactional:   ALLOW_SUPPRESSED,
+		common_models.OneTimePassword: ALLOW_SUPPRESSED,
+	}
+}
+
+// Reads the suppression section, types it doesn't mention keep their default
+func newSuppressionPolicy(configuration map[string]interface{}) (map[string]string, error) {
+	policy := defaultSuppressionPolicy()
+	section, _ := configuration["suppression"].(map[string]interface{})
+	for messageType, value := range section {
+		action, _ := value.(string)
+		if action != ALLOW_SUPPRESSED && action != SUPPRESS && action != REJECT_SUPPRESSED {
+			return nil, fmt.Errorf("invalid suppression action %v for %s", value, messageType)
+		}
+		policy[messageType] = action
+	}
+
+	return policy, nil
+}
+
+func fetchSuppressions(recipient string) ([]common_models.Suppression, error) {
+	key := common_models.SuppressionKey(recipient, defaultCountryCode)
+
+	suppressionCacheLock.Lock()
+	cached, ok := suppressionCache[key]
+	suppressionCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expiresOn) {
+		return cached.suppressions, nil
+	}
+
+	endpoint, err := common_config.Endpoint(common_config.CORE_URL)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := provisionerClient.GetJSON(endpoint + "/suppression/" + url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+
+	suppressions := []common_models.Suppression{}
+	content, _ := json.Marshal(body["suppressions"])
+	if err := json.Unmarshal(content, &suppressions); err != nil {
+		return nil, err
+	}
+
+	cacheSuppressions(key, suppressions)
+
+	return suppressions, nil
+}
+
+func cacheSuppressions(key string, suppressions []common_models.Suppression) {
+	suppressionCacheLock.Lock()
+	defer suppressionCacheLock.Unlock()
+
+	now := time.Now()
+	if now.After(suppressionCacheSweepOn) {
+		for cachedKey, cached := range suppressionCache {
+			if now.After(cached.expiresOn) {
+				delete(suppressionCache, cachedKey)
+			}
+		}
+		suppressionCacheSweepOn = now.Add(SUPPRESSION_CACHE_TTL)
+	}
+
+	if _, ok := suppressionCache[key]; ok || len(suppressionCache) < SUPPRESSION_CACHE_SIZE {
+		suppressionCache[key] = cachedSuppressions{suppressions: suppressions, expiresOn: now.Add(SUPPRESSION_CACHE_TTL)}
+	}
+}
+
+// Checks message against the suppression list and returns the action of its
+// type's policy. Suppressed and rejected messages are recorded for audits
+func suppressionAction(db *mgo.Database, message *common_models.Message) (string, error) {
+	action, ok := suppressionPolicy[message.Type]
+	if !ok || action == ALLOW_SUPPRESSED {
+		return ALLOW_SUPPRESSED, nil
+	}
+
+	suppressions, err := fetchSuppressions(message.Recipient)
+	if err != nil {
+		return "", err
+	}
+
+	for _, suppression := range suppressions {
+		if !suppression.Applies(message.Sender) {
+			continue
+		}
+
+		message.Status = common_models.SUPPRESSED
+		if message.Metadata == nil {
+			message.Metadata = map[string]string{}
+		}
+		message.Metadata["suppression_reason"] = suppression.Reason
+		if err := db.C(SUPPRESSED_COLLECTION).Insert(message); err != nil {
+			return "", err
+		}
+		reportCampaignMessage(*message, common_models.SUPPRESSED)
+
+		return action, nil
+	}
+
+	return ALLOW_SUPPRESSED, nil
+}
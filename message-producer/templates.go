@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_provisioner "github.com/hectorandac/kafka-message-processor/common-provisioner"
+)
+
+const TEMPLATE_CACHE_TTL = time.Minute
+
+type cachedTemplate struct {
+	template  common_models.Template
+	expiresOn time.Time
+}
+
+var templateCacheLock sync.Mutex
+var templateCache map[string]cachedTemplate = make(map[string]cachedTemplate)
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Fetches a template from core, version 0 being the latest one. Answers are
+// cached for TEMPLATE_CACHE_TTL so a burst of messages costs a single lookup
+func fetchTemplate(templateId string, version int) (common_models.Template, error) {
+	cacheKey := templateId + "@" + strconv.Itoa(version)
+
+	templateCacheLock.Lock()
+	cached, ok := templateCache[cacheKey]
+	templateCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expiresOn) {
+		return cached.template, nil
+	}
+
+	endpoint, err := common_config.Endpoint(common_config.CORE_URL)
+	if err != nil {
+		return common_models.Template{}, err
+	}
+
+	address := endpoint + "/template/" + url.PathEscape(templateId)
+	if version > 0 {
+		address += "?version=" + strconv.Itoa(version)
+	}
+
+	body, err := provisionerClient.GetJSON(address)
+	if statusError, ok := err.(*common_provisioner.StatusError); ok && statusError.StatusCode == 404 {
+		return common_models.Template{}, ErrTemplateNotFound
+	} else if err != nil {
+		return common_models.Template{}, err
+	}
+
+	template := common_models.Template{}
+	content, _ := json.Marshal(body)
+	if err := json.Unmarshal(content, &template); err != nil {
+		return common_models.Template{}, err
+	}
+
+	templateCacheLock.Lock()
+	templateCache[cacheKey] = cachedTemplate{template: template, expiresOn: time.Now().Add(TEMPLATE_CACHE_TTL)}
+	templateCacheLock.Unlock()
+
+	return template, nil
+}
+
+// Replaces the body of a templated message by its rendered text. The
+// variables are dropped afterwards so they never reach the queues
+func renderTemplate(message *common_models.Message) error {
+	template, err := fetchTemplate(message.TemplateId, message.TemplateVersion)
+	if err != nil {
+		return err
+	}
+
+	locale := message.Locale
+	if locale == "" {
+		locale = message.Metadata["locale"]
+	}
+
+	text, err := template.Render(locale, message.Variables)
+	if err != nil {
+		return err
+	}
+
+	message.Message = text
+	message.TemplateVersion = template.Version
+	message.Variables = nil
+
+	return nil
+}
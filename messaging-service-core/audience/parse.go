@@ -0,0 +1,176 @@
+package audience
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+const NDJSON = "application/x-ndjson"
+const CSV = "text/csv"
+
+// Only the first rejected rows are reported back
+const MAX_REPORTED_ERRORS = 100
+
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Upload sums up a parsed audience, Errors lists the first rejected rows
+type Upload struct {
+	Accepted int64      `json:"accepted"`
+	Rejected int64      `json:"rejected"`
+	Errors   []RowError `json:"errors"`
+}
+
+func (upload *Upload) reject(line int, reason string) {
+	upload.Rejected++
+	if len(upload.Errors) < MAX_REPORTED_ERRORS {
+		upload.Errors = append(upload.Errors, RowError{Line: line, Error: reason})
+	}
+}
+
+type ndjsonRow struct {
+	Recipient string                 `json:"recipient"`
+	Locale    string                 `json:"locale"`
+	TimeZone  string                 `json:"time_zone"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Parse streams a CSV or NDJSON audience and hands members to batch by
+// groups of size. CSV files need a header, the recipient, locale and
+// time_zone columns fill their fields and every other column is a variable.
+// Recipients are normalized with defaultCountryCode like the producer does
+func Parse(body io.Reader, contentType string, defaultCountryCode string, size int, batch func([]models.CampaignRecipient) error) (*Upload, error) {
+	upload := &Upload{Errors: []RowError{}}
+	members := []models.CampaignRecipient{}
+
+	add := func(line int, member models.CampaignRecipient) error {
+		member.Recipient = common_models.NormalizeRecipient(member.Recipient, defaultCountryCode)
+		if !common_models.ValidRecipient(member.Recipient) {
+			upload.reject(line, "invalid recipient "+member.Recipient)
+			return nil
+		}
+
+		upload.Accepted++
+		members = append(members, member)
+		if len(members) < size {
+			return nil
+		}
+
+		err := batch(members)
+		members = []models.CampaignRecipient{}
+		return err
+	}
+
+	var err error
+	if strings.HasPrefix(contentType, CSV) {
+		err = parseCSV(body, upload, add)
+	} else if strings.HasPrefix(contentType, NDJSON) {
+		err = parseNDJSON(body, upload, add)
+	} else {
+		return nil, fmt.Errorf("unsupported content type %s, use %s or %s", contentType, CSV, NDJSON)
+	}
+	if err != nil {
+		return upload, err
+	}
+
+	if len(members) > 0 {
+		err = batch(members)
+	}
+
+	return upload, err
+}
+
+func parseCSV(body io.Reader, upload *Upload, add func(int, models.CampaignRecipient) error) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("couldn't read the CSV header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	recipientColumn := -1
+	for i, column := range header {
+		if strings.EqualFold(column, "recipient") {
+			recipientColumn = i
+		}
+	}
+	if recipientColumn < 0 {
+		return fmt.Errorf("the CSV header has no recipient column")
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				upload.reject(line, err.Error())
+				continue
+			}
+			return err
+		}
+
+		member := models.CampaignRecipient{Variables: map[string]string{}}
+		for i, value := range record {
+			if i >= len(header) {
+				break
+			}
+			switch strings.ToLower(header[i]) {
+			case "recipient":
+				member.Recipient = value
+			case "locale":
+				member.Locale = strings.TrimSpace(value)
+			case "time_zone":
+				member.TimeZone = strings.TrimSpace(value)
+			default:
+				member.Variables[header[i]] = value
+			}
+		}
+
+		if err := add(line, member); err != nil {
+			return err
+		}
+	}
+}
+
+func parseNDJSON(body io.Reader, upload *Upload, add func(int, models.CampaignRecipient) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		content := strings.TrimSpace(scanner.Text())
+		if content == "" {
+			continue
+		}
+
+		row := ndjsonRow{}
+		if err := json.Unmarshal([]byte(content), &row); err != nil {
+			upload.reject(line, err.Error())
+			continue
+		}
+
+		member := models.CampaignRecipient{Recipient: row.Recipient, Locale: row.Locale, TimeZone: row.TimeZone, Variables: map[string]string{}}
+		for name, value := range row.Variables {
+			member.Variables[name] = fmt.Sprint(value)
+		}
+
+		if err := add(line, member); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
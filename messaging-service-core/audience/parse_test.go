@@ -0,0 +1,159 @@
+package audience
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+// Collects the batch sizes and members handed over by Parse
+type recordingBatches struct {
+	sizes   []int
+	members []models.CampaignRecipient
+}
+
+func (batches *recordingBatches) batch(members []models.CampaignRecipient) error {
+	batches.sizes = append(batches.sizes, len(members))
+	batches.members = append(batches.members, members...)
+	return nil
+}
+
+func TestParseRejectsRows(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		accepted    int64
+		lines       []int
+	}{
+		{
+			name:        "csv invalid recipients",
+			contentType: CSV,
+			body:        "recipient,locale\n+18095551234,es\nnot a recipient,en\nUser@Example.com,en\nfoo@,en\n",
+			accepted:    2,
+			lines:       []int{3, 5},
+		},
+		{
+			name:        "csv malformed quotes",
+			contentType: CSV + "; charset=utf-8",
+			body:        "recipient\n+18095551234\n\"+1809\"5551235\n+18095551236\n",
+			accepted:    2,
+			lines:       []int{3},
+		},
+		{
+			name:        "ndjson malformed and invalid lines",
+			contentType: NDJSON,
+			body:        "{\"recipient\":\"+18095551234\"}\n{\"recipient\":\n\n{\"recipient\":\"12\"}\n{\"recipient\":\"user@example.com\"}\n",
+			accepted:    2,
+			lines:       []int{2, 4},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batches := &recordingBatches{}
+			upload, err := Parse(strings.NewReader(c.body), c.contentType, "1", 10, batches.batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if upload.Accepted != c.accepted || upload.Rejected != int64(len(c.lines)) {
+				t.Fatalf("accepted %d rejected %d, want %d and %d", upload.Accepted, upload.Rejected, c.accepted, len(c.lines))
+			}
+			for i, line := range c.lines {
+				if upload.Errors[i].Line != line {
+					t.Errorf("rejected line %d, want %d", upload.Errors[i].Line, line)
+				}
+			}
+			if int64(len(batches.members)) != c.accepted {
+				t.Errorf("batched %d members, want %d", len(batches.members), c.accepted)
+			}
+		})
+	}
+}
+
+func TestParseCSVColumns(t *testing.T) {
+	batches := &recordingBatches{}
+	body := "Recipient, locale ,time_zone,first_name\nUser@Example.com,es, America/Santo_Domingo ,Ana\n"
+	if _, err := Parse(strings.NewReader(body), CSV, "1", 10, batches.batch); err != nil {
+		t.Fatal(err)
+	}
+
+	member := batches.members[0]
+	if member.Recipient != "user@example.com" || member.Locale != "es" || member.TimeZone != "America/Santo_Domingo" {
+		t.Errorf("parsed %+v", member)
+	}
+	if len(member.Variables) != 1 || member.Variables["first_name"] != "Ana" {
+		t.Errorf("parsed variables %v", member.Variables)
+	}
+}
+
+func TestParseRefusesBadInput(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"unsupported content type": {"application/json", "[]"},
+		"csv without recipient":    {CSV, "email,locale\nuser@example.com,en\n"},
+		"empty csv":                {CSV, ""},
+	}
+
+	for name, c := range cases {
+		batches := &recordingBatches{}
+		if _, err := Parse(strings.NewReader(c.body), c.contentType, "1", 10, batches.batch); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+		if len(batches.sizes) != 0 {
+			t.Errorf("%s: batched %v", name, batches.sizes)
+		}
+	}
+}
+
+func TestParseBatches(t *testing.T) {
+	cases := []struct {
+		rows  int
+		size  int
+		sizes []int
+	}{
+		{rows: 7, size: 3, sizes: []int{3, 3, 1}},
+		{rows: 6, size: 3, sizes: []int{3, 3}},
+		{rows: 2, size: 5, sizes: []int{2}},
+		{rows: 0, size: 5, sizes: []int{}},
+	}
+
+	for _, c := range cases {
+		body := strings.Builder{}
+		for i := 0; i < c.rows; i++ {
+			body.WriteString("{\"recipient\":\"+1809555123" + string(rune('0'+i)) + "\"}\n")
+		}
+
+		batches := &recordingBatches{}
+		if _, err := Parse(strings.NewReader(body.String()), NDJSON, "1", c.size, batches.batch); err != nil {
+			t.Fatal(err)
+		}
+		if len(batches.sizes) != len(c.sizes) {
+			t.Fatalf("%d rows by %d: batched %v, want %v", c.rows, c.size, batches.sizes, c.sizes)
+		}
+		for i := range c.sizes {
+			if batches.sizes[i] != c.sizes[i] {
+				t.Errorf("%d rows by %d: batched %v, want %v", c.rows, c.size, batches.sizes, c.sizes)
+			}
+		}
+	}
+}
+
+func TestParseStopsOnBatchError(t *testing.T) {
+	failure := errors.New("store unavailable")
+	calls := 0
+	body := "{\"recipient\":\"+18095551230\"}\n{\"recipient\":\"+18095551231\"}\n{\"recipient\":\"+18095551232\"}\n"
+
+	_, err := Parse(strings.NewReader(body), NDJSON, "1", 1, func(members []models.CampaignRecipient) error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("got %v after %d batches, want the store error after the first", err, calls)
+	}
+}
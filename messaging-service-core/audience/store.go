@@ -0,0 +1,202 @@
+package audience
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	MONGO_STORE      = "mongo"
+	FILESYSTEM_STORE = "filesystem"
+)
+
+const RECIPIENT_COLLECTION = "campaign_recipient"
+
+// Row is an audience member with the checkpoint that resumes right after it
+type Row struct {
+	Member models.CampaignRecipient
+	Next   models.AudienceCheckpoint
+}
+
+// Store keeps the audiences of campaigns, rows are read back in the order
+// they were appended
+type Store interface {
+	Append(campaignId bson.ObjectId, members []models.CampaignRecipient) error
+	Read(campaignId bson.ObjectId, from models.AudienceCheckpoint, limit int) ([]Row, error)
+	Remove(campaignId bson.ObjectId) error
+}
+
+// Directory is only used by the filesystem store and must be shared by every core instance
+type Settings struct {
+	Type      string
+	Directory string
+}
+
+// NewSettings reads the audience_store section of the configuration
+func NewSettings(configuration map[string]interface{}) (Settings, error) {
+	settings := Settings{Type: MONGO_STORE, Directory: "audiences"}
+	if err := mapstructure.Decode(configuration["audience_store"], &settings); err != nil {
+		return settings, fmt.Errorf("invalid audience_store: %v", err)
+	}
+
+	if settings.Type != MONGO_STORE && settings.Type != FILESYSTEM_STORE {
+		return settings, fmt.Errorf("invalid audience_store type %s", settings.Type)
+	}
+
+	return settings, nil
+}
+
+// Open returns the store of storeType, campaigns remember the store their
+// audience was uploaded to so changing the configuration doesn't lose it
+func Open(db *mgo.Database, storeType string, settings Settings) (Store, error) {
+	switch storeType {
+	case MONGO_STORE:
+		return &MongoStore{Collection: db.C(RECIPIENT_COLLECTION)}, nil
+	case FILESYSTEM_STORE:
+		return &FileStore{Directory: settings.Directory}, nil
+	}
+
+	return nil, fmt.Errorf("unknown audience store %s", storeType)
+}
+
+// MongoStore keeps one document per member, which also records the outcome of its message
+type MongoStore struct {
+	Collection *mgo.Collection
+}
+
+func (store *MongoStore) Append(campaignId bson.ObjectId, members []models.CampaignRecipient) error {
+	store.Collection.EnsureIndex(mgo.Index{Key: []string{"campaign_id", "_id"}})
+
+	bulk := store.Collection.Bulk()
+	bulk.Unordered()
+	for _, member := range members {
+		member.Id = bson.NewObjectId()
+		member.CampaignId = campaignId
+		member.Status = models.RECIPIENT_PENDING
+		bulk.Insert(member)
+	}
+
+	_, err := bulk.Run()
+	return err
+}
+
+func (store *MongoStore) Read(campaignId bson.ObjectId, from models.AudienceCheckpoint, limit int) ([]Row, error) {
+	filter := bson.M{"campaign_id": campaignId}
+	if from.LastId != "" {
+		filter["_id"] = bson.M{"$gt": from.LastId}
+	}
+
+	members := []models.CampaignRecipient{}
+	if err := store.Collection.Find(filter).Sort("_id").Limit(limit).All(&members); err != nil {
+		return nil, err
+	}
+
+	rows := []Row{}
+	for i, member := range members {
+		rows = append(rows, Row{Member: member, Next: models.AudienceCheckpoint{LastId: member.Id, Rows: from.Rows + int64(i) + 1}})
+	}
+
+	return rows, nil
+}
+
+func (store *MongoStore) Remove(campaignId bson.ObjectId) error {
+	_, err := store.Collection.RemoveAll(bson.M{"campaign_id": campaignId})
+	return err
+}
+
+// FileStore appends the members of each campaign as NDJSON to a file of
+// Directory, checkpoints are byte offsets into it. Any core instance may fan
+// out a campaign so Directory has to be shared by all of them
+type FileStore struct {
+	Directory string
+}
+
+func (store *FileStore) path(campaignId bson.ObjectId) string {
+	return filepath.Join(store.Directory, campaignId.Hex()+".ndjson")
+}
+
+func (store *FileStore) Append(campaignId bson.ObjectId, members []models.CampaignRecipient) error {
+	if err := os.MkdirAll(store.Directory, 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(store.path(campaignId), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Written at once so the batch lands as whole lines even if another writer appends
+	batch := bytes.Buffer{}
+	encoder := json.NewEncoder(&batch)
+	for _, member := range members {
+		member.CampaignId = ""
+		member.Status = ""
+		if err := encoder.Encode(member); err != nil {
+			return err
+		}
+	}
+	if _, err := file.Write(batch.Bytes()); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func (store *FileStore) Read(campaignId bson.ObjectId, from models.AudienceCheckpoint, limit int) ([]Row, error) {
+	// A missing file is an error, read as empty it would complete the campaign
+	file, err := os.Open(store.path(campaignId))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("audience of campaign %s not found in %s, the directory must be shared by every core instance", campaignId.Hex(), store.Directory)
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(from.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	rows := []Row{}
+	reader := bufio.NewReader(file)
+	next := from
+	for len(rows) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		member := models.CampaignRecipient{}
+		if err := json.Unmarshal(line, &member); err != nil {
+			return nil, fmt.Errorf("corrupted audience at offset %d: %v", next.Offset, err)
+		}
+		member.CampaignId = campaignId
+
+		next.Offset += int64(len(line))
+		next.Rows++
+		rows = append(rows, Row{Member: member, Next: next})
+	}
+
+	return rows, nil
+}
+
+func (store *FileStore) Remove(campaignId bson.ObjectId) error {
+	err := os.Remove(store.path(campaignId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,105 @@
+package audience
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func members(recipients ...string) []models.CampaignRecipient {
+	list := []models.CampaignRecipient{}
+	for _, recipient := range recipients {
+		list = append(list, models.CampaignRecipient{Recipient: recipient, Variables: map[string]string{"name": recipient}})
+	}
+
+	return list
+}
+
+func TestFileStoreResumesFromCheckpoints(t *testing.T) {
+	store := &FileStore{Directory: t.TempDir() + "/audiences"}
+	campaignId := bson.NewObjectId()
+
+	if err := store.Append(campaignId, members("+18095551230", "+18095551231")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(campaignId, members("+18095551232", "user@example.com", "+18095551234")); err != nil {
+		t.Fatal(err)
+	}
+
+	read := []string{}
+	from := models.AudienceCheckpoint{}
+	for {
+		rows, err := store.Read(campaignId, from, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			if row.Member.CampaignId != campaignId || row.Member.Variables["name"] != row.Member.Recipient {
+				t.Errorf("read %+v", row.Member)
+			}
+			if row.Next.Offset <= from.Offset || row.Next.Rows != from.Rows+1 {
+				t.Errorf("checkpoint %+v doesn't follow %+v", row.Next, from)
+			}
+			read = append(read, row.Member.Recipient)
+			from = row.Next
+		}
+	}
+
+	expected := "+18095551230,+18095551231,+18095551232,user@example.com,+18095551234"
+	if strings.Join(read, ",") != expected {
+		t.Errorf("read %v, want %s", read, expected)
+	}
+	if from.Rows != 5 {
+		t.Errorf("final checkpoint counts %d rows", from.Rows)
+	}
+}
+
+func TestFileStoreReadsFromMidCheckpoint(t *testing.T) {
+	store := &FileStore{Directory: t.TempDir()}
+	campaignId := bson.NewObjectId()
+	if err := store.Append(campaignId, members("+18095551230", "+18095551231", "+18095551232")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := store.Read(campaignId, models.AudienceCheckpoint{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A checkpoint restored later resumes right after the row it was taken at
+	rest, err := store.Read(campaignId, first[0].Next, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 2 || rest[0].Member.Recipient != "+18095551231" || rest[1].Next.Rows != 3 {
+		t.Errorf("resumed with %+v", rest)
+	}
+}
+
+func TestFileStoreMissingAudience(t *testing.T) {
+	store := &FileStore{Directory: t.TempDir()}
+	campaignId := bson.NewObjectId()
+
+	if _, err := store.Read(campaignId, models.AudienceCheckpoint{}, 10); err == nil {
+		t.Error("a missing audience read as empty")
+	}
+	if err := store.Remove(campaignId); err != nil {
+		t.Errorf("removing a missing audience failed: %v", err)
+	}
+
+	if err := store.Append(campaignId, members("+18095551230")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove(campaignId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read(campaignId, models.AudienceCheckpoint{}, 10); err == nil {
+		t.Error("a removed audience is still readable")
+	}
+}
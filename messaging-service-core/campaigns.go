@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/audience"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+	"github.com/martini-contrib/render"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const CAMPAIGN_COLLECTION = "campaign"
+const CAMPAIGN_POLL_INTERVAL = 5 * time.Second
+const CAMPAIGN_COMPONENT = "campaigns"
+
+// Reports already counted, kept long enough to outlive any redelivery
+const CAMPAIGN_REPORT_COLLECTION = "campaign_report"
+const CAMPAIGN_REPORT_TTL = 7 * 24 * time.Hour
+
+// A fan out renews its lease every batch, an expired lease means its core instance is gone
+const CAMPAIGN_LEASE = 5 * time.Minute
+
+const MAX_AUDIENCE_BYTES = 1 << 30
+const AUDIENCE_BATCH_SIZE = 1000
+
+// An upload renews its lease every batch, an expired lease means its core instance is gone
+const AUDIENCE_UPLOAD_LEASE = 5 * time.Minute
+
+var errAudienceTooLarge = fmt.Errorf("audiences are limited to %d bytes", MAX_AUDIENCE_BYTES)
+
+// Fails the read once more than MAX_AUDIENCE_BYTES were read, so an oversize
+// body without a Content-Length is rejected instead of being truncated
+type audienceBody struct {
+	reader io.Reader
+	read   int64
+}
+
+func (body *audienceBody) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	body.read += int64(n)
+	if body.read > MAX_AUDIENCE_BYTES {
+		return n, errAudienceTooLarge
+	}
+
+	return n, err
+}
+
+// Not persisted, campaign_fanout section of the configuration. Rate is the
+// default number of messages per second of a campaign
+type fanOutSettings struct {
+	BatchSize int `mapstructure:"batch_size"`
+	Rate      float64
+}
+
+var producerHTTPClient *http.Client = &http.Client{Timeout: 10 * time.Second}
+var campaignWorkerId string = newCampaignWorkerId()
+
+func newCampaignWorkerId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), bson.NewObjectId().Hex())
+}
+
+func campaignFanOutSettings() fanOutSettings {
+	settings := fanOutSettings{BatchSize: 500, Rate: 50}
+	mapstructure.Decode(configuration["campaign_fanout"], &settings)
+	if settings.BatchSize < 1 {
+		settings.BatchSize = 500
+	}
+	if settings.Rate <= 0 {
+		settings.Rate = 50
+	}
+
+	return settings
+}
+
+func ensureCampaignIndexes(db *mgo.Database) {
+	db.C(CAMPAIGN_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"status", "scheduled_on"}})
+	db.C(audience.RECIPIENT_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"campaign_id", "_id"}})
+	db.C(CAMPAIGN_REPORT_COLLECTION).EnsureIndex(mgo.Index{Key: []string{"created_on"}, ExpireAfter: CAMPAIGN_REPORT_TTL})
+}
+
+func audienceStore(db *mgo.Database, campaign models.Campaign) (audience.Store, error) {
+	settings, err := audience.NewSettings(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return audience.Open(db, campaign.AudienceStore, settings)
+}
+
+func createCampaign(campaign models.Campaign, r render.Render, db *mgo.Database) {
+	if err := campaign.Validate(); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	settings, err := audience.NewSettings(configuration)
+	if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	ensureCampaignIndexes(db)
+
+	now := time.Now().UnixNano()
+	campaign.Id = bson.NewObjectId()
+	campaign.Status = models.CAMPAIGN_SCHEDULED
+	if campaign.Draft {
+		campaign.Status = models.CAMPAIGN_DRAFT
+	}
+	campaign.AudienceStore = settings.Type
+	campaign.Counters = models.CampaignCounters{}
+	campaign.Checkpoint = models.AudienceCheckpoint{}
+	campaign.LeaseOwner, campaign.LeaseUntil = "", 0
+	campaign.Upload = nil
+	campaign.CreatedOn = now
+	campaign.StartedOn, campaign.FinishedOn = 0, 0
+	if campaign.ScheduledOn == 0 {
+		campaign.ScheduledOn = now
+	}
+
+	store, err := audienceStore(db, campaign)
+	if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// The audience goes first so the campaign never starts with part of it
+	members := []models.CampaignRecipient{}
+	for _, member := range campaign.Audience {
+		member.Recipient = common_models.NormalizeRecipient(member.Recipient, defaultCountryCode())
+		if !common_models.ValidRecipient(member.Recipient) {
+			r.JSON(400, map[string]interface{}{"error": "invalid recipient " + member.Recipient})
+			return
+		}
+		members = append(members, member)
+	}
+	if len(members) > 0 {
+		if err := store.Append(campaign.Id, members); err != nil {
+			store.Remove(campaign.Id)
+			r.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+	campaign.Counters.Recipients = int64(len(members))
+
+	if err := db.C(CAMPAIGN_COLLECTION).Insert(campaign); err != nil {
+		store.Remove(campaign.Id)
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	campaign.Audience = nil
+	r.JSON(200, map[string]interface{}{"status": "successful", "campaign": campaign})
+}
+
+// Appends a CSV or NDJSON audience to a draft campaign, invalid rows are
+// skipped and reported by line. The upload holds a lease on the campaign so
+// it can't start while rows are still being appended, and a second upload
+// can't interleave its rows with them
+func uploadAudience(params martini.Params, req *http.Request, r render.Render, db *mgo.Database) {
+	if req.ContentLength > MAX_AUDIENCE_BYTES {
+		r.JSON(413, map[string]interface{}{"error": errAudienceTooLarge.Error()})
+		return
+	}
+	if !bson.IsObjectIdHex(params["campaign_id"]) {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+		return
+	}
+
+	campaign := models.Campaign{}
+	uploadId := bson.NewObjectId()
+	now := time.Now()
+	filter := bson.M{"_id": bson.ObjectIdHex(params["campaign_id"]), "status": models.CAMPAIGN_DRAFT, "upload.until": bson.M{"$not": bson.M{"$gt": now.UnixNano()}}}
+	lease := bson.M{"$set": bson.M{"upload": models.AudienceUpload{Id: uploadId, Until: now.Add(AUDIENCE_UPLOAD_LEASE).UnixNano()}}}
+	_, err := db.C(CAMPAIGN_COLLECTION).Find(filter).Apply(mgo.Change{Update: lease, ReturnNew: true}, &campaign)
+	if err == mgo.ErrNotFound {
+		r.JSON(409, map[string]interface{}{"error": "campaign not found, not a draft or already receiving an audience, audiences are uploaded one at a time to draft campaigns"})
+		return
+	} else if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	defer db.C(CAMPAIGN_COLLECTION).Update(bson.M{"_id": campaign.Id, "upload._id": uploadId}, bson.M{"$unset": bson.M{"upload": ""}})
+
+	store, err := audienceStore(db, campaign)
+	if err != nil {
+		r.JSON(500, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	body := &audienceBody{reader: req.Body}
+	upload, err := audience.Parse(body, req.Header.Get("Content-Type"), defaultCountryCode(), AUDIENCE_BATCH_SIZE, func(members []models.CampaignRecipient) error {
+		// Renewed before appending, a campaign started meanwhile gets no more rows
+		renew := bson.M{"$set": bson.M{"upload.until": time.Now().Add(AUDIENCE_UPLOAD_LEASE).UnixNano()}}
+		err := db.C(CAMPAIGN_COLLECTION).Update(bson.M{"_id": campaign.Id, "status": models.CAMPAIGN_DRAFT, "upload._id": uploadId}, renew)
+		if err == mgo.ErrNotFound {
+			return fmt.Errorf("campaign is no longer a draft or the upload lease expired")
+		} else if err != nil {
+			return err
+		}
+
+		if err := store.Append(campaign.Id, members); err != nil {
+			return err
+		}
+		return db.C(CAMPAIGN_COLLECTION).UpdateId(campaign.Id, bson.M{"$inc": bson.M{"counters.recipients": len(members)}})
+	})
+	if body.read > MAX_AUDIENCE_BYTES {
+		r.JSON(413, map[string]interface{}{"error": errAudienceTooLarge.Error(), "upload": upload})
+		return
+	}
+	if err != nil {
+		// Rows stored before the failure stay, they are part of the upload summary
+		r.JSON(400, map[string]interface{}{"error": err.Error(), "upload": upload})
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"status": "successful", "upload": upload})
+}
+
+// Schedules a draft campaign once its audience is uploaded, an upload still
+// in progress has to finish first
+func startCampaign(params martini.Params, r render.Render, db *mgo.Database) {
+	if !bson.IsObjectIdHex(params["campaign_id"]) {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+		return
+	}
+
+	campaign := models.Campaign{}
+	filter := bson.M{
+		"_id":          bson.ObjectIdHex(params["campaign_id"]),
+		"status":       models.CAMPAIGN_DRAFT,
+		"upload.until": bson.M{"$not": bson.M{"$gt": time.Now().UnixNano()}},
+	}
+	_, err := db.C(CAMPAIGN_COLLECTION).Find(filter).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"status": models.CAMPAIGN_SCHEDULED}, "$unset": bson.M{"upload": ""}}, ReturnNew: true}, &campaign)
+	if err == mgo.ErrNotFound {
+		r.JSON(409, map[string]interface{}{"error": "campaign not found, not a draft or its audience is still being uploaded"})
+	} else if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"status": "successful", "campaign": campaign})
+	}
+}
+
+func findCampaign(db *mgo.Database, id string) (models.Campaign, error) {
+	campaign := models.Campaign{}
+	if !bson.IsObjectIdHex(id) {
+		return campaign, mgo.ErrNotFound
+	}
+
+	err := db.C(CAMPAIGN_COLLECTION).FindId(bson.ObjectIdHex(id)).One(&campaign)
+	return campaign, err
+}
+
+func showCampaign(params martini.Params, r render.Render, db *mgo.Database) {
+	campaign, err := findCampaign(db, params["campaign_id"])
+	if err == mgo.ErrNotFound {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+	} else if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, campaign)
+	}
+}
+
+func listCampaigns(req *http.Request, r render.Render, db *mgo.Database) {
+	filter := bson.M{}
+	if status := req.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	campaigns := []models.Campaign{}
+	if err := db.C(CAMPAIGN_COLLECTION).Find(filter).Sort("-created_on").Limit(DEFAULT_PAGE_SIZE).All(&campaigns); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"campaigns": campaigns})
+	}
+}
+
+// Pages through the audience of a campaign, optionally of a single ?status=
+func campaignRecipients(params martini.Params, req *http.Request, r render.Render, db *mgo.Database) {
+	if !bson.IsObjectIdHex(params["campaign_id"]) {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+		return
+	}
+
+	campaign, err := findCampaign(db, params["campaign_id"])
+	if err != nil {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+		return
+	}
+	if campaign.AudienceStore != audience.MONGO_STORE {
+		r.JSON(400, map[string]interface{}{"error": "the audience of this campaign is stored on the filesystem, recipients aren't tracked"})
+		return
+	}
+
+	query := req.URL.Query()
+	skip, _ := strconv.Atoi(query.Get("skip"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+
+	filter := bson.M{"campaign_id": bson.ObjectIdHex(params["campaign_id"])}
+	if status := query.Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	recipients := []models.CampaignRecipient{}
+	if err := db.C(audience.RECIPIENT_COLLECTION).Find(filter).Sort("_id").Skip(skip).Limit(limit).All(&recipients); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"skip": skip, "limit": limit, "recipients": recipients})
+	}
+}
+
+// Stops the fan out, messages already queued are dropped by the dispatcher
+func cancelCampaign(params martini.Params, r render.Render, db *mgo.Database) {
+	if !bson.IsObjectIdHex(params["campaign_id"]) {
+		r.JSON(404, map[string]interface{}{"error": "campaign not found"})
+		return
+	}
+
+	filter := bson.M{"_id": bson.ObjectIdHex(params["campaign_id"]), "status": bson.M{"$in": []string{models.CAMPAIGN_DRAFT, models.CAMPAIGN_SCHEDULED, models.CAMPAIGN_RUNNING}}}
+	update := bson.M{"$set": bson.M{"status": models.CAMPAIGN_CANCELLED, "finished_on": time.Now().UnixNano()}}
+
+	campaign := models.Campaign{}
+	_, err := db.C(CAMPAIGN_COLLECTION).Find(filter).Apply(mgo.Change{Update: update, ReturnNew: true}, &campaign)
+	if err == mgo.ErrNotFound {
+		r.JSON(409, map[string]interface{}{"error": "campaign not found or already finished"})
+	} else if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"status": "successful", "campaign": campaign})
+	}
+}
+
+// Starts the campaigns that are due and fans out every running campaign
+// whose lease is free, each on its own goroutine
+func runCampaigns() {
+	var db *mgo.Database
+	var session *mgo.Session
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		var err error
+		db, session, err = common_mongo.Connect(DATABASE)
+		if err != nil {
+			fmt.Printf("Couldn't connect to run campaigns (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(CAMPAIGN_COMPONENT, err.Error())
+			return err
+		}
+
+		common_health.SetReady(CAMPAIGN_COMPONENT)
+		return nil
+	})
+	defer session.Close()
+	ensureCampaignIndexes(db)
+
+	for {
+		now := time.Now()
+		db.C(CAMPAIGN_COLLECTION).UpdateAll(
+			bson.M{"status": models.CAMPAIGN_SCHEDULED, "scheduled_on": bson.M{"$lte": now.UnixNano()}},
+			bson.M{"$set": bson.M{"status": models.CAMPAIGN_RUNNING, "started_on": now.UnixNano()}},
+		)
+
+		for {
+			campaign := models.Campaign{}
+			_, err := db.C(CAMPAIGN_COLLECTION).
+				Find(bson.M{"status": models.CAMPAIGN_RUNNING, "lease_until": bson.M{"$lt": now.UnixNano()}}).
+				Apply(mgo.Change{Update: bson.M{"$set": bson.M{"lease_owner": campaignWorkerId, "lease_until": now.Add(CAMPAIGN_LEASE).UnixNano()}}, ReturnNew: true}, &campaign)
+			if err == mgo.ErrNotFound {
+				break
+			} else if err != nil {
+				fmt.Printf("Couldn't read campaigns: %v\n", err)
+				session.Refresh()
+				break
+			}
+
+			go func(campaign models.Campaign) {
+				fanOutSession := session.Copy()
+				defer fanOutSession.Close()
+
+				if err := fanOut(fanOutSession.DB(DATABASE), campaign); err != nil {
+					fmt.Printf("Campaign %s paused: %v\n", campaign.Id.Hex(), err)
+				}
+				releaseLease(fanOutSession.DB(DATABASE), campaign.Id)
+			}(campaign)
+		}
+
+		time.Sleep(CAMPAIGN_POLL_INTERVAL)
+	}
+}
+
+func releaseLease(db *mgo.Database, id bson.ObjectId) {
+	db.C(CAMPAIGN_COLLECTION).Update(
+		bson.M{"_id": id, "lease_owner": campaignWorkerId},
+		bson.M{"$set": bson.M{"lease_owner": "", "lease_until": int64(0)}},
+	)
+}
+
+// Sends the audience of campaign from its checkpoint in throttled batches.
+// The checkpoint and the counters of a batch are saved together, a fan out
+// resuming after a crash repeats at most the unsaved batch and the producer
+// drops the messages it already accepted for the campaign. Returns when the
+// audience is exhausted, the campaign is cancelled or the producer asks to
+// slow down
+func fanOut(db *mgo.Database, campaign models.Campaign) error {
+	settings := campaignFanOutSettings()
+	rate := settings.Rate
+	if campaign.Rate > 0 {
+		rate = campaign.Rate
+	}
+
+	store, err := audienceStore(db, campaign)
+	if err != nil {
+		return err
+	}
+
+	owned := bson.M{"_id": campaign.Id, "status": models.CAMPAIGN_RUNNING, "lease_owner": campaignWorkerId}
+	for {
+		current := models.Campaign{}
+		renew := bson.M{"$set": bson.M{"lease_until": time.Now().Add(CAMPAIGN_LEASE).UnixNano()}}
+		_, err := db.C(CAMPAIGN_COLLECTION).Find(owned).Apply(mgo.Change{Update: renew, ReturnNew: true}, &current)
+		if err == mgo.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Campaigns without recipients may have no audience file at all
+		rows := []audience.Row{}
+		if current.Counters.Recipients > 0 {
+			rows, err = store.Read(current.Id, current.Checkpoint, settings.BatchSize)
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) == 0 {
+			return db.C(CAMPAIGN_COLLECTION).Update(owned, bson.M{"$set": bson.M{"status": models.CAMPAIGN_COMPLETED, "finished_on": time.Now().UnixNano()}})
+		}
+
+		started := time.Now()
+		checkpoint := current.Checkpoint
+		counters := map[string]int{}
+		outcomes := db.C(audience.RECIPIENT_COLLECTION).Bulk()
+		outcomes.Unordered()
+
+		updated := 0
+		var sendError error
+		for _, row := range rows {
+			counter, outcome, err := sendCampaignMessage(current, row.Member)
+			if err != nil {
+				sendError = err
+				break
+			}
+
+			if counter != "" {
+				counters[counter]++
+			}
+			if current.AudienceStore == audience.MONGO_STORE && outcome != nil {
+				updated++
+				outcomes.Update(bson.M{"_id": row.Member.Id}, bson.M{"$set": outcome})
+			}
+			checkpoint = row.Next
+		}
+
+		progress := bson.M{"$set": bson.M{"checkpoint": checkpoint}}
+		if len(counters) > 0 {
+			increments := bson.M{}
+			for counter, count := range counters {
+				increments["counters."+counter] = count
+			}
+			progress["$inc"] = increments
+		}
+		if err := db.C(CAMPAIGN_COLLECTION).Update(bson.M{"_id": campaign.Id, "lease_owner": campaignWorkerId}, progress); err != nil {
+			return err
+		}
+		if current.AudienceStore == audience.MONGO_STORE && updated > 0 {
+			outcomes.Run()
+		}
+
+		if sendError != nil {
+			return sendError
+		}
+
+		if pause := time.Duration(float64(len(rows))/rate*float64(time.Second)) - time.Since(started); pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+}
+
+// Hands one message to the producer, returning the counter and recipient
+// fields its outcome updates. Queued and suppressed messages are counted from
+// the producer's reports so they have no counter here. Throttled or unavailable producers return an
+// error so the fan out resumes from this recipient on the next round
+func sendCampaignMessage(campaign models.Campaign, member models.CampaignRecipient) (string, bson.M, error) {
+	message := common_models.Message{
+		Recipient:       member.Recipient,
+		Sender:          campaign.Sender,
+		Type:            common_models.Campaing,
+		TemplateId:      campaign.TemplateId,
+		TemplateVersion: campaign.TemplateVersion,
+		Locale:          member.Locale,
+		TimeZone:        member.TimeZone,
+		Variables:       member.Variables,
+		Priority:        campaign.Priority,
+		CampaignId:      campaign.Id.Hex(),
+	}
+
+	status, body, err := postToProducer(message)
+	if err != nil {
+		return "", nil, err
+	}
+	if status == 429 || status >= 500 {
+		return "", nil, fmt.Errorf("producer answered %d: %v", status, body["error"])
+	}
+	// Already accepted before a resumed fan out, its outcome was recorded then
+	if status == 200 && body["result"] == "duplicate" {
+		return "", nil, nil
+	}
+
+	switch {
+	case status == 403 || (status == 200 && body["result"] == common_models.SUPPRESSED):
+		return "", bson.M{"status": models.RECIPIENT_SUPPRESSED, "message_id": fmt.Sprint(body["message_id"])}, nil
+	case status == 200:
+		outcome := bson.M{"status": models.RECIPIENT_QUEUED}
+		if produced, ok := body["message"].(map[string]interface{}); ok {
+			outcome["message_id"] = fmt.Sprint(produced["_id"])
+		}
+		return "", outcome, nil
+	}
+
+	return "failed", bson.M{"status": models.RECIPIENT_FAILED, "error": fmt.Sprint(body["error"])}, nil
+}
+
+func postToProducer(message common_models.Message) (int, map[string]interface{}, error) {
+	endpoint, err := common_config.Endpoint(common_config.PRODUCER_URL)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	content, err := json.Marshal(message)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := producerHTTPClient.Post(endpoint+"/message", "application/json", bytes.NewReader(content))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	return resp.StatusCode, body, nil
+}
+
+// Counts the outcome reported for a campaign message, the producer reports
+// it queued or suppressed and the dispatcher how it was delivered. Reports are
+// read at least once so each message and status is counted a single time
+func countReport(db *mgo.Database, headers common_kafka.MessageHeaders) {
+	if !bson.IsObjectIdHex(headers.CampaignId) {
+		return
+	}
+
+	var counter string
+	switch headers.Status {
+	case "":
+		// The dispatcher reports the messages it sent without a status
+		counter = "counters.delivered"
+	case common_models.QUEUED:
+		counter = "counters.queued"
+	case common_models.SUPPRESSED:
+		counter = "counters.suppressed"
+	case common_models.CANCELLED:
+		counter = "counters.cancelled"
+	case common_models.FAILED:
+		counter = "counters.failed"
+	default:
+		fmt.Printf("Ignored report of campaign %s with unknown status %s\n", headers.CampaignId, headers.Status)
+		return
+	}
+
+	if headers.MessageId != "" {
+		report := bson.M{"_id": headers.MessageId + ":" + headers.Status, "created_on": time.Now()}
+		if err := db.C(CAMPAIGN_REPORT_COLLECTION).Insert(report); mgo.IsDup(err) {
+			return
+		} else if err != nil {
+			fmt.Printf("Couldn't record report of campaign %s: %v\n", headers.CampaignId, err)
+			return
+		}
+	}
+
+	if err := db.C(CAMPAIGN_COLLECTION).UpdateId(bson.ObjectIdHex(headers.CampaignId), bson.M{"$inc": bson.M{counter: 1}}); err != nil && err != mgo.ErrNotFound {
+		fmt.Printf("Couldn't count report of campaign %s: %v\n", headers.CampaignId, err)
+	}
+}
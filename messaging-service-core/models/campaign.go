@@ -0,0 +1,111 @@
+package models
+
+import (
+	"fmt"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	CAMPAIGN_DRAFT     = "draft"
+	CAMPAIGN_SCHEDULED = "scheduled"
+	CAMPAIGN_RUNNING   = "running"
+	CAMPAIGN_COMPLETED = "completed"
+	CAMPAIGN_CANCELLED = common_models.CANCELLED
+)
+
+const (
+	RECIPIENT_PENDING    = "pending"
+	RECIPIENT_QUEUED     = "queued"
+	RECIPIENT_SUPPRESSED = "suppressed"
+	RECIPIENT_FAILED     = "failed"
+)
+
+// Counted from the reporting queue, queued and suppressed once the producer
+// reports a message, delivered, failed and cancelled once the dispatcher does.
+// Messages the producer rejects are counted as failed by the fan out
+type CampaignCounters struct {
+	Recipients int64 `json:"recipients" bson:"recipients"`
+	Queued     int64 `json:"queued" bson:"queued"`
+	Delivered  int64 `json:"delivered" bson:"delivered"`
+	Failed     int64 `json:"failed" bson:"failed"`
+	Suppressed int64 `json:"suppressed" bson:"suppressed"`
+	Cancelled  int64 `json:"cancelled" bson:"cancelled"`
+}
+
+// AudienceCheckpoint is the position of the fan out in the audience, LastId
+// for audiences stored in Mongo and Offset in bytes for audience files
+type AudienceCheckpoint struct {
+	LastId bson.ObjectId `json:"last_id,omitempty" bson:"last_id,omitempty"`
+	Offset int64         `json:"offset" bson:"offset"`
+	Rows   int64         `json:"rows" bson:"rows"`
+}
+
+// AudienceUpload is the upload in progress, renewed every batch. A draft
+// campaign takes one upload at a time and can't start while it holds a lease
+type AudienceUpload struct {
+	Id    bson.ObjectId `json:"_id" bson:"_id"`
+	Until int64         `json:"until" bson:"until"`
+}
+
+// Campaign sends a template to every recipient of its audience once
+// ScheduledOn is reached, each message carries the campaign id. Draft
+// campaigns wait for their audience to be uploaded and started
+type Campaign struct {
+	Id              bson.ObjectId       `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name            string              `json:"name" form:"name" binding:"required" bson:"name"`
+	Sender          string              `json:"sender" form:"sender" binding:"required" bson:"sender"`
+	TemplateId      string              `json:"template_id" form:"template_id" binding:"required" bson:"template_id"`
+	TemplateVersion int                 `json:"template_version,omitempty" form:"template_version" bson:"template_version,omitempty"`
+	Priority        string              `json:"priority,omitempty" form:"priority" bson:"priority,omitempty"`
+	ScheduledOn     int64               `json:"scheduled_on" form:"scheduled_on" bson:"scheduled_on"`
+	Status          string              `json:"status" bson:"status"`
+	Counters        CampaignCounters    `json:"counters" bson:"counters"`
+	Audience        []CampaignRecipient `json:"audience,omitempty" bson:"-"`
+	Draft           bool                `json:"draft,omitempty" form:"draft" bson:"-"`
+	AudienceStore   string              `json:"audience_store,omitempty" bson:"audience_store,omitempty"`
+	Checkpoint      AudienceCheckpoint  `json:"checkpoint" bson:"checkpoint"`
+	LeaseOwner      string              `json:"lease_owner,omitempty" bson:"lease_owner,omitempty"`
+	LeaseUntil      int64               `json:"lease_until,omitempty" bson:"lease_until"`
+	Upload          *AudienceUpload     `json:"upload,omitempty" bson:"upload,omitempty"`
+	Rate            float64             `json:"rate,omitempty" form:"rate" bson:"rate,omitempty"`
+	CreatedOn       int64               `json:"created_on" bson:"created_on"`
+	StartedOn       int64               `json:"started_on,omitempty" bson:"started_on,omitempty"`
+	FinishedOn      int64               `json:"finished_on,omitempty" bson:"finished_on,omitempty"`
+}
+
+// CampaignRecipient is an audience member, stored apart from the campaign so
+// audiences aren't bound by the document size limit
+type CampaignRecipient struct {
+	Id         bson.ObjectId     `json:"_id,omitempty" bson:"_id,omitempty"`
+	CampaignId bson.ObjectId     `json:"campaign_id,omitempty" bson:"campaign_id"`
+	Recipient  string            `json:"recipient" bson:"recipient"`
+	Variables  map[string]string `json:"variables,omitempty" bson:"variables,omitempty"`
+	Locale     string            `json:"locale,omitempty" bson:"locale,omitempty"`
+	TimeZone   string            `json:"time_zone,omitempty" bson:"time_zone,omitempty"`
+	Status     string            `json:"status" bson:"status"`
+	MessageId  string            `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	Error      string            `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+func (c *Campaign) Validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("rate can not be negative")
+	}
+	if c.Priority != "" && !contains(common_models.PRIORITIES, c.Priority) {
+		return fmt.Errorf("invalid priority %s", c.Priority)
+	}
+	for _, member := range c.Audience {
+		if member.Recipient == "" {
+			return fmt.Errorf("audience members need a recipient")
+		}
+	}
+
+	return nil
+}
+
+// Finished tells if the campaign won't send any further message
+func (c *Campaign) Finished() bool {
+	return c.Status == CAMPAIGN_COMPLETED || c.Status == CAMPAIGN_CANCELLED
+}
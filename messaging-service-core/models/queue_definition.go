@@ -0,0 +1,100 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+)
+
+// Not persisted, queue entry of the provisioner configuration
+type QueueDefinition struct {
+	Name              string
+	Partitions        int
+	Priority          float64
+	ReplicationFactor int               `mapstructure:"replication_factor"`
+	RetentionMs       *int64            `mapstructure:"retention_ms"`
+	MinInsyncReplicas int               `mapstructure:"min_insync_replicas"`
+	CompressionType   string            `mapstructure:"compression_type"`
+	CleanupPolicy     string            `mapstructure:"cleanup_policy"`
+	Config            map[string]string `mapstructure:"config"`
+	PriorityLanes     bool              `mapstructure:"priority_lanes"`
+}
+
+// TopicSpec translates the definition into the topic settings managed by the
+// reconciler, the named settings take precedence over the raw config entries
+func (q *QueueDefinition) TopicSpec() TopicSpec {
+	config := map[string]string{}
+	for name, value := range q.Config {
+		config[name] = value
+	}
+
+	if q.RetentionMs != nil {
+		config["retention.ms"] = strconv.FormatInt(*q.RetentionMs, 10)
+	}
+	if q.MinInsyncReplicas > 0 {
+		config["min.insync.replicas"] = strconv.Itoa(q.MinInsyncReplicas)
+	}
+	if q.CompressionType != "" {
+		config["compression.type"] = q.CompressionType
+	}
+	if q.CleanupPolicy != "" {
+		config["cleanup.policy"] = q.CleanupPolicy
+	}
+
+	return TopicSpec{Name: q.Name, Partitions: q.Partitions, ReplicationFactor: q.ReplicationFactor, Config: config}
+}
+
+// Lanes lists the topics consumers of the queue read, the most urgent first
+func (q *QueueDefinition) Lanes() []string {
+	if !q.PriorityLanes {
+		return []string{q.Name}
+	}
+
+	return common_models.LaneTopics(q.Name)
+}
+
+// TopicSpecs returns the spec of every lane of the queue, lanes share its settings
+func (q *QueueDefinition) TopicSpecs() []TopicSpec {
+	specs := []TopicSpec{}
+	for _, lane := range q.Lanes() {
+		spec := q.TopicSpec()
+		spec.Name = lane
+		specs = append(specs, spec)
+	}
+
+	return specs
+}
+
+var compressionTypes = []string{"producer", "uncompressed", "gzip", "snappy", "lz4", "zstd"}
+var cleanupPolicies = []string{"delete", "compact", "compact,delete", "delete,compact"}
+
+func (q *QueueDefinition) Validate() error {
+	if q.Name == "" {
+		return fmt.Errorf("queue definition without a name")
+	}
+	if q.Partitions < 1 {
+		return fmt.Errorf("queue %s needs at least one partition", q.Name)
+	}
+	if q.ReplicationFactor > 0 && q.MinInsyncReplicas > q.ReplicationFactor {
+		return fmt.Errorf("queue %s has min_insync_replicas above its replication factor", q.Name)
+	}
+	if q.CompressionType != "" && !contains(compressionTypes, q.CompressionType) {
+		return fmt.Errorf("queue %s has an unknown compression_type %s", q.Name, q.CompressionType)
+	}
+	if q.CleanupPolicy != "" && !contains(cleanupPolicies, q.CleanupPolicy) {
+		return fmt.Errorf("queue %s has an unknown cleanup_policy %s", q.Name, q.CleanupPolicy)
+	}
+
+	return nil
+}
+
+func contains(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+
+	return false
+}
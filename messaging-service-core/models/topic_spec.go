@@ -0,0 +1,9 @@
+package models
+
+// Not persisted, desired state of a topic
+type TopicSpec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	Config            map[string]string
+}
@@ -0,0 +1,109 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+const DEFAULT_REPLICATION_FACTOR = 1
+
+// Apply executes every action of the plan that wasn't refused, the outcome
+// of each one is recorded on the plan and the first failure is returned
+func Apply(adminClient *kafka.AdminClient, plan *Plan) error {
+	var firstError error
+
+	for i := range plan.Actions {
+		action := &plan.Actions[i]
+		if action.Refused {
+			continue
+		}
+
+		err := applyAction(adminClient, action)
+		if err != nil {
+			action.Error = err.Error()
+			if firstError == nil {
+				firstError = fmt.Errorf("%s on %s: %v", action.Type, action.Topic, err)
+			}
+		} else {
+			action.Applied = true
+		}
+	}
+
+	return firstError
+}
+
+func applyAction(adminClient *kafka.AdminClient, action *Action) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch action.Type {
+	case CREATE_TOPIC:
+		return createTopic(ctx, adminClient, action.spec)
+	case CREATE_PARTITIONS:
+		results, err := adminClient.CreatePartitions(ctx, []kafka.PartitionsSpecification{{Topic: action.Topic, IncreaseTo: action.spec.Partitions}})
+		return topicResultError(results, err)
+	case ALTER_CONFIGS:
+		resource := kafka.ConfigResource{
+			Type:   kafka.ResourceTopic,
+			Name:   action.Topic,
+			Config: kafka.StringMapToConfigEntries(action.Config, kafka.AlterOperationSet),
+		}
+		results, err := adminClient.AlterConfigs(ctx, []kafka.ConfigResource{resource})
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if result.Error.Code() != kafka.ErrNoError {
+				return result.Error
+			}
+		}
+		return nil
+	case RECREATE_TOPIC:
+		results, err := adminClient.DeleteTopics(ctx, []string{action.Topic})
+		if err := topicResultError(results, err); err != nil {
+			return err
+		}
+
+		// Deletion completes asynchronously on the brokers
+		return common_retry.Retry(common_retry.DefaultBackoff(), 10, func(attempt int) error {
+			return createTopic(ctx, adminClient, action.spec)
+		})
+	}
+
+	return fmt.Errorf("unknown action %s", action.Type)
+}
+
+func createTopic(ctx context.Context, adminClient *kafka.AdminClient, spec models.TopicSpec) error {
+	replication := spec.ReplicationFactor
+	if replication <= 0 {
+		replication = DEFAULT_REPLICATION_FACTOR
+	}
+
+	results, err := adminClient.CreateTopics(ctx, []kafka.TopicSpecification{{
+		Topic:             spec.Name,
+		NumPartitions:     spec.Partitions,
+		ReplicationFactor: replication,
+		Config:            spec.Config,
+	}})
+
+	return topicResultError(results, err)
+}
+
+func topicResultError(results []kafka.TopicResult, err error) error {
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return result.Error
+		}
+	}
+
+	return nil
+}
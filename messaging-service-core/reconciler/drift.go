@@ -0,0 +1,71 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+type Difference struct {
+	Setting string `json:"setting"`
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+}
+
+type TopicDrift struct {
+	Topic       string       `json:"topic"`
+	Missing     bool         `json:"missing"`
+	Differences []Difference `json:"differences"`
+}
+
+// Drift compares the live topics with the desired state, topics matching it are left out
+func Drift(ctx context.Context, adminClient *kafka.AdminClient, specs []models.TopicSpec) ([]TopicDrift, error) {
+	md, err := adminClient.GetMetadata(nil, true, 5000)
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[string]kafka.TopicMetadata{}
+	for _, t := range md.Topics {
+		live[t.Topic] = t
+	}
+
+	drifts := []TopicDrift{}
+	for _, spec := range specs {
+		current, found := live[spec.Name]
+		if !found {
+			drifts = append(drifts, TopicDrift{Topic: spec.Name, Missing: true, Differences: []Difference{}})
+			continue
+		}
+
+		differences := []Difference{}
+		if len(current.Partitions) != spec.Partitions {
+			differences = append(differences, Difference{Setting: "partitions", Desired: fmt.Sprint(spec.Partitions), Actual: fmt.Sprint(len(current.Partitions))})
+		}
+
+		if spec.ReplicationFactor > 0 && replicationFactor(current) != spec.ReplicationFactor {
+			differences = append(differences, Difference{Setting: "replication_factor", Desired: fmt.Sprint(spec.ReplicationFactor), Actual: fmt.Sprint(replicationFactor(current))})
+		}
+
+		if len(spec.Config) > 0 {
+			config, err := describeTopicConfig(ctx, adminClient, spec.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			for name, value := range spec.Config {
+				if config[name].Value != value {
+					differences = append(differences, Difference{Setting: name, Desired: value, Actual: config[name].Value})
+				}
+			}
+		}
+
+		if len(differences) > 0 {
+			drifts = append(drifts, TopicDrift{Topic: spec.Name, Differences: differences})
+		}
+	}
+
+	return drifts, nil
+}
@@ -0,0 +1,200 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+const (
+	CREATE_TOPIC      = "create_topic"
+	CREATE_PARTITIONS = "create_partitions"
+	ALTER_CONFIGS     = "alter_configs"
+	RECREATE_TOPIC    = "recreate_topic"
+)
+
+type Action struct {
+	Topic       string            `json:"topic"`
+	Type        string            `json:"type"`
+	Description string            `json:"description"`
+	Destructive bool              `json:"destructive"`
+	Refused     bool              `json:"refused"`
+	Applied     bool              `json:"applied"`
+	Error       string            `json:"error,omitempty"`
+	Config      map[string]string `json:"config,omitempty"`
+
+	spec models.TopicSpec
+}
+
+// Plan lists the changes needed to bring the live topics to the desired state,
+// destructive actions are refused unless the plan was built with Force
+type Plan struct {
+	Force   bool     `json:"force"`
+	Actions []Action `json:"actions"`
+}
+
+func (p *Plan) Refused() []Action {
+	refused := []Action{}
+	for _, action := range p.Actions {
+		if action.Refused {
+			refused = append(refused, action)
+		}
+	}
+
+	return refused
+}
+
+func BuildPlan(ctx context.Context, adminClient *kafka.AdminClient, specs []models.TopicSpec, force bool) (*Plan, error) {
+	md, err := adminClient.GetMetadata(nil, true, 5000)
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[string]kafka.TopicMetadata{}
+	for _, t := range md.Topics {
+		live[t.Topic] = t
+	}
+
+	return planTopics(live, specs, force, func(topic string) (map[string]kafka.ConfigEntryResult, error) {
+		return describeTopicConfig(ctx, adminClient, topic)
+	})
+}
+
+// Compares specs with the live topics, describe returns the configuration of
+// a live topic. Live topics without a spec are left alone
+func planTopics(live map[string]kafka.TopicMetadata, specs []models.TopicSpec, force bool, describe func(topic string) (map[string]kafka.ConfigEntryResult, error)) (*Plan, error) {
+	plan := &Plan{Force: force, Actions: []Action{}}
+	for _, spec := range specs {
+		current, found := live[spec.Name]
+		if !found {
+			plan.add(Action{Topic: spec.Name, Type: CREATE_TOPIC, Description: fmt.Sprintf("create with %d partitions", spec.Partitions), spec: spec})
+			continue
+		}
+
+		reasons := []string{}
+		currentPartitions := len(current.Partitions)
+		if spec.Partitions < currentPartitions {
+			reasons = append(reasons, fmt.Sprintf("partitions can't shrink from %d to %d", currentPartitions, spec.Partitions))
+		}
+
+		currentReplication := replicationFactor(current)
+		if spec.ReplicationFactor > 0 && spec.ReplicationFactor != currentReplication {
+			reasons = append(reasons, fmt.Sprintf("replication factor changes from %d to %d", currentReplication, spec.ReplicationFactor))
+		}
+
+		if len(reasons) > 0 {
+			description := strings.Join(reasons, ", ") + ", the topic and its pending messages would be deleted"
+			plan.add(Action{Topic: spec.Name, Type: RECREATE_TOPIC, Description: description, Destructive: true, Refused: !force, spec: spec})
+			if force {
+				continue
+			}
+		}
+
+		if spec.Partitions > currentPartitions {
+			plan.add(Action{Topic: spec.Name, Type: CREATE_PARTITIONS, Description: fmt.Sprintf("increase partitions from %d to %d", currentPartitions, spec.Partitions), spec: spec})
+		}
+
+		if len(spec.Config) > 0 {
+			current, err := describe(spec.Name)
+			if err != nil {
+				return nil, err
+			}
+			if action := configAction(spec, current, force); action != nil {
+				plan.add(*action)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+func (p *Plan) add(action Action) {
+	p.Actions = append(p.Actions, action)
+}
+
+// AlterConfigs replaces every topic override, so the action carries the
+// current dynamic configuration with the desired values on top of it
+func configAction(spec models.TopicSpec, current map[string]kafka.ConfigEntryResult, force bool) *Action {
+	changes := []string{}
+	destructive := false
+	config := map[string]string{}
+	for name, entry := range current {
+		if entry.Source == kafka.ConfigSourceDynamicTopic {
+			config[name] = entry.Value
+		}
+	}
+
+	for name, value := range spec.Config {
+		previous := current[name].Value
+		if previous == value {
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, previous, value))
+		destructive = destructive || destructiveConfigChange(name, previous, value)
+		config[name] = value
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return &Action{
+		Topic:       spec.Name,
+		Type:        ALTER_CONFIGS,
+		Description: strings.Join(changes, ", "),
+		Destructive: destructive,
+		Refused:     destructive && !force,
+		Config:      config,
+		spec:        spec,
+	}
+}
+
+func describeTopicConfig(ctx context.Context, adminClient *kafka.AdminClient, topic string) (map[string]kafka.ConfigEntryResult, error) {
+	results, err := adminClient.DescribeConfigs(ctx, []kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) == 0 {
+		return map[string]kafka.ConfigEntryResult{}, nil
+	}
+
+	if results[0].Error.Code() != kafka.ErrNoError {
+		return nil, results[0].Error
+	}
+
+	return results[0].Config, nil
+}
+
+// Shorter retention or a different cleanup policy make the broker drop messages
+func destructiveConfigChange(name string, previous string, value string) bool {
+	switch name {
+	case "retention.ms", "retention.bytes":
+		previousLimit, pErr := strconv.ParseInt(previous, 10, 64)
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if pErr != nil || err != nil {
+			return true
+		}
+		if limit < 0 {
+			return false
+		}
+		return previousLimit < 0 || limit < previousLimit
+	case "cleanup.policy":
+		return previous != ""
+	}
+
+	return false
+}
+
+func replicationFactor(topic kafka.TopicMetadata) int {
+	if len(topic.Partitions) == 0 {
+		return 0
+	}
+
+	return len(topic.Partitions[0].Replicas)
+}
@@ -0,0 +1,174 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+)
+
+func liveTopic(name string, partitions int, replicas int) kafka.TopicMetadata {
+	topic := kafka.TopicMetadata{Topic: name}
+	for i := 0; i < partitions; i++ {
+		partition := kafka.PartitionMetadata{ID: int32(i)}
+		for broker := 0; broker < replicas; broker++ {
+			partition.Replicas = append(partition.Replicas, int32(broker))
+		}
+		topic.Partitions = append(topic.Partitions, partition)
+	}
+
+	return topic
+}
+
+func liveTopics(topics ...kafka.TopicMetadata) map[string]kafka.TopicMetadata {
+	live := map[string]kafka.TopicMetadata{}
+	for _, topic := range topics {
+		live[topic.Topic] = topic
+	}
+
+	return live
+}
+
+// Every live topic has retention.ms overridden to a day
+func describeRetention(topic string) (map[string]kafka.ConfigEntryResult, error) {
+	return map[string]kafka.ConfigEntryResult{
+		"retention.ms":   {Name: "retention.ms", Value: "86400000", Source: kafka.ConfigSourceDynamicTopic},
+		"cleanup.policy": {Name: "cleanup.policy", Value: "delete", Source: kafka.ConfigSourceDefault},
+	}, nil
+}
+
+func actionTypes(plan *Plan) map[string]Action {
+	actions := map[string]Action{}
+	for _, action := range plan.Actions {
+		actions[action.Topic+" "+action.Type] = action
+	}
+
+	return actions
+}
+
+func TestPlanCreatesAndGrows(t *testing.T) {
+	live := liveTopics(liveTopic("existing", 2, 1), liveTopic("unmanaged", 1, 1))
+	specs := []models.TopicSpec{
+		{Name: "missing", Partitions: 4},
+		{Name: "existing", Partitions: 6},
+	}
+
+	plan, err := planTopics(live, specs, false, describeRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := actionTypes(plan)
+	if len(actions) != 2 {
+		t.Fatalf("planned %v", plan.Actions)
+	}
+	if action, ok := actions["missing "+CREATE_TOPIC]; !ok || action.Destructive {
+		t.Errorf("missing topic isn't created: %v", plan.Actions)
+	}
+	if action, ok := actions["existing "+CREATE_PARTITIONS]; !ok || action.Destructive || action.spec.Partitions != 6 {
+		t.Errorf("existing topic doesn't grow: %v", plan.Actions)
+	}
+	for _, action := range plan.Actions {
+		if action.Topic == "unmanaged" {
+			t.Errorf("topic without a spec was touched: %v", action)
+		}
+	}
+}
+
+func TestPlanAltersConfigs(t *testing.T) {
+	live := liveTopics(liveTopic("longer", 1, 1), liveTopic("shorter", 1, 1), liveTopic("same", 1, 1))
+	specs := []models.TopicSpec{
+		{Name: "longer", Partitions: 1, Config: map[string]string{"retention.ms": "172800000", "compression.type": "lz4"}},
+		{Name: "shorter", Partitions: 1, Config: map[string]string{"retention.ms": "3600000"}},
+		{Name: "same", Partitions: 1, Config: map[string]string{"retention.ms": "86400000"}},
+	}
+
+	plan, err := planTopics(live, specs, false, describeRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := actionTypes(plan)
+	if len(actions) != 2 {
+		t.Fatalf("planned %v", plan.Actions)
+	}
+
+	longer := actions["longer "+ALTER_CONFIGS]
+	if longer.Destructive || longer.Refused || longer.Config["retention.ms"] != "172800000" || longer.Config["compression.type"] != "lz4" {
+		t.Errorf("longer retention isn't altered: %+v", longer)
+	}
+	if _, ok := longer.Config["cleanup.policy"]; ok {
+		t.Errorf("default configs are carried over: %v", longer.Config)
+	}
+
+	shorter := actions["shorter "+ALTER_CONFIGS]
+	if !shorter.Destructive || !shorter.Refused {
+		t.Errorf("shorter retention isn't refused: %+v", shorter)
+	}
+}
+
+func TestPlanRefusesRecreateWithoutForce(t *testing.T) {
+	live := liveTopics(liveTopic("shrunk", 6, 1), liveTopic("replicated", 2, 1))
+	specs := []models.TopicSpec{
+		{Name: "shrunk", Partitions: 3},
+		{Name: "replicated", Partitions: 4, ReplicationFactor: 3},
+	}
+
+	plan, err := planTopics(live, specs, false, describeRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := actionTypes(plan)
+	for _, topic := range []string{"shrunk", "replicated"} {
+		action, ok := actions[topic+" "+RECREATE_TOPIC]
+		if !ok || !action.Destructive || !action.Refused {
+			t.Errorf("%s: recreate isn't refused: %v", topic, plan.Actions)
+		}
+	}
+	// Without force the rest of the changes still apply
+	if _, ok := actions["replicated "+CREATE_PARTITIONS]; !ok {
+		t.Errorf("partitions aren't increased next to a refused recreate: %v", plan.Actions)
+	}
+	if len(plan.Refused()) != 2 {
+		t.Errorf("refused %v", plan.Refused())
+	}
+}
+
+func TestPlanRecreatesWithForce(t *testing.T) {
+	live := liveTopics(liveTopic("shrunk", 6, 1))
+	specs := []models.TopicSpec{{Name: "shrunk", Partitions: 3, Config: map[string]string{"retention.ms": "3600000"}}}
+
+	plan, err := planTopics(live, specs, true, describeRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Actions) != 1 || plan.Actions[0].Type != RECREATE_TOPIC || plan.Actions[0].Refused {
+		t.Errorf("planned %v, want a single recreate", plan.Actions)
+	}
+}
+
+func TestDestructiveConfigChange(t *testing.T) {
+	cases := []struct {
+		name        string
+		previous    string
+		value       string
+		destructive bool
+	}{
+		{name: "retention.ms", previous: "1000", value: "2000"},
+		{name: "retention.ms", previous: "2000", value: "1000", destructive: true},
+		{name: "retention.ms", previous: "-1", value: "1000", destructive: true},
+		{name: "retention.ms", previous: "1000", value: "-1"},
+		{name: "retention.bytes", previous: "", value: "1000", destructive: true},
+		{name: "cleanup.policy", previous: "delete", value: "compact", destructive: true},
+		{name: "cleanup.policy", previous: "", value: "compact"},
+		{name: "compression.type", previous: "gzip", value: "lz4"},
+	}
+
+	for _, c := range cases {
+		if destructiveConfigChange(c.name, c.previous, c.value) != c.destructive {
+			t.Errorf("%s %q -> %q: destructive should be %v", c.name, c.previous, c.value, c.destructive)
+		}
+	}
+}
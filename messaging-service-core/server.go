@@ -2,10 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"net/http"
 	"strconv"
@@ -13,17 +11,30 @@ import (
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-martini/martini"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_kafka "github.com/hectorandac/kafka-message-processor/common-kafka"
 	common_models "github.com/hectorandac/kafka-message-processor/common-models"
-	"github.com/hectorandac/kafka-message-processor/messaging-service-core/middlewares"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
+	common_provisioner "github.com/hectorandac/kafka-message-processor/common-provisioner"
+	common_retry "github.com/hectorandac/kafka-message-processor/common-retry"
+	common_serde "github.com/hectorandac/kafka-message-processor/common-serde"
 	"github.com/hectorandac/kafka-message-processor/messaging-service-core/models"
+	"github.com/hectorandac/kafka-message-processor/messaging-service-core/reconciler"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
+	"github.com/mitchellh/mapstructure"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+const SERVICE_NAME = "messaging-service-core"
+const DATABASE = "messaging_core"
+
 var configuration map[string]interface{}
 var kafkaAdminClient *kafka.AdminClient
+var codec *common_serde.Codec
+var provisionerClient *common_provisioner.Client = common_provisioner.NewClient(SERVICE_NAME)
 
 var processDuration int64 = 0
 var processedMessages int = 0
@@ -33,52 +44,106 @@ var registeredConsumers map[string]int64 = make(map[string]int64)
 var queuesPriorities map[string]float64 = make(map[string]float64)
 
 func main() {
+	common_health.Register(common_provisioner.COMPONENT)
+	common_health.Register(common_kafka.COMPONENT)
+	common_health.RegisterCheck(common_kafka.COMPONENT, true, func() error { return common_kafka.Check(kafkaAdminClient)() })
+	common_health.RegisterCheck(common_provisioner.COMPONENT, false, provisionerClient.Check)
 
 	m := martini.Classic()
-	m.Use(middlewares.MongoDB())
+	m.Use(common_health.RequireReady())
+	m.Use(common_mongo.MongoDB(DATABASE))
 	m.Use(render.Renderer())
 
-	setupEnvironment()
+	go runCampaigns()
+	go func() {
+		startEnvironment()
 
-	fmt.Println(registeredConsumers)
-	fmt.Println(queuesPriorities)
+		fmt.Println(registeredConsumers)
+		fmt.Println(queuesPriorities)
 
-	go consumeReporting()
+		consumeReporting()
+	}()
 
+	m.Get("/livez", common_health.LivezHandler)
+	m.Get("/readyz", common_health.ReadyzHandler)
 	m.Get("/health", health)
 	m.Patch("/core/reconfigure", reconfigure)
+	m.Get("/core/topics/plan", topicPlan)
+	m.Get("/core/topics/drift", topicDrift)
 	m.Post("/sender/register", binding.Bind(models.Sender{}), register)
 	m.Patch("/sender/:sender_name/validate", func(params martini.Params, r render.Render, db *mgo.Database) { validateSender(true, params, r, db) })
 	m.Patch("/sender/:sender_name/invalidate", func(params martini.Params, r render.Render, db *mgo.Database) { validateSender(false, params, r, db) })
 	m.Get("/sender/:sender_name", showValidate)
 	m.Get("/register_consumer", register_consumer)
-
-	m.RunOnAddr(":3000")
+	m.Post("/template", binding.Bind(common_models.Template{}), createTemplate)
+	m.Put("/template/:template_id", binding.Bind(common_models.Template{}), updateTemplate)
+	m.Get("/template/:template_id", showTemplate)
+	m.Get("/template/:template_id/versions", templateVersions)
+	m.Delete("/template/:template_id", deleteTemplate)
+	m.Post("/suppression", binding.Bind(common_models.Suppression{}), addSuppression)
+	m.Post("/suppression/import", importSuppressions)
+	m.Get("/suppression/:recipient", showSuppression)
+	m.Delete("/suppression/:recipient", removeSuppression)
+	m.Get("/suppressions", listSuppressions)
+	m.Post("/campaign", binding.Bind(models.Campaign{}), createCampaign)
+	m.Get("/campaign/:campaign_id", showCampaign)
+	m.Get("/campaign/:campaign_id/recipients", campaignRecipients)
+	m.Post("/campaign/:campaign_id/audience", uploadAudience)
+	m.Post("/campaign/:campaign_id/start", startCampaign)
+	m.Post("/campaign/:campaign_id/cancel", cancelCampaign)
+	m.Get("/campaigns", listCampaigns)
+
+	m.RunOnAddr(common_config.Get(common_config.LISTEN_ADDRESS, ":3000"))
 }
 
 func consumeReporting() {
 	fmt.Println("Started consuming")
 
-	consumerClient, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": configuration["kafka_host"],
-		"group.id":          "message_stats",
-		"auto.offset.reset": "earliest",
-	})
-	if err != nil {
-		panic(err)
-	}
+	// Retried until it succeeds, the service stays not ready meanwhile
+	var consumerClient *kafka.Consumer
+	var db *mgo.Database
+	var session *mgo.Session
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		var err error
+		consumerClient, err = reportingConsumer()
+		if err != nil {
+			fmt.Printf("Couldn't consume the reporting queue (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_kafka.COMPONENT, err.Error())
+			return err
+		}
+
+		db, session, err = common_mongo.Connect(DATABASE)
+		if err != nil {
+			fmt.Printf("Couldn't connect to the database (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_mongo.COMPONENT, err.Error())
+			consumerClient.Close()
+			return err
+		}
 
-	consumerClient.SubscribeTopics([]string{configuration["reporting_queue"].(string)}, nil)
+		common_health.SetReady(common_kafka.COMPONENT)
+		common_health.SetReady(common_mongo.COMPONENT)
+		return nil
+	})
+	defer consumerClient.Close()
+	defer session.Close()
 
 	for {
 		msg, err := consumerClient.ReadMessage(-1)
 		if err == nil {
-			var result common_models.Message
-			json.Unmarshal(msg.Value, &result)
-			processDuration += result.ReceivedOn - result.CreatedOn
+			headers, ok := common_kafka.ReadHeaders(msg)
+			if ok && headers.CampaignId != "" {
+				countReport(db, headers)
+			}
+			// Queued and suppressed reports come from the producer, nothing was sent yet
+			if ok && (headers.Status == common_models.QUEUED || headers.Status == common_models.SUPPRESSED) {
+				continue
+			}
+
+			createdOn, receivedOn := reportingTimestamps(msg)
+			processDuration += receivedOn - createdOn
 			processedMessages += 1
 
-			key := strconv.FormatInt((result.ReceivedOn / 1000000000), 10)
+			key := strconv.FormatInt((receivedOn / 1000000000), 10)
 
 			messagesPerSecond[key] = messagesPerSecond[key] + 1
 		} else {
@@ -87,15 +152,53 @@ func consumeReporting() {
 	}
 }
 
+func reportingConsumer() (*kafka.Consumer, error) {
+	reportingQueue, ok := configuration["reporting_queue"].(string)
+	if !ok || reportingQueue == "" {
+		return nil, &common_kafka.ConfigurationError{Key: "reporting_queue"}
+	}
+
+	consumerClient, err := common_kafka.NewConsumer(configuration, "message_stats")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := consumerClient.SubscribeTopics([]string{reportingQueue}, nil); err != nil {
+		consumerClient.Close()
+		return nil, err
+	}
+
+	return consumerClient, nil
+}
+
+// Timestamps come from the headers, the body is only decoded for messages produced without them
+func reportingTimestamps(msg *kafka.Message) (int64, int64) {
+	headers, ok := common_kafka.ReadHeaders(msg)
+	if ok && headers.CreatedOn != 0 && headers.ReceivedOn != 0 {
+		return headers.CreatedOn, headers.ReceivedOn
+	}
+
+	result, _ := codec.Deserialize(msg.Value)
+	return result.CreatedOn, result.ReceivedOn
+}
+
 func health(r render.Render, db *mgo.Database) {
-	healthResult := map[string]interface{}{"status": "successful"}
+	ready, components := common_health.Evaluate()
+
+	healthResult := map[string]interface{}{"status": "successful", "components": components}
+	if !ready {
+		healthResult["status"] = "failure"
+	}
+
 	if configuration != nil {
-		healthResult["kafka_configuration"] = configuration
+		healthResult["kafka_configuration"] = common_health.Redact(configuration)
 	}
 
-	kafkaInfo, kErr := obtainKafkaServerInfo(kafkaAdminClient)
-	if kErr == nil {
-		healthResult["kafka_server_information"] = kafkaInfo
+	if kafkaAdminClient != nil {
+		kafkaInfo, kErr := obtainKafkaServerInfo(kafkaAdminClient)
+		if kErr == nil {
+			healthResult["kafka_server_information"] = common_health.Redact(kafkaInfo)
+		}
 	}
 
 	if processedMessages != 0 {
@@ -113,7 +216,11 @@ func health(r render.Render, db *mgo.Database) {
 		healthResult["messages_per_second"] = messages_sum / messages_count
 	}
 
-	r.JSON(200, healthResult)
+	if ready {
+		r.JSON(200, healthResult)
+	} else {
+		r.JSON(503, healthResult)
+	}
 }
 
 func register_consumer(r render.Render, db *mgo.Database) {
@@ -154,16 +261,45 @@ func register_consumer(r render.Render, db *mgo.Database) {
 	if err != nil {
 		r.JSON(400, map[string]interface{}{"error": err.Error()})
 	} else {
-		r.JSON(200, map[string]interface{}{"result": "registered", "subscription_target": subscription_target})
+		r.JSON(200, map[string]interface{}{"result": "registered", "subscription_target": subscription_target, "lanes": queueLanes(subscription_target)})
 	}
 }
 
-func reconfigure(r render.Render, db *mgo.Database) {
-	success, e := setupEnvironment()
-	if success {
-		r.JSON(200, map[string]interface{}{"status": "successful"})
+// Query parameters: dry_run only returns the topic plan, force allows destructive topic changes
+func reconfigure(req *http.Request, r render.Render, db *mgo.Database) {
+	force := req.URL.Query().Get("force") == "true"
+
+	// The preview plans against the configuration reconfigure would apply, not the loaded one
+	if req.URL.Query().Get("dry_run") == "true" {
+		result, err := provisionerClient.Configuration(common_provisioner.KAFKA_SERVICE_CONFIG)
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"status": "failure", "error": err.Error()})
+			return
+		}
+
+		plan, err := planTopics(result, force)
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"status": "failure", "error": err.Error()})
+		} else {
+			r.JSON(200, map[string]interface{}{"status": "successful", "plan": plan})
+		}
+		return
+	}
+
+	plan, e := setupEnvironment(force)
+	if e == nil {
+		r.JSON(200, map[string]interface{}{"status": "successful", "plan": plan})
+	} else {
+		r.JSON(400, map[string]interface{}{"status": "failure", "error": e.Error(), "plan": plan})
+	}
+}
+
+func topicPlan(req *http.Request, r render.Render) {
+	plan, err := planTopics(configuration, req.URL.Query().Get("force") == "true")
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"status": "failure", "error": err.Error()})
 	} else {
-		r.JSON(400, map[string]interface{}{"status": "failure", "error": e.Error()})
+		r.JSON(200, map[string]interface{}{"status": "successful", "plan": plan})
 	}
 }
 
@@ -206,95 +342,158 @@ func showValidate(params martini.Params, r render.Render, db *mgo.Database) {
 	}
 }
 
-func setupEnvironment() (bool, error) {
-	url := "http://localhost:3010/config/kafka_service_config"
-	body, err := getRequest(url)
+// Blocks until the configuration is retrieved and applied against the brokers
+func startEnvironment() {
+	result, _ := provisionerClient.WaitForConfiguration(common_provisioner.KAFKA_SERVICE_CONFIG)
+
+	common_retry.Retry(common_retry.DefaultBackoff(), 0, func(attempt int) error {
+		_, err := applyConfiguration(result, false)
+		if err != nil {
+			fmt.Printf("Couldn't apply the configuration (attempt %d): %v\n", attempt, err)
+			common_health.SetNotReady(common_kafka.COMPONENT, err.Error())
+			return err
+		}
+
+		common_health.SetReady(common_kafka.COMPONENT)
+		return nil
+	})
+}
+
+func setupEnvironment(force bool) (*reconciler.Plan, error) {
+	result, err := provisionerClient.Configuration(common_provisioner.KAFKA_SERVICE_CONFIG)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyConfiguration(result, force)
+}
+
+func applyConfiguration(result map[string]interface{}, force bool) (*reconciler.Plan, error) {
+	configuration = result
 
+	c, err := common_serde.NewCodec(configuration)
 	if err != nil {
-		return false, errors.New("couldn't retrieve information form provisioning service")
+		return nil, err
 	}
+	codec = c
 
-	if body["status"] == "successful" {
-		configuration = body["result"].(map[string]interface{})
+	a, err := common_kafka.NewAdminClient(configuration)
+	if err != nil {
+		return nil, errors.New("couldn't connect to the kafka server")
+	}
 
-		a, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": configuration["kafka_host"]})
-		if err != nil {
-			return false, errors.New("couldn't connect to the kafka server")
-		}
-		kafkaAdminClient = a
+	_, err = a.GetMetadata(nil, false, int(5*time.Second))
+	if err != nil {
+		a.Close()
+		return nil, errors.New("couldn't retrieve information from the kafka server")
+	}
+	if previous := kafkaAdminClient; previous != nil {
+		defer previous.Close()
+	}
+	kafkaAdminClient = a
 
-		md, err := kafkaAdminClient.GetMetadata(nil, false, int(5*time.Second))
-		if err != nil {
-			return false, errors.New("couldn't retrieve information from the kafka server")
-		}
+	plan, err := planTopics(configuration, force)
+	if err != nil {
+		return nil, err
+	}
 
-		topics := md.Topics
-		queues := configuration["queues"].([]interface{})
-
-		createTopic(configuration["reporting_queue"].(string), 10)
-
-		for _, queue := range queues {
-			found := false
-			partitionSizeDifference := 0
-			info := queue.(map[string]interface{})
-			for _, t := range topics {
-				if t.Topic == info["name"].(string) {
-					found = true
-					partitionSizeDifference = len(t.Partitions) - int(info["partitions"].(float64))
-					break
-				}
-			}
+	for _, action := range plan.Refused() {
+		fmt.Printf("Refused %s on %s: %s\n", action.Type, action.Topic, action.Description)
+	}
 
-			if !found {
-				createTopic(info["name"].(string), int(info["partitions"].(float64)))
-			} else if partitionSizeDifference != 0 {
-				removeTopic(info["name"].(string))
-				createTopic(info["name"].(string), int(info["partitions"].(float64)))
-			}
+	if err := reconciler.Apply(kafkaAdminClient, plan); err != nil {
+		return plan, err
+	}
 
-			registeredConsumers[info["name"].(string)] = 0
-			queuesPriorities[info["name"].(string)] = info["priority"].(float64) / 100.0
-		}
+	queues, _ := queueDefinitions(configuration)
+	for _, queue := range queues {
+		registeredConsumers[queue.Name] = 0
+		queuesPriorities[queue.Name] = queue.Priority / 100.0
 	}
 
-	return true, nil
+	return plan, nil
 }
 
-func getRequest(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+func queueDefinitions(configuration map[string]interface{}) ([]models.QueueDefinition, error) {
+	queues := []models.QueueDefinition{}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{WeaklyTypedInput: true, Result: &queues})
 	if err != nil {
-		return map[string]interface{}{}, err
+		return nil, err
+	}
+
+	if err := decoder.Decode(configuration["queues"]); err != nil {
+		return nil, fmt.Errorf("invalid queue definitions: %v", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	for _, queue := range queues {
+		if err := queue.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return queues, nil
+}
+
+// Topics a consumer of queue reads, the most urgent first
+func queueLanes(queue string) []string {
+	queues, _ := queueDefinitions(configuration)
+	for _, definition := range queues {
+		if definition.Name == queue {
+			return definition.Lanes()
+		}
+	}
+
+	return []string{queue}
+}
+
+func topicSpecs(configuration map[string]interface{}) ([]models.TopicSpec, error) {
+	queues, err := queueDefinitions(configuration)
 	if err != nil {
-		return map[string]interface{}{}, err
+		return nil, err
 	}
 
-	return toJson(string(body)), err
+	reportingQueue, _ := configuration["reporting_queue"].(string)
+	if reportingQueue == "" {
+		return nil, errors.New("no reporting_queue configured")
+	}
+
+	specs := []models.TopicSpec{{Name: reportingQueue, Partitions: 10}}
+	for _, queue := range queues {
+		specs = append(specs, queue.TopicSpecs()...)
+	}
+
+	return specs, nil
 }
 
-func createTopic(name string, partitions int) ([]kafka.TopicResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// Dry run of the topic reconciliation against configuration
+func planTopics(configuration map[string]interface{}, force bool) (*reconciler.Plan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	r, err := kafkaAdminClient.CreateTopics(ctx, []kafka.TopicSpecification{{Topic: name, NumPartitions: partitions, ReplicationFactor: 1}})
+
+	specs, err := topicSpecs(configuration)
 	if err != nil {
-		fmt.Println(err.Error())
+		return nil, err
 	}
 
-	return r, err
+	return reconciler.BuildPlan(ctx, kafkaAdminClient, specs, force)
 }
 
-func removeTopic(name string) ([]kafka.TopicResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func topicDrift(r render.Render) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	r, err := kafkaAdminClient.DeleteTopics(ctx, []string{name})
+	specs, err := topicSpecs(configuration)
 	if err != nil {
-		fmt.Println(err.Error())
+		r.JSON(400, map[string]interface{}{"status": "failure", "error": err.Error()})
+		return
 	}
 
-	return r, err
+	drift, err := reconciler.Drift(ctx, kafkaAdminClient, specs)
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"status": "failure", "error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"status": "successful", "in_sync": len(drift) == 0, "drift": drift})
+	}
 }
 
 func obtainKafkaServerInfo(adminClient *kafka.AdminClient) (map[string]interface{}, error) {
@@ -330,9 +529,3 @@ func obtainKafkaServerInfo(adminClient *kafka.AdminClient) (map[string]interface
 	}
 	return kafkaServerInformation, kError
 }
-
-func toJson(jsonString string) map[string]interface{} {
-	var result map[string]interface{}
-	json.Unmarshal([]byte(jsonString), &result)
-	return result
-}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/martini-contrib/render"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const SUPPRESSION_COLLECTION = "suppression"
+const MAX_IMPORT_BYTES = 64 << 20
+const DEFAULT_PAGE_SIZE = 100
+
+var suppressionIndex = mgo.Index{Key: []string{"recipient", "sender"}, Unique: true}
+
+// The producer normalizes messages with the same default_country_code, a
+// national number suppressed here matches messages sent to it
+func defaultCountryCode() string {
+	code, _ := configuration["default_country_code"].(string)
+	return code
+}
+
+func suppressionKey(recipient string) string {
+	return common_models.SuppressionKey(recipient, defaultCountryCode())
+}
+
+func upsertSuppression(bulk *mgo.Bulk, key string, suppression common_models.Suppression, source string) {
+	bulk.Upsert(
+		bson.M{"recipient": key, "sender": suppression.Sender},
+		bson.M{
+			"$set":         bson.M{"reason": suppression.Reason, "source": source},
+			"$setOnInsert": bson.M{"created_on": time.Now().UnixNano()},
+		},
+	)
+}
+
+func addSuppression(suppression common_models.Suppression, r render.Render, db *mgo.Database) {
+	key := suppressionKey(suppression.Recipient)
+	if !common_models.ValidRecipient(key) {
+		r.JSON(400, map[string]interface{}{"error": "recipient must be an E.164 phone number or an email address", "fields": map[string]string{"recipient": common_models.RECIPIENT_VALIDATION}})
+		return
+	}
+	db.C(SUPPRESSION_COLLECTION).EnsureIndex(suppressionIndex)
+
+	bulk := db.C(SUPPRESSION_COLLECTION).Bulk()
+	upsertSuppression(bulk, key, suppression, common_models.SUPPRESSION_API)
+	if _, err := bulk.Run(); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"status": "successful", "recipient": key, "sender": suppression.Sender})
+}
+
+// Imports a JSON array of suppressions, or CSV rows of recipient, sender and
+// reason when sent as text/csv. Entries already present are updated
+func importSuppressions(req *http.Request, r render.Render, db *mgo.Database) {
+	suppressions := []common_models.Suppression{}
+	body := io.LimitReader(req.Body, MAX_IMPORT_BYTES)
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				r.JSON(400, map[string]interface{}{"error": err.Error()})
+				return
+			}
+
+			if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "recipient") {
+				continue
+			}
+			suppression := common_models.Suppression{Recipient: record[0]}
+			if len(record) > 1 {
+				suppression.Sender = strings.TrimSpace(record[1])
+			}
+			if len(record) > 2 {
+				suppression.Reason = strings.TrimSpace(record[2])
+			}
+			suppressions = append(suppressions, suppression)
+		}
+	} else if err := json.NewDecoder(body).Decode(&suppressions); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	db.C(SUPPRESSION_COLLECTION).EnsureIndex(suppressionIndex)
+	bulk := db.C(SUPPRESSION_COLLECTION).Bulk()
+	bulk.Unordered()
+
+	skipped := 0
+	for _, suppression := range suppressions {
+		key := suppressionKey(suppression.Recipient)
+		if !common_models.ValidRecipient(key) {
+			skipped++
+			continue
+		}
+		upsertSuppression(bulk, key, suppression, common_models.SUPPRESSION_IMPORT)
+	}
+
+	result, err := bulk.Run()
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"status": "successful", "imported": len(suppressions) - skipped, "skipped": skipped, "matched": result.Matched})
+}
+
+// Lists the suppressions of a recipient, suppressed is false when there is none
+func showSuppression(params martini.Params, r render.Render, db *mgo.Database) {
+	suppressions := []common_models.Suppression{}
+	recipient := suppressionKey(params["recipient"])
+	if err := db.C(SUPPRESSION_COLLECTION).Find(bson.M{"recipient": recipient}).All(&suppressions); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"recipient": recipient, "suppressed": len(suppressions) > 0, "suppressions": suppressions})
+}
+
+// Removes the suppression of ?sender=, the global one when not given
+func removeSuppression(params martini.Params, req *http.Request, r render.Render, db *mgo.Database) {
+	filter := bson.M{"recipient": suppressionKey(params["recipient"]), "sender": req.URL.Query().Get("sender")}
+	err := db.C(SUPPRESSION_COLLECTION).Remove(filter)
+	if err == mgo.ErrNotFound {
+		r.JSON(404, map[string]interface{}{"error": "suppression not found"})
+	} else if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, map[string]interface{}{"status": "successful"})
+	}
+}
+
+// Pages through the suppressions, optionally of a single ?sender=
+func listSuppressions(req *http.Request, r render.Render, db *mgo.Database) {
+	query := req.URL.Query()
+	skip, _ := strconv.Atoi(query.Get("skip"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+
+	filter := bson.M{}
+	if _, ok := query["sender"]; ok {
+		filter["sender"] = query.Get("sender")
+	}
+
+	suppressions := []common_models.Suppression{}
+	total, err := db.C(SUPPRESSION_COLLECTION).Find(filter).Count()
+	if err == nil {
+		err = db.C(SUPPRESSION_COLLECTION).Find(filter).Sort("recipient").Skip(skip).Limit(limit).All(&suppressions)
+	}
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"total": total, "skip": skip, "limit": limit, "suppressions": suppressions})
+}
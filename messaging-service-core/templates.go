@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	common_models "github.com/hectorandac/kafka-message-processor/common-models"
+	"github.com/martini-contrib/render"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const TEMPLATE_COLLECTION = "template"
+
+var templateIndex = mgo.Index{Key: []string{"template_id", "version"}, Unique: true}
+
+// A deleted template_id can be created again, it continues after the
+// numbers of its deleted versions which stay hidden
+func createTemplate(template common_models.Template, r render.Render, db *mgo.Database) {
+	if count, _ := db.C(TEMPLATE_COLLECTION).Find(bson.M{"template_id": template.TemplateId, "deleted": false}).Count(); count > 0 {
+		r.JSON(409, map[string]interface{}{"error": "template " + template.TemplateId + " already exists"})
+		return
+	}
+
+	latest := common_models.Template{}
+	err := db.C(TEMPLATE_COLLECTION).Find(bson.M{"template_id": template.TemplateId}).Sort("-version").One(&latest)
+	if err != nil && err != mgo.ErrNotFound {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	storeTemplateVersion(template, latest.Version+1, r, db)
+}
+
+// Updates never modify a stored version, the new content is saved as the next one
+func updateTemplate(template common_models.Template, params martini.Params, r render.Render, db *mgo.Database) {
+	latest, err := findTemplate(db, params["template_id"], 0)
+	if err != nil {
+		r.JSON(404, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	template.TemplateId = latest.TemplateId
+	if template.DefaultLocale == "" {
+		template.DefaultLocale = latest.DefaultLocale
+	}
+
+	storeTemplateVersion(template, latest.Version+1, r, db)
+}
+
+func storeTemplateVersion(template common_models.Template, version int, r render.Render, db *mgo.Database) {
+	if template.DefaultLocale == "" {
+		template.DefaultLocale = common_models.DEFAULT_LOCALE
+	}
+	if err := template.Validate(); err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	variables := map[string]bool{}
+	template.Variables = []string{}
+	for _, body := range template.Bodies {
+		for _, name := range common_models.TemplateVariables(body) {
+			if !variables[name] {
+				variables[name] = true
+				template.Variables = append(template.Variables, name)
+			}
+		}
+	}
+
+	template.Id = bson.NewObjectId()
+	template.Version = version
+	template.Deleted = false
+	template.CreatedOn = time.Now().UnixNano()
+
+	db.C(TEMPLATE_COLLECTION).EnsureIndex(templateIndex)
+	if err := db.C(TEMPLATE_COLLECTION).Insert(template); err != nil {
+		if mgo.IsDup(err) {
+			r.JSON(409, map[string]interface{}{"error": "template was updated concurrently, retry"})
+		} else {
+			r.JSON(400, map[string]interface{}{"error": err.Error()})
+		}
+		return
+	}
+
+	r.JSON(200, map[string]interface{}{"status": "successful", "template": template})
+}
+
+// Returns the requested version, the latest one when ?version= is not given
+func showTemplate(params martini.Params, req *http.Request, r render.Render, db *mgo.Database) {
+	version := 0
+	if value := req.URL.Query().Get("version"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			r.JSON(400, map[string]interface{}{"error": "version must be a positive integer"})
+			return
+		}
+		version = parsed
+	}
+
+	template, err := findTemplate(db, params["template_id"], version)
+	if err != nil {
+		r.JSON(404, map[string]interface{}{"error": err.Error()})
+	} else {
+		r.JSON(200, template)
+	}
+}
+
+func templateVersions(params martini.Params, r render.Render, db *mgo.Database) {
+	templates := []common_models.Template{}
+	filter := bson.M{"template_id": params["template_id"], "deleted": false}
+	err := db.C(TEMPLATE_COLLECTION).Find(filter).Sort("-version").All(&templates)
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else if len(templates) == 0 {
+		r.JSON(404, map[string]interface{}{"error": "template " + params["template_id"] + " not found"})
+	} else {
+		r.JSON(200, map[string]interface{}{"template_id": params["template_id"], "versions": templates})
+	}
+}
+
+// Versions are kept for auditing, deleting only hides them from rendering
+func deleteTemplate(params martini.Params, r render.Render, db *mgo.Database) {
+	filter := bson.M{"template_id": params["template_id"], "deleted": false}
+	info, err := db.C(TEMPLATE_COLLECTION).UpdateAll(filter, bson.M{"$set": bson.M{"deleted": true}})
+	if err != nil {
+		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	} else if info.Updated == 0 {
+		r.JSON(404, map[string]interface{}{"error": "template " + params["template_id"] + " not found"})
+	} else {
+		r.JSON(200, map[string]interface{}{"status": "successful", "deleted_versions": info.Updated})
+	}
+}
+
+func findTemplate(db *mgo.Database, templateId string, version int) (common_models.Template, error) {
+	template := common_models.Template{}
+	filter := bson.M{"template_id": templateId, "deleted": false}
+	if version > 0 {
+		filter["version"] = version
+	}
+
+	err := db.C(TEMPLATE_COLLECTION).Find(filter).Sort("-version").One(&template)
+	if err == mgo.ErrNotFound {
+		if version > 0 {
+			err = errors.New("template " + templateId + " version " + strconv.Itoa(version) + " not found")
+		} else {
+			err = errors.New("template " + templateId + " not found")
+		}
+	}
+
+	return template, err
+}
@@ -7,6 +7,7 @@ import (
 type ConfigurationDefinition struct {
 	Id        bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
 	Key       string        `json:"key" form:"key" binding:"required" bson:"key"`
+	Namespace string        `json:"namespace" form:"namespace" bson:"namespace"`
 	Value     string        `json:"value" form:"value" binding:"required" bson:"value"`
 	CreatedOn int64         `json:"created_on" bson:"created_on"`
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
+	"strings"
 
 	"github.com/go-martini/martini"
-	"github.com/hectorandac/kafka-message-processor/provisioner/middlewares"
+	common_config "github.com/hectorandac/kafka-message-processor/common-config"
+	common_health "github.com/hectorandac/kafka-message-processor/common-health"
+	common_mongo "github.com/hectorandac/kafka-message-processor/common-mongo"
 	"github.com/hectorandac/kafka-message-processor/provisioner/models"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
@@ -12,24 +16,30 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+const DATABASE = "provisioning"
+
 // var kafkaAdminClient *kafka.AdminClient
 // var kafkaDefinition common_models.KafkaDefinition
 
 func main() {
 	m := martini.Classic()
-	m.Use(middlewares.MongoDB())
+	m.Use(common_mongo.MongoDB(DATABASE))
 	m.Use(render.Renderer())
 
+	m.Get("/livez", common_health.LivezHandler)
+	m.Get("/readyz", common_health.ReadyzHandler)
+
 	m.Post("/config", binding.Bind(models.ConfigurationDefinition{}), ubsertConfiguration)
 	m.Get("/config/:configuration_key", retrieveConfig)
 
-	m.RunOnAddr(":3010")
+	m.RunOnAddr(common_config.Get(common_config.LISTEN_ADDRESS, ":3010"))
 }
 
 func ubsertConfiguration(configuration models.ConfigurationDefinition, r render.Render, db *mgo.Database) {
 	var err error
 	var count int
-	filter := bson.M{"key": configuration.Key}
+	configuration.Namespace = normalizeNamespace(configuration.Namespace)
+	filter := namespaceFilter(configuration.Key, configuration.Namespace)
 
 	if (models.ConfigurationDefinition{}) != configuration {
 		count, err = db.C("configuration_definition").Find(filter).Count()
@@ -58,18 +68,89 @@ func ubsertConfiguration(configuration models.ConfigurationDefinition, r render.
 	}
 }
 
-func retrieveConfig(params martini.Params, r render.Render, db *mgo.Database) {
-	var err error
-	var configuration models.ConfigurationDefinition = models.ConfigurationDefinition{}
+// Resolves the configuration for a namespace by merging every level of it,
+// "prod/tenant-a/message-producer" inherits from the root, "prod" and
+// "prod/tenant-a" definitions and overrides them in that order
+func retrieveConfig(params martini.Params, req *http.Request, r render.Render, db *mgo.Database) {
+	namespace := normalizeNamespace(req.URL.Query().Get("namespace"))
+
+	result := map[string]interface{}{}
+	sources := []string{}
+	for _, level := range namespaceChain(namespace) {
+		var configuration models.ConfigurationDefinition = models.ConfigurationDefinition{}
+
+		err := db.C("configuration_definition").Find(namespaceFilter(params["configuration_key"], level)).One(&configuration)
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			r.JSON(400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+
+		var value map[string]interface{}
+		if err := json.Unmarshal([]byte(configuration.Value), &value); err != nil {
+			r.JSON(400, map[string]interface{}{"error": err.Error(), "namespace": level})
+			return
+		}
+
+		result = mergeConfiguration(result, value)
+		sources = append(sources, level)
+	}
 
-	filter := bson.M{"key": params["configuration_key"]}
-	err = db.C("configuration_definition").Find(filter).One(&configuration)
-	if err != nil {
-		r.JSON(400, map[string]interface{}{"error": err.Error()})
+	if len(sources) == 0 {
+		r.JSON(400, map[string]interface{}{"error": mgo.ErrNotFound.Error()})
 	} else {
-		var result map[string]interface{}
-		json.Unmarshal([]byte(configuration.Value), &result)
+		r.JSON(200, map[string]interface{}{"status": "successful", "result": result, "namespace": namespace, "sources": sources})
+	}
+}
+
+func normalizeNamespace(namespace string) string {
+	segments := []string{}
+	for _, segment := range strings.Split(namespace, "/") {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
 
-		r.JSON(200, map[string]interface{}{"status": "successful", "result": result})
+	return strings.Join(segments, "/")
+}
+
+// Lists the namespace and its ancestors from the root down
+func namespaceChain(namespace string) []string {
+	chain := []string{""}
+	if namespace == "" {
+		return chain
+	}
+
+	segments := strings.Split(namespace, "/")
+	for i := range segments {
+		chain = append(chain, strings.Join(segments[:i+1], "/"))
+	}
+
+	return chain
+}
+
+// Definitions created before namespaces existed have no namespace field and belong to the root
+func namespaceFilter(key string, namespace string) bson.M {
+	if namespace == "" {
+		return bson.M{"key": key, "namespace": bson.M{"$in": []interface{}{"", nil}}}
 	}
+
+	return bson.M{"key": key, "namespace": namespace}
+}
+
+// Deep merges override into base, nested objects are merged and any other value is replaced
+func mergeConfiguration(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	for key, value := range override {
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		baseMap, baseIsMap := base[key].(map[string]interface{})
+
+		if overrideIsMap && baseIsMap {
+			base[key] = mergeConfiguration(baseMap, overrideMap)
+		} else {
+			base[key] = value
+		}
+	}
+
+	return base
 }